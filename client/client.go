@@ -2,15 +2,18 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/copperwall/bittorrent-go/bitfield"
 	"github.com/copperwall/bittorrent-go/handshake"
 	"github.com/copperwall/bittorrent-go/message"
+	"github.com/copperwall/bittorrent-go/mse"
 	"github.com/copperwall/bittorrent-go/peers"
 )
 
@@ -18,18 +21,36 @@ type Client struct {
 	Conn net.Conn
 	Choked bool
 	Bitfield bitfield.Bitfield
+	// AmChoking is whether we're choking the peer, and PeerInterested is
+	// whether the peer wants something from us. Together they decide if
+	// we upload to the peer.
+	AmChoking bool
+	PeerInterested bool
+	// RemoteID is the peer ID the other side sent in its handshake
+	RemoteID [20]byte
+	// reserved is the reserved bytes from the other side's handshake,
+	// which say what extensions it speaks
+	reserved handshake.Reserved
+	// early is messages that arrived while we were waiting for the
+	// bitfield. Read returns them first.
+	early []*message.Message
+	// inbound is set if the peer connected to us
+	inbound bool
 	peer peers.Peer
 	infoHash [20]byte
 	peerID [20]byte
+	// Messages can be sent from more than one goroutine, e.g. uploads
+	// going out while a piece is being requested.
+	mu sync.Mutex
 }
 
 func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Handshake, error) {
 	conn.SetDeadline(time.Now().Add(10 * time.Second))
 	defer conn.SetDeadline(time.Time{})
 
-	fmt.Println("lol")
-	fmt.Println(infohash, peerID)
 	req := handshake.New(infohash, peerID)
+	req.Reserved.Set(handshake.ExtensionProtocol)
+	req.Reserved.Set(handshake.Fast)
 
 	_, err := conn.Write(req.Serialize())
 	if err != nil {
@@ -49,57 +70,241 @@ func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Han
 	return res, nil
 }
 
-func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
+// recvBitfield waits for the peer's bitfield. Peers that speak the extension
+// protocol might send their extension handshake first, those messages are
+// returned along with the bitfield. Peers that speak the fast extension can
+// send HaveAll or HaveNone instead, then the bitfield is nil and the message
+// is returned last in early for the caller to handle.
+func recvBitfield(conn net.Conn, fast bool) (bitfield.Bitfield, []*message.Message, error) {
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
 	defer conn.SetDeadline(time.Time{}) // Disable the deadline after the function finishes
 
-	msg, err := message.Read(conn)
+	early := []*message.Message{}
+
+	for {
+		msg, err := message.Read(conn)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if msg != nil && msg.ID == message.MsgExtended && len(early) < 4 {
+			early = append(early, msg)
+			continue
+		}
+
+		if fast && msg != nil && (msg.ID == message.MsgHaveAll || msg.ID == message.MsgHaveNone) {
+			return nil, append(early, msg), nil
+		}
+
+		if msg == nil || msg.ID != message.MsgBitfield {
+			err := fmt.Errorf("Expected bitfield but got %s", msg)
+			return nil, nil, err
+		}
+
+		return msg.Payload, early, nil
+	}
+}
+
+// New connects to a peer and completes the handshake. policy decides if
+// the connection is encrypted. Cancelling ctx gives up on the peer, even
+// halfway through the handshake.
+func New(ctx context.Context, peer peers.Peer, peerID, infoHash [20]byte, policy mse.Policy) (*Client, error) {
+	conn, err := Dial(ctx, peer, infoHash, policy)
 
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Println(msg.ID)
-	if msg.ID != message.MsgBitfield {
-		err := fmt.Errorf("Expected bitfield but got ID %d", msg.ID)
+	stop := closeOnCancel(ctx, conn)
+
+	res, err := completeHandshake(conn, infoHash, peerID)
+
+	var bf bitfield.Bitfield
+	var early []*message.Message
+	if err == nil {
+		bf, early, err = recvBitfield(conn, res.Reserved.Has(handshake.Fast))
+	}
+
+	if !stop() {
+		return nil, ctx.Err()
+	}
+
+	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	return msg.Payload, nil
+	return &Client {
+		Conn: conn,
+		Choked: true,
+		Bitfield: bf,
+		AmChoking: true,
+		RemoteID: res.PeerID,
+		reserved: res.Reserved,
+		early: early,
+		peer: peer,
+		infoHash: infoHash,
+		peerID: peerID,
+	}, nil
 }
 
-func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3 * time.Second)
+// Dial connects to a peer and runs the MSE handshake if policy asks for
+// it. Peers that don't speak MSE hang up on it, so unless encryption is
+// required they get another try in plaintext. The BitTorrent handshake is
+// left to the caller.
+func Dial(ctx context.Context, peer peers.Peer, infoHash [20]byte, policy mse.Policy) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: 3 * time.Second}
 
-	if err != nil {
-		return nil, err
+	// peer.String() brackets IPv6 addresses, which is what Dial expects
+	conn, err := dialer.DialContext(ctx, peer.Network(), peer.String())
+
+	if err != nil || policy == mse.Disabled {
+		return conn, err
 	}
 
-	// TODO Implement
-	_, err = completeHandshake(conn, infoHash, peerID)
+	stop := closeOnCancel(ctx, conn)
+	encrypted, err := mse.Initiate(conn, infoHash, policy)
+
+	if !stop() {
+		return nil, ctx.Err()
+	}
+
+	if err == nil {
+		return encrypted, nil
+	}
+
+	conn.Close()
+
+	if policy == mse.Required {
+		return nil, fmt.Errorf("Could not encrypt the connection: %v", err)
+	}
+
+	return dialer.DialContext(ctx, peer.Network(), peer.String())
+}
+
+// closeOnCancel closes conn if ctx is cancelled before stop is called. stop
+// reports whether conn is still open.
+func closeOnCancel(ctx context.Context, conn net.Conn) func() bool {
+	done := make(chan struct{})
+	closed := make(chan bool, 1)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			closed <- true
+		case <-done:
+			closed <- false
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return !<-closed
+	}
+}
+
+// Accept completes the handshake for a connection a peer opened to us.
+// The peer goes first, and known decides if we have the torrent it's asking for.
+func Accept(conn net.Conn, peerID [20]byte, known func(infoHash [20]byte) bool) (*Client, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	req, err := handshake.Read(conn)
 
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
 
-	bf, err := recvBitfield(conn)
+	if !known(req.InfoHash) {
+		return nil, fmt.Errorf("Peer asked for unknown infohash %x", req.InfoHash)
+	}
+
+	res := handshake.New(req.InfoHash, peerID)
+	res.Reserved.Set(handshake.ExtensionProtocol)
+	res.Reserved.Set(handshake.Fast)
+	_, err = conn.Write(res.Serialize())
+
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
 
-	return &Client {
+	peer := peers.Peer{}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		peer.IP = addr.IP
+		peer.Port = uint16(addr.Port)
+	}
+
+	return &Client{
 		Conn: conn,
 		Choked: true,
-		Bitfield: bf,
+		AmChoking: true,
+		RemoteID: req.PeerID,
+		reserved: req.Reserved,
+		inbound: true,
 		peer: peer,
-		infoHash: infoHash,
+		infoHash: req.InfoHash,
 		peerID: peerID,
 	}, nil
 }
 
+// Peer is the address of the other side of the connection
+func (c *Client) Peer() peers.Peer {
+	return c.peer
+}
+
+// Inbound is true if the peer connected to us, so its port is one it
+// picked for the connection rather than one it listens on
+func (c *Client) Inbound() bool {
+	return c.inbound
+}
+
+// Encrypted is true if the connection is MSE encrypted
+func (c *Client) Encrypted() bool {
+	conn, ok := c.Conn.(*mse.Conn)
+
+	return ok && conn.Encrypted()
+}
+
+// InfoHash is the torrent this connection is for
+func (c *Client) InfoHash() [20]byte {
+	return c.infoHash
+}
+
+// send writes a message to the peer. Writes are serialized so messages
+// from different goroutines don't get interleaved.
+func (c *Client) send(msg *message.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	defer c.Conn.SetWriteDeadline(time.Time{})
+
+	_, err := c.Conn.Write(msg.Serialize())
+
+	return err
+}
+
+// SupportsExtensions is true if the peer speaks the extension protocol
+func (c *Client) SupportsExtensions() bool {
+	return c.reserved.Has(handshake.ExtensionProtocol)
+}
+
+// SupportsFast is true if the peer speaks the fast extension (BEP 6), so
+// both sides can send HaveAll, HaveNone, Suggest, Reject and AllowedFast
+func (c *Client) SupportsFast() bool {
+	return c.reserved.Has(handshake.Fast)
+}
+
 func (c *Client) Read() (*message.Message, error) {
+	if len(c.early) > 0 {
+		msg := c.early[0]
+		c.early = c.early[1:]
+
+		return msg, nil
+	}
+
 	msg, err := message.Read(c.Conn)
 
 	if err != nil {
@@ -115,35 +320,104 @@ func (c *Client) Read() (*message.Message, error) {
 
 func (c *Client) SendRequest(index, begin, length int) error {
 	req := message.FormatRequest(index, begin, length)
-	_, err := c.Conn.Write(req.Serialize())
 
-	return err
+	return c.send(req)
+}
+
+func (c *Client) SendCancel(index, begin, length int) error {
+	msg := message.FormatCancel(index, begin, length)
+
+	return c.send(msg)
 }
 
 func (c *Client) SendInterested() error {
 	msg := message.Message{ID: message.MsgInterested}
-	_, err := c.Conn.Write(msg.Serialize())
 
-	return err
+	return c.send(&msg)
 }
 
 func (c *Client) SendNotInterested() error {
 	msg := message.Message{ID: message.MsgNotInterested}
-	_, err := c.Conn.Write(msg.Serialize())
 
-	return err
+	return c.send(&msg)
 }
 
 func (c *Client) SendUnchoke() error {
 	msg := message.Message{ID: message.MsgUnchoke}
-	_, err := c.Conn.Write(msg.Serialize())
 
-	return err
+	return c.send(&msg)
 }
 
 func (c *Client) SendHave(index int) error {
 	msg := message.FormatHave(index)
-	_, err := c.Conn.Write(msg.Serialize())
 
-	return err
+	return c.send(msg)
+}
+
+func (c *Client) SendChoke() error {
+	msg := message.Message{ID: message.MsgChoke}
+
+	return c.send(&msg)
+}
+
+func (c *Client) SendHaveAll() error {
+	msg := message.Message{ID: message.MsgHaveAll}
+
+	return c.send(&msg)
+}
+
+func (c *Client) SendHaveNone() error {
+	msg := message.Message{ID: message.MsgHaveNone}
+
+	return c.send(&msg)
+}
+
+func (c *Client) SendReject(index, begin, length int) error {
+	msg := message.FormatReject(index, begin, length)
+
+	return c.send(msg)
+}
+
+func (c *Client) SendSuggest(index int) error {
+	msg := message.FormatSuggest(index)
+
+	return c.send(msg)
+}
+
+func (c *Client) SendAllowedFast(index int) error {
+	msg := message.FormatAllowedFast(index)
+
+	return c.send(msg)
+}
+
+func (c *Client) SendBitfield(bf bitfield.Bitfield) error {
+	msg := message.Message{ID: message.MsgBitfield, Payload: bf}
+
+	return c.send(&msg)
+}
+
+// SendExtended sends an extension protocol message. extendedID is the ID
+// the peer gave the extension in its extension handshake, or 0 for the
+// handshake itself.
+func (c *Client) SendExtended(extendedID uint8, payload []byte) error {
+	msg := message.FormatExtended(extendedID, payload)
+
+	return c.send(msg)
+}
+
+// SendExtendedHandshake sends our extension handshake
+func (c *Client) SendExtendedHandshake(hs *message.ExtendedHandshake) error {
+	msg, err := message.FormatExtendedHandshake(hs)
+
+	if err != nil {
+		return err
+	}
+
+	return c.send(msg)
+}
+
+func (c *Client) SendPiece(index, begin int, block []byte) error {
+	msg := message.FormatPiece(index, begin, block)
+
+	return c.send(msg)
 }
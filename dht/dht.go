@@ -0,0 +1,708 @@
+// Package dht is a node in the mainline DHT (BEP 5), the distributed hash
+// table that lets peers find each other without a tracker.
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/peers"
+	"github.com/jackpal/bencode-go"
+)
+
+// DefaultBootstrap is a few long running nodes to join the DHT through
+var DefaultBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// ErrNoNodes is returned when the routing table is empty, so there's nobody
+// to ask
+var ErrNoNodes = errors.New("No DHT nodes to query")
+
+// ErrTimeout is returned when a node doesn't answer a query
+var ErrTimeout = errors.New("DHT node did not respond")
+
+// AnnounceInterval is how often Track announces a torrent again
+const AnnounceInterval = 15 * time.Minute
+
+// alpha is how many queries a lookup has in flight at once
+const alpha = 3
+
+// queryTimeout is how long a node has to answer a query
+const queryTimeout = 3 * time.Second
+
+// refreshInterval is how often buckets nobody has heard from get looked up
+// again to find fresh nodes
+const refreshInterval = 15 * time.Minute
+
+// DHT is our node in the DHT. It answers other nodes' queries for as long
+// as it's open, and looks up and announces torrents for us.
+type DHT struct {
+	// ID is our node ID
+	ID ID
+
+	conn   *net.UDPConn
+	table  *table
+	tokens *tokens
+	store  *peerStore
+	// ctx is cancelled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	pending   map[string]*transaction
+	nextTID   uint16
+	bootstrap []string
+}
+
+// transaction is a query waiting for its response
+type transaction struct {
+	addr *net.UDPAddr
+	res  chan *msg
+}
+
+// candidate is a node a lookup has heard of
+type candidate struct {
+	id        ID
+	addr      *net.UDPAddr
+	queried   bool
+	responded bool
+	failed    bool
+	token     string
+}
+
+// New starts a node listening on the UDP address addr, like ":6881". A zero
+// id means a random one.
+func New(addr string, id ID) (*DHT, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if id == (ID{}) {
+		id = RandomID()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d := &DHT{
+		ID:      id,
+		conn:    conn,
+		table:   newTable(id),
+		tokens:  newTokens(),
+		store:   newPeerStore(),
+		ctx:     ctx,
+		cancel:  cancel,
+		pending: map[string]*transaction{},
+	}
+
+	go d.serve()
+	go d.refresh()
+
+	return d, nil
+}
+
+// Addr is the address we're listening on
+func (d *DHT) Addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Nodes is how many good nodes are in the routing table
+func (d *DHT) Nodes() int {
+	return len(d.table.all())
+}
+
+// Close stops the node
+func (d *DHT) Close() error {
+	d.cancel()
+
+	return d.conn.Close()
+}
+
+// Bootstrap joins the DHT through the nodes at addrs, host:port pairs, by
+// looking up our own ID. It fails if we end up knowing no nodes at all.
+// The same addresses are used to join again if every node we know goes
+// away.
+func (d *DHT) Bootstrap(ctx context.Context, addrs []string) error {
+	d.mu.Lock()
+	d.bootstrap = addrs
+	d.mu.Unlock()
+
+	seeds := []*net.UDPAddr{}
+
+	for _, addr := range addrs {
+		udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+		if err != nil {
+			log.Printf("Could not resolve DHT bootstrap node %s: %v\n", addr, err)
+			continue
+		}
+
+		seeds = append(seeds, udpAddr)
+	}
+
+	_, _, err := d.lookup(ctx, d.ID, "find_node", seeds)
+	if err != nil && err != ErrNoNodes {
+		return err
+	}
+
+	if d.Nodes() == 0 {
+		return fmt.Errorf("Could not reach any of %d DHT bootstrap nodes", len(addrs))
+	}
+
+	return nil
+}
+
+// GetPeers looks up the peers the DHT knows for a torrent
+func (d *DHT) GetPeers(ctx context.Context, infoHash [20]byte) ([]peers.Peer, error) {
+	_, found, err := d.lookup(ctx, ID(infoHash), "get_peers", nil)
+
+	return found, err
+}
+
+// Announce tells the nodes closest to a torrent that we're downloading it
+// and accept connections on port. It returns the peers found on the way.
+func (d *DHT) Announce(ctx context.Context, infoHash [20]byte, port uint16) ([]peers.Peer, error) {
+	closest, found, err := d.lookup(ctx, ID(infoHash), "get_peers", nil)
+	if err != nil {
+		return found, err
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+
+	for _, c := range closest {
+		if c.token == "" {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(c *candidate) {
+			defer wg.Done()
+
+			_, err := d.query(ctx, c.addr, "announce_peer", dict{
+				"info_hash": string(infoHash[:]),
+				"port":      int64(port),
+				"token":     c.token,
+			})
+
+			if err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}(c)
+	}
+
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return found, ctx.Err()
+	}
+
+	if accepted == 0 {
+		return found, fmt.Errorf("None of %d DHT nodes accepted our announce", len(closest))
+	}
+
+	return found, nil
+}
+
+// Track announces a torrent now and every AnnounceInterval after that until
+// ctx is cancelled, passing the peers it finds to onPeers
+func (d *DHT) Track(ctx context.Context, infoHash [20]byte, port uint16, onPeers func([]peers.Peer)) {
+	for {
+		found, err := d.Announce(ctx, infoHash, port)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			log.Println("DHT announce failed:", err)
+		}
+
+		if len(found) > 0 {
+			onPeers(found)
+		}
+
+		select {
+		case <-time.After(AnnounceInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// lookup runs an iterative Kademlia lookup for target, asking the closest
+// nodes we know with method ("find_node" or "get_peers") for nodes closer
+// still, until the K closest have all answered or failed. seeds are
+// addresses to ask whose IDs we don't know yet, like bootstrap nodes. It
+// returns the closest nodes that answered and, for get_peers, every peer
+// they told us about.
+func (d *DHT) lookup(ctx context.Context, target ID, method string, seeds []*net.UDPAddr) ([]*candidate, []peers.Peer, error) {
+	seen := map[string]bool{}
+	shortlist := []*candidate{}
+
+	add := func(id ID, addr *net.UDPAddr) {
+		if id == d.ID || seen[addr.String()] {
+			return
+		}
+
+		seen[addr.String()] = true
+		shortlist = append(shortlist, &candidate{id: id, addr: addr})
+	}
+
+	for _, n := range d.table.closest(target, K) {
+		add(n.id, n.addr)
+	}
+
+	for _, addr := range seeds {
+		add(ID{}, addr)
+	}
+
+	if len(shortlist) == 0 {
+		return nil, nil, ErrNoNodes
+	}
+
+	args := dict{"target": string(target[:])}
+	if method == "get_peers" {
+		args = dict{"info_hash": string(target[:])}
+	}
+
+	type reply struct {
+		c   *candidate
+		r   dict
+		err error
+	}
+
+	replies := make(chan reply)
+	inFlight := 0
+
+	found := []peers.Peer{}
+	foundSeen := map[string]bool{}
+
+	for {
+		sort.Slice(shortlist, func(i, j int) bool {
+			return closer(target, shortlist[i].id, shortlist[j].id)
+		})
+
+		// Ask the K closest nodes that haven't failed, alpha at a time
+		considered := 0
+
+		for _, c := range shortlist {
+			if considered == K || inFlight == alpha {
+				break
+			}
+
+			if c.failed {
+				continue
+			}
+
+			considered++
+
+			if c.queried {
+				continue
+			}
+
+			c.queried = true
+			inFlight++
+
+			go func(c *candidate) {
+				r, err := d.query(ctx, c.addr, method, copyDict(args))
+				replies <- reply{c: c, r: r, err: err}
+			}(c)
+		}
+
+		if inFlight == 0 {
+			break
+		}
+
+		rep := <-replies
+		inFlight--
+
+		if rep.err != nil {
+			rep.c.failed = true
+			d.table.failed(rep.c.id)
+			continue
+		}
+
+		rep.c.responded = true
+		rep.c.token = rep.r.str("token")
+
+		if id, ok := rep.r.id("id"); ok {
+			rep.c.id = id
+		}
+
+		for _, n := range decodeNodes(rep.r.str("nodes")) {
+			add(n.id, n.addr)
+		}
+
+		for _, value := range rep.r.strings("values") {
+			ps, err := peers.Unmarshal([]byte(value))
+			if err != nil {
+				continue
+			}
+
+			for _, p := range ps {
+				if !foundSeen[p.String()] {
+					foundSeen[p.String()] = true
+					found = append(found, p)
+				}
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, found, ctx.Err()
+	}
+
+	closest := []*candidate{}
+
+	for _, c := range shortlist {
+		if c.responded && len(closest) < K {
+			closest = append(closest, c)
+		}
+	}
+
+	return closest, found, nil
+}
+
+func copyDict(d dict) dict {
+	c := dict{}
+	for k, v := range d {
+		c[k] = v
+	}
+
+	return c
+}
+
+// query sends a query to addr and waits for the response
+func (d *DHT) query(ctx context.Context, addr *net.UDPAddr, method string, args dict) (dict, error) {
+	args["id"] = string(d.ID[:])
+
+	tx := &transaction{addr: addr, res: make(chan *msg, 1)}
+
+	d.mu.Lock()
+	d.nextTID++
+	tid := string([]byte{byte(d.nextTID >> 8), byte(d.nextTID)})
+	d.pending[tid] = tx
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, tid)
+		d.mu.Unlock()
+	}()
+
+	err := d.send(addr, &msg{T: tid, Y: "q", Q: method, A: args})
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	select {
+	case m := <-tx.res:
+		if m.E != nil {
+			return nil, m.E
+		}
+
+		return m.R, nil
+	case <-timer.C:
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.ctx.Done():
+		return nil, d.ctx.Err()
+	}
+}
+
+func (d *DHT) send(addr *net.UDPAddr, m *msg) error {
+	data, err := m.encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.conn.WriteToUDP(data, addr)
+
+	return err
+}
+
+// serve reads messages until Close
+func (d *DHT) serve() {
+	buf := make([]byte, 65536)
+
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+
+		if d.ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			continue
+		}
+
+		// Without a transaction ID there's nothing to even send an error to
+		m, err := decodeMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		switch m.Y {
+		case "q":
+			d.handleQuery(addr, m)
+		case "r", "e":
+			d.handleResponse(addr, m)
+		}
+	}
+}
+
+// handleResponse hands a response to the query waiting for it. Only nodes
+// that answer our queries make it into the routing table this way, so
+// nobody can fill it up by sending unasked for responses.
+func (d *DHT) handleResponse(addr *net.UDPAddr, m *msg) {
+	d.mu.Lock()
+	tx := d.pending[m.T]
+	d.mu.Unlock()
+
+	if tx == nil || !tx.addr.IP.Equal(addr.IP) || tx.addr.Port != addr.Port {
+		return
+	}
+
+	if m.R != nil {
+		if id, ok := m.R.id("id"); ok {
+			d.addNode(id, addr)
+		}
+	}
+
+	select {
+	case tx.res <- m:
+	default:
+	}
+}
+
+func (d *DHT) handleQuery(addr *net.UDPAddr, m *msg) {
+	id, ok := m.A.id("id")
+	if !ok {
+		d.sendError(addr, m.T, errProtocol, "Missing or bad id")
+		return
+	}
+
+	// Read only nodes (BEP 43) ask but can't be asked
+	if ro, _ := m.A.integer("ro"); ro != 1 {
+		d.addNode(id, addr)
+	}
+
+	switch m.Q {
+	case "ping":
+		d.reply(addr, m.T, dict{})
+	case "find_node":
+		target, ok := m.A.id("target")
+		if !ok {
+			d.sendError(addr, m.T, errProtocol, "Missing or bad target")
+			return
+		}
+
+		d.reply(addr, m.T, dict{"nodes": encodeNodes(d.table.closest(target, K))})
+	case "get_peers":
+		infoHash, ok := m.A.id("info_hash")
+		if !ok {
+			d.sendError(addr, m.T, errProtocol, "Missing or bad info_hash")
+			return
+		}
+
+		r := dict{"token": d.tokens.create(addr.IP)}
+
+		values := []string{}
+		for _, p := range d.store.get(infoHash) {
+			if v, ok := compactPeer(p); ok {
+				values = append(values, v)
+			}
+		}
+
+		if len(values) > 0 {
+			r["values"] = values
+		} else {
+			r["nodes"] = encodeNodes(d.table.closest(infoHash, K))
+		}
+
+		d.reply(addr, m.T, r)
+	case "announce_peer":
+		infoHash, ok := m.A.id("info_hash")
+		if !ok {
+			d.sendError(addr, m.T, errProtocol, "Missing or bad info_hash")
+			return
+		}
+
+		if !d.tokens.valid(m.A.str("token"), addr.IP) {
+			d.sendError(addr, m.T, errProtocol, "Bad token")
+			return
+		}
+
+		port, _ := m.A.integer("port")
+		// The peer is behind a NAT and wants the port the query came from
+		if implied, _ := m.A.integer("implied_port"); implied == 1 {
+			port = int64(addr.Port)
+		}
+
+		if port <= 0 || port > 65535 {
+			d.sendError(addr, m.T, errProtocol, "Missing or bad port")
+			return
+		}
+
+		d.store.add(infoHash, peers.Peer{IP: addr.IP, Port: uint16(port)})
+		d.reply(addr, m.T, dict{})
+	default:
+		d.sendError(addr, m.T, errMethod, "Unknown method")
+	}
+}
+
+func (d *DHT) reply(addr *net.UDPAddr, tid string, r dict) {
+	r["id"] = string(d.ID[:])
+	d.send(addr, &msg{T: tid, Y: "r", R: r})
+}
+
+func (d *DHT) sendError(addr *net.UDPAddr, tid string, code int, message string) {
+	d.send(addr, &msg{T: tid, Y: "e", E: &krpcError{Code: code, Message: message}})
+}
+
+// addNode puts a node we heard from in the routing table. If its bucket is
+// full we ping the node there that's been quiet longest, and if that one
+// doesn't answer the next newcomer takes its place.
+func (d *DHT) addNode(id ID, addr *net.UDPAddr) {
+	if id == d.ID {
+		return
+	}
+
+	stale := d.table.insert(id, addr, true)
+	if stale == nil {
+		return
+	}
+
+	go func() {
+		_, err := d.query(d.ctx, stale.addr, "ping", dict{})
+		if err != nil {
+			d.table.failed(stale.id)
+		}
+	}()
+}
+
+// refresh looks up a random ID in every bucket nobody has heard from in a
+// while, and joins the DHT again if every node we knew has gone away
+func (d *DHT) refresh() {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return
+		}
+
+		if d.Nodes() == 0 {
+			d.mu.Lock()
+			bootstrap := d.bootstrap
+			d.mu.Unlock()
+
+			if len(bootstrap) > 0 {
+				err := d.Bootstrap(d.ctx, bootstrap)
+				if err != nil {
+					log.Println("Could not rejoin the DHT:", err)
+				}
+			}
+
+			continue
+		}
+
+		for _, i := range d.table.stale(refreshInterval) {
+			d.lookup(d.ctx, randomIDInBucket(d.ID, i), "find_node", nil)
+		}
+	}
+}
+
+// state is what Save writes: our ID and the nodes in the routing table, so
+// a restart doesn't have to join the DHT from scratch
+type state struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"`
+}
+
+// Save writes our ID and routing table to path, for Load
+func (d *DHT) Save(path string) error {
+	tempPath := path + ".tmp"
+
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+
+	err = bencode.Marshal(f, state{
+		ID:    string(d.ID[:]),
+		Nodes: encodeNodes(d.table.all()),
+	})
+
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	return os.Rename(tempPath, path)
+}
+
+// Load starts a node on addr with the ID and routing table that Save wrote
+// to path
+func Load(path, addr string) (*DHT, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	s := state{}
+	err = bencode.Unmarshal(f, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	var id ID
+	if len(s.ID) != len(id) {
+		return nil, fmt.Errorf("DHT state %s has a bad node ID", path)
+	}
+
+	copy(id[:], s.ID)
+
+	d, err := New(addr, id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range decodeNodes(s.Nodes) {
+		d.table.insert(n.id, n.addr, false)
+	}
+
+	return d, nil
+}
@@ -0,0 +1,207 @@
+package dht
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testNetwork starts n nodes on loopback, every one after the first joining
+// through the first
+func testNetwork(t *testing.T, n int) []*DHT {
+	nodes := []*DHT{}
+
+	for i := 0; i < n; i++ {
+		d, err := New("127.0.0.1:0", ID{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { d.Close() })
+		nodes = append(nodes, d)
+
+		if i == 0 {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = d.Bootstrap(ctx, []string{nodes[0].Addr().String()})
+		cancel()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return nodes
+}
+
+func TestBootstrap(t *testing.T) {
+	nodes := testNetwork(t, 6)
+
+	// The first node heard from everyone who joined through it
+	if n := nodes[0].Nodes(); n != len(nodes)-1 {
+		t.Errorf("First node knows %d nodes, expected %d", n, len(nodes)-1)
+	}
+
+	for i, d := range nodes[1:] {
+		if d.Nodes() == 0 {
+			t.Errorf("Node %d knows no nodes after bootstrapping", i+1)
+		}
+	}
+}
+
+func TestAnnounceGetPeers(t *testing.T) {
+	nodes := testNetwork(t, 6)
+	infoHash := [20]byte{0xde, 0xad, 0xbe, 0xef}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := nodes[2].Announce(ctx, infoHash, 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := nodes[5].GetPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 1 || found[0].String() != "127.0.0.1:6881" {
+		t.Fatalf("Expected to find 127.0.0.1:6881, got %v", found)
+	}
+
+	// Nobody announced this one
+	found, err = nodes[5].GetPeers(ctx, [20]byte{0xca, 0xfe})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 0 {
+		t.Errorf("Found peers %v for a torrent nobody announced", found)
+	}
+}
+
+func TestAnnounceToken(t *testing.T) {
+	nodes := testNetwork(t, 2)
+	server, asker := nodes[0], nodes[1]
+	infoHash := ID{0x42}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	announce := func(token string) error {
+		_, err := asker.query(ctx, server.Addr(), "announce_peer", dict{
+			"info_hash": string(infoHash[:]),
+			"port":      int64(6881),
+			"token":     token,
+		})
+
+		return err
+	}
+
+	err := announce("made up")
+
+	krpcErr, ok := err.(*krpcError)
+	if !ok || krpcErr.Code != errProtocol {
+		t.Fatalf("Expected a protocol error for a bad token, got %v", err)
+	}
+
+	if len(server.store.get(infoHash)) != 0 {
+		t.Fatal("Stored a peer that announced with a bad token")
+	}
+
+	r, err := asker.query(ctx, server.Addr(), "get_peers", dict{"info_hash": string(infoHash[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = announce(r.str("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(server.store.get(infoHash)) != 1 {
+		t.Fatal("Didn't store a peer that announced with a good token")
+	}
+
+	// Tokens are tied to the address they were given to
+	if !server.tokens.valid(r.str("token"), asker.Addr().IP) {
+		t.Fatal("Token isn't valid for the address it was given to")
+	}
+
+	if server.tokens.valid(r.str("token"), net.IPv4(10, 0, 0, 1)) {
+		t.Fatal("Token is valid for another address")
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	nodes := testNetwork(t, 4)
+	saved := nodes[1]
+
+	dir, err := ioutil.TempDir("", "dht")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dht.dat")
+
+	err = saved.Save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(path, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer loaded.Close()
+
+	if loaded.ID != saved.ID {
+		t.Errorf("Loaded ID %x, saved %x", loaded.ID, saved.ID)
+	}
+
+	want := map[ID]string{}
+	for _, n := range saved.table.all() {
+		want[n.id] = n.addr.String()
+	}
+
+	got := loaded.table.all()
+	if len(got) != len(want) {
+		t.Fatalf("Loaded %d nodes, saved %d", len(got), len(want))
+	}
+
+	for _, n := range got {
+		if want[n.id] != n.addr.String() {
+			t.Errorf("Loaded node %x at %s, saved at %q", n.id, n.addr, want[n.id])
+		}
+	}
+
+	// The loaded table is enough to find peers without bootstrapping
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	infoHash := [20]byte{0x99}
+
+	_, err = nodes[3].Announce(ctx, infoHash, 51413)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := loaded.GetPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 1 {
+		t.Errorf("Expected to find the announced peer, got %v", found)
+	}
+}
@@ -0,0 +1,106 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math/bits"
+	"net"
+)
+
+// ID is a node ID. Info hashes live in the same 160 bit space, which is
+// how a lookup finds the nodes responsible for a torrent.
+type ID [20]byte
+
+// RandomID makes a new node ID
+func RandomID() ID {
+	var id ID
+	rand.Read(id[:])
+
+	return id
+}
+
+// closer is true if a is closer to target than b, by XOR distance
+func closer(target, a, b ID) bool {
+	for i := range target {
+		da := a[i] ^ target[i]
+		db := b[i] ^ target[i]
+
+		if da != db {
+			return da < db
+		}
+	}
+
+	return false
+}
+
+// commonPrefix is how many leading bits a and b share
+func commonPrefix(a, b ID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+
+	return len(a) * 8
+}
+
+// randomIDInBucket makes an ID that shares exactly prefix leading bits
+// with self, so it lands in that bucket of self's routing table
+func randomIDInBucket(self ID, prefix int) ID {
+	id := RandomID()
+
+	for i := 0; i < prefix; i++ {
+		mask := byte(0x80) >> uint(i%8)
+		id[i/8] = id[i/8]&^mask | self[i/8]&mask
+	}
+
+	mask := byte(0x80) >> uint(prefix%8)
+	id[prefix/8] = id[prefix/8]&^mask | ^self[prefix/8]&mask
+
+	return id
+}
+
+// Compact node info is 20 bytes of ID, 4 bytes of IPv4 address and 2 bytes
+// of port
+const compactNodeLen = 26
+
+func encodeNodes(nodes []*node) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeLen)
+
+	for _, n := range nodes {
+		ip := n.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+
+		buf = append(buf, n.id[:]...)
+		buf = append(buf, ip...)
+		buf = append(buf, byte(n.addr.Port>>8), byte(n.addr.Port))
+	}
+
+	return string(buf)
+}
+
+// decodeNodes parses compact node info. Anything left over that isn't a
+// whole node is ignored.
+func decodeNodes(s string) []*node {
+	nodes := []*node{}
+
+	for i := 0; i+compactNodeLen <= len(s); i += compactNodeLen {
+		n := &node{}
+		copy(n.id[:], s[i:i+20])
+
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, s[i+20:i+24])
+		port := binary.BigEndian.Uint16([]byte(s[i+24 : i+26]))
+
+		if port == 0 {
+			continue
+		}
+
+		n.addr = &net.UDPAddr{IP: ip, Port: int(port)}
+		nodes = append(nodes, n)
+	}
+
+	return nodes
+}
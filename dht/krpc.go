@@ -0,0 +1,162 @@
+package dht
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// KRPC error codes
+const (
+	errGeneric  = 201
+	errServer   = 202
+	errProtocol = 203
+	errMethod   = 204
+)
+
+// krpcError is an error message from another node
+type krpcError struct {
+	Code    int
+	Message string
+}
+
+func (e *krpcError) Error() string {
+	return fmt.Sprintf("DHT error %d: %s", e.Code, e.Message)
+}
+
+// dict is a decoded bencoded dictionary. Messages come off the network from
+// anyone, so they're decoded without a schema and every value is checked
+// as it's read.
+type dict map[string]interface{}
+
+// str returns the string at key, or "" if there isn't one
+func (d dict) str(key string) string {
+	s, _ := d[key].(string)
+
+	return s
+}
+
+func (d dict) integer(key string) (int64, bool) {
+	i, ok := d[key].(int64)
+
+	return i, ok
+}
+
+// id returns the 20 byte ID or info hash at key
+func (d dict) id(key string) (ID, bool) {
+	var id ID
+
+	s := d.str(key)
+	if len(s) != len(id) {
+		return id, false
+	}
+
+	copy(id[:], s)
+
+	return id, true
+}
+
+// strings returns the strings in the list at key, skipping anything that
+// isn't one
+func (d dict) strings(key string) []string {
+	list, _ := d[key].([]interface{})
+	strs := []string{}
+
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+
+	return strs
+}
+
+// msg is a KRPC message: a query, a response or an error
+type msg struct {
+	// T is the transaction ID, which ties a response to its query
+	T string
+	// Y is "q", "r" or "e"
+	Y string
+	// Q is the method of a query, with its arguments in A
+	Q string
+	A dict
+	// R is the body of a response
+	R dict
+	E *krpcError
+}
+
+func decodeMsg(data []byte) (*msg, error) {
+	v, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	top, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("KRPC message is not a dictionary")
+	}
+
+	d := dict(top)
+	m := &msg{T: d.str("t"), Y: d.str("y"), Q: d.str("q")}
+
+	if m.T == "" {
+		return nil, fmt.Errorf("KRPC message has no transaction ID")
+	}
+
+	switch m.Y {
+	case "q":
+		a, _ := top["a"].(map[string]interface{})
+		if a == nil {
+			return nil, fmt.Errorf("KRPC query has no arguments")
+		}
+
+		m.A = dict(a)
+	case "r":
+		r, _ := top["r"].(map[string]interface{})
+		if r == nil {
+			return nil, fmt.Errorf("KRPC response has no body")
+		}
+
+		m.R = dict(r)
+	case "e":
+		e, _ := top["e"].([]interface{})
+		m.E = &krpcError{Code: errGeneric}
+
+		if len(e) > 0 {
+			if code, ok := e[0].(int64); ok {
+				m.E.Code = int(code)
+			}
+		}
+
+		if len(e) > 1 {
+			m.E.Message, _ = e[1].(string)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown KRPC message type %q", m.Y)
+	}
+
+	return m, nil
+}
+
+func (m *msg) encode() ([]byte, error) {
+	top := map[string]interface{}{
+		"t": m.T,
+		"y": m.Y,
+	}
+
+	switch m.Y {
+	case "q":
+		top["q"] = m.Q
+		top["a"] = map[string]interface{}(m.A)
+	case "r":
+		top["r"] = map[string]interface{}(m.R)
+	case "e":
+		top["e"] = []interface{}{m.E.Code, m.E.Message}
+	}
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, top)
+
+	return buf.Bytes(), err
+}
@@ -0,0 +1,117 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/peers"
+)
+
+// peerTTL is how long we remember a peer that announced to us. Peers
+// announce again every AnnounceInterval to stay listed.
+const peerTTL = 30 * time.Minute
+
+// maxValues is the most peers one get_peers response carries, which keeps
+// it well inside a UDP packet
+const maxValues = 50
+
+// maxTorrents caps how many info hashes we store peers for, so that
+// announces for made up torrents can't eat all our memory
+const maxTorrents = 10000
+
+// sweepInterval is the most often a full store looks for expired torrents
+// to make room
+const sweepInterval = time.Minute
+
+type storedPeer struct {
+	peer  peers.Peer
+	added time.Time
+}
+
+// peerStore keeps the peers that announced to us, by info hash
+type peerStore struct {
+	mu       sync.Mutex
+	torrents map[ID]map[string]storedPeer
+	// lastSweep is when expire last ran
+	lastSweep time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{torrents: map[ID]map[string]storedPeer{}}
+}
+
+func (s *peerStore) add(infoHash ID, peer peers.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	swarm := s.torrents[infoHash]
+	if swarm == nil {
+		// Torrents whose peers all went quiet make room for new ones
+		if len(s.torrents) >= maxTorrents && time.Since(s.lastSweep) >= sweepInterval {
+			s.expire()
+		}
+
+		if len(s.torrents) >= maxTorrents {
+			return
+		}
+
+		swarm = map[string]storedPeer{}
+		s.torrents[infoHash] = swarm
+	}
+
+	swarm[peer.String()] = storedPeer{peer: peer, added: time.Now()}
+}
+
+// get returns up to maxValues peers for infoHash, in no particular order
+func (s *peerStore) get(infoHash ID) []peers.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	swarm := s.torrents[infoHash]
+	found := []peers.Peer{}
+
+	for addr, sp := range swarm {
+		if time.Since(sp.added) >= peerTTL {
+			delete(swarm, addr)
+			continue
+		}
+
+		if len(found) < maxValues {
+			found = append(found, sp.peer)
+		}
+	}
+
+	if swarm != nil && len(swarm) == 0 {
+		delete(s.torrents, infoHash)
+	}
+
+	return found
+}
+
+// expire drops every peer that hasn't announced within peerTTL, and every
+// torrent that has no peers left. s.mu must be held.
+func (s *peerStore) expire() {
+	s.lastSweep = time.Now()
+
+	for infoHash, swarm := range s.torrents {
+		for addr, sp := range swarm {
+			if time.Since(sp.added) >= peerTTL {
+				delete(swarm, addr)
+			}
+		}
+
+		if len(swarm) == 0 {
+			delete(s.torrents, infoHash)
+		}
+	}
+}
+
+// compactPeer encodes an IPv4 peer as 4 bytes of address and 2 of port
+func compactPeer(p peers.Peer) (string, bool) {
+	ip := p.IP.To4()
+	if ip == nil {
+		return "", false
+	}
+
+	return string(append(ip[:4:4], byte(p.Port>>8), byte(p.Port))), true
+}
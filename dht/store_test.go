@@ -0,0 +1,46 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/peers"
+)
+
+func TestPeerStoreMakesRoom(t *testing.T) {
+	s := newPeerStore()
+	peer := peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+
+	for i := 0; i < maxTorrents; i++ {
+		var infoHash ID
+		infoHash[0], infoHash[1] = byte(i>>8), byte(i)
+		s.add(infoHash, peer)
+	}
+
+	fresh := ID{0xff}
+
+	// Full of live torrents, so there's no room
+	s.add(fresh, peer)
+	if len(s.get(fresh)) != 0 {
+		t.Fatal("Stored a torrent past maxTorrents")
+	}
+
+	// Every peer goes quiet
+	for _, swarm := range s.torrents {
+		for addr, sp := range swarm {
+			sp.added = time.Now().Add(-peerTTL)
+			swarm[addr] = sp
+		}
+	}
+	s.lastSweep = time.Time{}
+
+	s.add(fresh, peer)
+	if len(s.get(fresh)) != 1 {
+		t.Fatal("Expired torrents didn't make room for a new one")
+	}
+
+	if len(s.torrents) != 1 {
+		t.Errorf("Expected only the new torrent left, got %d", len(s.torrents))
+	}
+}
@@ -0,0 +1,194 @@
+package dht
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// K is how many nodes a bucket holds, and how many nodes a lookup ends on
+const K = 8
+
+// A node we haven't heard from in this long might be gone, and gets pinged
+// before a newcomer is turned away in its favour
+const questionableAfter = 15 * time.Minute
+
+// maxFailures unanswered queries in a row make a node bad. Bad nodes are
+// never handed out and are the first to be replaced.
+const maxFailures = 2
+
+type node struct {
+	id       ID
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+	// pinging is set while we check whether the node is still around
+	pinging bool
+}
+
+type bucket struct {
+	nodes []*node
+	// changed is the last time a node was added to the bucket or heard
+	// from, for deciding when it needs a refresh
+	changed time.Time
+}
+
+// table is a Kademlia routing table. Bucket i holds up to K nodes whose IDs
+// share exactly i leading bits with ours, so we know lots of nodes close
+// to us and a few far away.
+type table struct {
+	self ID
+
+	mu      sync.Mutex
+	buckets [160]bucket
+}
+
+func newTable(self ID) *table {
+	return &table{self: self}
+}
+
+func (t *table) bucketFor(id ID) *bucket {
+	i := commonPrefix(t.self, id)
+	if i == len(t.buckets) {
+		return nil
+	}
+
+	return &t.buckets[i]
+}
+
+// insert adds a node to the table. seen is true if we just heard from it,
+// and false for nodes from a saved table that might be long gone. If the
+// bucket is full of nodes that are still good, the new node is dropped
+// and insert returns the least recently seen node for the caller to ping.
+func (t *table) insert(id ID, addr *net.UDPAddr, seen bool) *node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(id)
+	if b == nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	for _, n := range b.nodes {
+		if n.id != id {
+			continue
+		}
+
+		// Keep the address we know, so nobody can take over a node's
+		// entry by claiming its ID
+		if seen && n.addr.String() == addr.String() {
+			n.lastSeen = now
+			n.failures = 0
+			n.pinging = false
+			b.changed = now
+		}
+
+		return nil
+	}
+
+	n := &node{id: id, addr: addr}
+	if seen {
+		n.lastSeen = now
+	}
+
+	if len(b.nodes) < K {
+		b.nodes = append(b.nodes, n)
+		b.changed = now
+		return nil
+	}
+
+	for i, old := range b.nodes {
+		if old.failures >= maxFailures {
+			b.nodes[i] = n
+			b.changed = now
+			return nil
+		}
+	}
+
+	oldest := b.nodes[0]
+	for _, old := range b.nodes[1:] {
+		if old.lastSeen.Before(oldest.lastSeen) {
+			oldest = old
+		}
+	}
+
+	if oldest.pinging || time.Since(oldest.lastSeen) < questionableAfter {
+		return nil
+	}
+
+	oldest.pinging = true
+
+	return oldest
+}
+
+// failed records a query to id that went unanswered
+func (t *table) failed(id ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(id)
+	if b == nil {
+		return
+	}
+
+	for _, n := range b.nodes {
+		if n.id == id {
+			n.failures++
+			n.pinging = false
+		}
+	}
+}
+
+// closest returns up to count good nodes, closest to target first
+func (t *table) closest(target ID, count int) []*node {
+	nodes := t.all()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return closer(target, nodes[i].id, nodes[j].id)
+	})
+
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+
+	return nodes
+}
+
+// all returns every good node in the table
+func (t *table) all() []*node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	nodes := []*node{}
+
+	for i := range t.buckets {
+		for _, n := range t.buckets[i].nodes {
+			if n.failures < maxFailures {
+				nodes = append(nodes, n)
+			}
+		}
+	}
+
+	return nodes
+}
+
+// stale lists the buckets nobody has been added to or heard from in the
+// last interval
+func (t *table) stale(interval time.Duration) []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stale := []int{}
+
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		if len(b.nodes) > 0 && time.Since(b.changed) >= interval {
+			stale = append(stale, i)
+		}
+	}
+
+	return stale
+}
@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+// tokenRotation is how often the token secret changes. Tokens made with the
+// secret before the current one are still accepted, so a token is good
+// for five to ten minutes.
+const tokenRotation = 5 * time.Minute
+
+// tokens hands out the tokens that get_peers responses carry, which a node
+// has to send back with announce_peer. A token is a hash of the node's IP
+// and a secret, so only nodes that really are at that IP can announce.
+type tokens struct {
+	mu       sync.Mutex
+	secret   []byte
+	previous []byte
+	rotated  time.Time
+}
+
+func newTokens() *tokens {
+	return &tokens{
+		secret:   randomSecret(),
+		previous: randomSecret(),
+		rotated:  time.Now(),
+	}
+}
+
+func randomSecret() []byte {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+
+	return secret
+}
+
+func (tk *tokens) rotate() {
+	elapsed := time.Since(tk.rotated)
+	if elapsed < tokenRotation {
+		return
+	}
+
+	tk.previous = tk.secret
+	if elapsed >= 2*tokenRotation {
+		tk.previous = randomSecret()
+	}
+
+	tk.secret = randomSecret()
+	tk.rotated = time.Now()
+}
+
+func (tk *tokens) create(ip net.IP) string {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	tk.rotate()
+
+	return token(tk.secret, ip)
+}
+
+func (tk *tokens) valid(t string, ip net.IP) bool {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	tk.rotate()
+
+	return hmac.Equal([]byte(t), []byte(token(tk.secret, ip))) ||
+		hmac.Equal([]byte(t), []byte(token(tk.previous, ip)))
+}
+
+func token(secret []byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(secret)
+	h.Write(ip.To16())
+
+	return string(h.Sum(nil))
+}
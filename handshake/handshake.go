@@ -9,8 +9,37 @@ const InfoHashLength = 20
 const PeerIDLength = 20
 const ReservedByteLength = 8
 
+// Reserved is the reserved bytes of a handshake. Each bit that's set says
+// the peer speaks some extension to the protocol.
+type Reserved [ReservedByteLength]byte
+
+// A Bit is one of the reserved bits, counted from the left of the first
+// reserved byte
+type Bit uint
+
+const (
+	// ExtensionProtocol is the extension protocol (BEP 10), 0x10 in the
+	// sixth byte
+	ExtensionProtocol Bit = 43
+	// Fast is the fast extension (BEP 6), 0x04 in the last byte
+	Fast Bit = 61
+	// DHT says the peer runs a DHT node (BEP 5), 0x01 in the last byte
+	DHT Bit = 63
+)
+
+// Set turns on bit b
+func (r *Reserved) Set(b Bit) {
+	r[b / 8] |= 0x80 >> (b % 8)
+}
+
+// Has is true if bit b is on
+func (r Reserved) Has(b Bit) bool {
+	return r[b / 8] & (0x80 >> (b % 8)) != 0
+}
+
 type Handshake struct {
 	Pstr string
+	Reserved Reserved
 	InfoHash [InfoHashLength]byte
 	PeerID [PeerIDLength]byte
 }
@@ -32,7 +61,7 @@ func (h *Handshake) Serialize() []byte {
 	// Protocol Standard
 	curr += copy(buf[curr:], h.Pstr)
 	// Reserved bytes
-	curr += copy(buf[curr:], make([]byte, 8))
+	curr += copy(buf[curr:], h.Reserved[:])
 	// InfoHash
 	curr += copy(buf[curr:], h.InfoHash[:])
 	// PeerID
@@ -42,12 +71,9 @@ func (h *Handshake) Serialize() []byte {
 }
 
 func Read(r io.Reader) (*Handshake, error) {
-	fmt.Println("Make it to handshake read")
 	lengthBuf := make([]byte, 1)
 	_, err := io.ReadFull(r, lengthBuf)
 
-	fmt.Println("Read into the length buf")
-
 	if err != nil {
 		return nil, err
 	}
@@ -70,12 +96,15 @@ func Read(r io.Reader) (*Handshake, error) {
 
 	// PeerID and InfoHash have the same length
 	var infoHash, peerID [InfoHashLength]byte
+	var reserved Reserved
 
+	copy(reserved[:], handshakeBuf[pstrlen : pstrlen + ReservedByteLength])
 	copy(infoHash[:], handshakeBuf[pstrlen + ReservedByteLength : pstrlen + ReservedByteLength + InfoHashLength])
 	copy(peerID[:], handshakeBuf[pstrlen + ReservedByteLength + InfoHashLength:])
 
 	h := Handshake {
 		Pstr: string(handshakeBuf[0 : pstrlen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID: peerID,
 	}
@@ -0,0 +1,61 @@
+package handshake
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReservedBits(t *testing.T) {
+	cases := []struct {
+		bit   Bit
+		index int
+		mask  byte
+	}{
+		{ExtensionProtocol, 5, 0x10},
+		{Fast, 7, 0x04},
+		{DHT, 7, 0x01},
+	}
+
+	for _, tc := range cases {
+		var r Reserved
+		r.Set(tc.bit)
+
+		var want Reserved
+		want[tc.index] = tc.mask
+		if r != want {
+			t.Errorf("Bit %d set %x, want %x", tc.bit, r, want)
+		}
+
+		if !r.Has(tc.bit) {
+			t.Errorf("Bit %d isn't set after Set", tc.bit)
+		}
+
+		for _, other := range cases {
+			if other.bit != tc.bit && r.Has(other.bit) {
+				t.Errorf("Setting bit %d sets bit %d", tc.bit, other.bit)
+			}
+		}
+	}
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	var infoHash, peerID [20]byte
+	copy(infoHash[:], "aaaaaaaaaaaaaaaaaaaa")
+	copy(peerID[:], "-GO0001-bbbbbbbbbbbb")
+
+	h := New(infoHash, peerID)
+	h.Reserved.Set(ExtensionProtocol)
+	h.Reserved.Set(DHT)
+
+	read, err := Read(bytes.NewReader(h.Serialize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if read.Pstr != h.Pstr || read.InfoHash != infoHash || read.PeerID != peerID {
+		t.Errorf("Got %+v, want %+v", read, h)
+	}
+	if !read.Reserved.Has(ExtensionProtocol) || !read.Reserved.Has(DHT) || read.Reserved.Has(Fast) {
+		t.Errorf("Reserved bytes %x", read.Reserved)
+	}
+}
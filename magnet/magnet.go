@@ -0,0 +1,136 @@
+// Package magnet parses magnet URIs (magnet:?xt=urn:btih:...)
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/copperwall/bittorrent-go/peers"
+)
+
+// ErrNotMagnet is returned when the URI isn't a BitTorrent magnet link
+var ErrNotMagnet = errors.New("Not a BitTorrent magnet link")
+
+// Link is everything a magnet link can tell us about a torrent
+type Link struct {
+	InfoHash [20]byte
+	Name     string
+	Trackers []string
+	Peers    []peers.Peer
+}
+
+// IsMagnet is a predicate for if s looks like a magnet link
+func IsMagnet(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), "magnet:")
+}
+
+// Parse parses a magnet URI. Only the exact topic (xt) is required, every
+// other parameter is optional.
+func Parse(uri string) (*Link, error) {
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "magnet" {
+		return nil, ErrNotMagnet
+	}
+
+	params, err := url.ParseQuery(u.RawQuery)
+
+	if err != nil {
+		return nil, err
+	}
+
+	link := &Link{}
+	found := false
+
+	// There can be several exact topics, pick the first BitTorrent one
+	for _, xt := range params["xt"] {
+		const prefix = "urn:btih:"
+
+		if !strings.HasPrefix(strings.ToLower(xt), prefix) {
+			continue
+		}
+
+		link.InfoHash, err = decodeInfoHash(xt[len(prefix):])
+		if err != nil {
+			return nil, err
+		}
+
+		found = true
+		break
+	}
+
+	if !found {
+		return nil, ErrNotMagnet
+	}
+
+	link.Name = params.Get("dn")
+	link.Trackers = params["tr"]
+
+	for _, pe := range params["x.pe"] {
+		peer, err := parsePeer(pe)
+
+		// Peer hints are only hints, skip the ones we can't use
+		if err != nil {
+			continue
+		}
+
+		link.Peers = append(link.Peers, peer)
+	}
+
+	return link, nil
+}
+
+// decodeInfoHash accepts either the 40 character hex or the 32 character
+// base32 form of an info hash.
+func decodeInfoHash(s string) ([20]byte, error) {
+	var infoHash [20]byte
+	var buf []byte
+	var err error
+
+	switch len(s) {
+	case 40:
+		buf, err = hex.DecodeString(s)
+	case 32:
+		buf, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return infoHash, fmt.Errorf("Info hash %q has length %d, expected 40 or 32", s, len(s))
+	}
+
+	if err != nil {
+		return infoHash, fmt.Errorf("Could not decode info hash %q: %v", s, err)
+	}
+
+	copy(infoHash[:], buf)
+	return infoHash, nil
+}
+
+func parsePeer(s string) (peers.Peer, error) {
+	host, portStr, err := net.SplitHostPort(s)
+
+	if err != nil {
+		return peers.Peer{}, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+
+	if err != nil {
+		return peers.Peer{}, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return peers.Peer{}, fmt.Errorf("Peer %q is not an IP address", s)
+	}
+
+	return peers.Peer{IP: ip, Port: uint16(port)}, nil
+}
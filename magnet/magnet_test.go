@@ -0,0 +1,88 @@
+package magnet
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/copperwall/bittorrent-go/peers"
+)
+
+const testHex = "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+
+// testBase32 is testHex in base32
+const testBase32 = "YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK"
+
+func TestParse(t *testing.T) {
+	var infoHash [20]byte
+	hex.Decode(infoHash[:], []byte(testHex))
+
+	cases := []struct {
+		name string
+		uri  string
+		want Link
+	}{
+		{"hex", "magnet:?xt=urn:btih:" + testHex, Link{InfoHash: infoHash}},
+		{"upper case hex", "magnet:?xt=urn:btih:C12FE1C06BBA254A9DC9F519B335AA7C1367A88A", Link{InfoHash: infoHash}},
+		{"base32", "magnet:?xt=urn:btih:" + testBase32, Link{InfoHash: infoHash}},
+		{"lower case base32", "magnet:?xt=urn:btih:yex6dqdlxisuvhoj6um3gnnkpqjwpkek", Link{InfoHash: infoHash}},
+		{"name and trackers",
+			"magnet:?xt=urn:btih:" + testHex + "&dn=Some+File&tr=http%3A%2F%2Fa.example%2Fannounce&tr=udp%3A%2F%2Fb.example%3A80",
+			Link{
+				InfoHash: infoHash,
+				Name:     "Some File",
+				Trackers: []string{"http://a.example/announce", "udp://b.example:80"},
+			}},
+		{"first BitTorrent topic",
+			"magnet:?xt=urn:sha1:YNCKHTQCWBTRNJIV4WNAE52SJUQCZO5C&xt=urn:btih:" + testHex,
+			Link{InfoHash: infoHash}},
+		{"peers",
+			"magnet:?xt=urn:btih:" + testHex + "&x.pe=10.0.0.1:6881&x.pe=%5B2001:db8::1%5D:51413&x.pe=host.example:1&x.pe=10.0.0.2",
+			Link{
+				InfoHash: infoHash,
+				Peers: []peers.Peer{
+					{IP: net.ParseIP("10.0.0.1"), Port: 6881},
+					{IP: net.ParseIP("2001:db8::1"), Port: 51413},
+				},
+			}},
+	}
+
+	for _, tc := range cases {
+		link, err := Parse(tc.uri)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(*link, tc.want) {
+			t.Errorf("%s: Got %+v, want %+v", tc.name, *link, tc.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		name      string
+		uri       string
+		notMagnet bool
+	}{
+		{"missing xt", "magnet:?dn=Some+File&tr=http%3A%2F%2Fa.example%2Fannounce", true},
+		{"no BitTorrent xt", "magnet:?xt=urn:sha1:YNCKHTQCWBTRNJIV4WNAE52SJUQCZO5C", true},
+		{"http URL", "http://example.com/?xt=urn:btih:" + testHex, true},
+		{"short hash", "magnet:?xt=urn:btih:c12fe1c06bba", false},
+		{"bad hex", "magnet:?xt=urn:btih:z12fe1c06bba254a9dc9f519b335aa7c1367a88a", false},
+		{"bad base32", "magnet:?xt=urn:btih:1EX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK", false},
+	}
+
+	for _, tc := range cases {
+		_, err := Parse(tc.uri)
+
+		if err == nil {
+			t.Errorf("%s: Parsed", tc.name)
+		} else if errors.Is(err, ErrNotMagnet) != tc.notMagnet {
+			t.Errorf("%s: Got %v", tc.name, err)
+		}
+	}
+}
@@ -1,167 +1,369 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
-	"crypto/sha1"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
-	"net/url"
+	"net"
 	"os"
-	"strconv"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/copperwall/bittorrent-go/dht"
+	"github.com/copperwall/bittorrent-go/magnet"
+	"github.com/copperwall/bittorrent-go/metadata"
+	"github.com/copperwall/bittorrent-go/metainfo"
+	"github.com/copperwall/bittorrent-go/mse"
 	"github.com/copperwall/bittorrent-go/p2p"
 	"github.com/copperwall/bittorrent-go/peers"
-	"github.com/jackpal/bencode-go"
+	"github.com/copperwall/bittorrent-go/storage"
+	"github.com/copperwall/bittorrent-go/tracker"
 )
 
 const Port = 6881
 
-// TorrentFile : Everything we need lol
-type TorrentFile struct {
-	Announce    string
-	InfoHash    [20]byte
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
-}
+// requestPeers announces to the torrent's trackers and returns the peers from
+// the first one that answers
+func requestPeers(ctx context.Context, t *metainfo.TorrentFile, peerID [20]byte, port uint16) ([]peers.Peer, error) {
+	tiers := tracker.NewTiers(t.Trackers())
+	resp, err := tiers.Announce(ctx, tracker.AnnounceRequest{
+		InfoHash: t.InfoHash,
+		PeerID:   peerID,
+		Port:     port,
+		Left:     int64(t.Length),
+	})
 
-type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
-}
+	if err != nil {
+		return nil, err
+	}
 
-type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	return resp.Peers, nil
 }
 
-func (info *bencodeInfo) hash() ([20]byte, error) {
-	buf := bytes.Buffer{}
-
-	err := bencode.Marshal(&buf, *info)
+// localIPv6 returns a public IPv6 address of this host, or nil if there
+// isn't one
+func localIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
 
 	if err != nil {
-		return [20]byte{}, err
+		return nil
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		ip := ipNet.IP
+		// Skip IPv4, link-local and unique local (fc00::/7) addresses
+		if ip.To4() != nil || !ip.IsGlobalUnicast() || ip[0]&0xfe == 0xfc {
+			continue
+		}
+
+		return ip
 	}
 
-	return sha1.Sum(buf.Bytes()), nil
+	return nil
 }
 
-func (info *bencodeInfo) splitPieces() ([][20]byte, error) {
-	// split pieces into 20 byte sections
-	hashLen := 20
+// openMagnet finds peers for a magnet link and downloads the info dictionary
+// from them. The peer hints from the link are returned for the download.
+// node is used to find peers if the link's trackers don't give us any, and
+// can be nil. policy decides if connections to peers are encrypted.
+func openMagnet(ctx context.Context, uri string, peerID [20]byte, node *dht.DHT, policy mse.Policy) (metainfo.TorrentFile, []peers.Peer, error) {
+	link, err := magnet.Parse(uri)
 
-	// Cast Pieces into a buf
-	piecesBuf := []byte(info.Pieces)
+	if err != nil {
+		return metainfo.TorrentFile{}, nil, err
+	}
 
-	// If pieces isn't divisible by the sha1 hash length, we have a problem
-	if len(piecesBuf)%hashLen != 0 {
-		err := fmt.Errorf("Pieces of length %v isn't divisible by %v", len(piecesBuf), hashLen)
+	fmt.Println("Fetching metadata for", link.Name)
 
-		return nil, err
+	found := link.Peers
+
+	for _, tracker := range link.Trackers {
+		// We don't know the length until we have the metadata, but telling
+		// the tracker we have nothing left would make it treat us as a seed.
+		partial := metainfo.TorrentFile{Announce: tracker, InfoHash: link.InfoHash, Length: 1}
+		trackerPeers, err := requestPeers(ctx, &partial, peerID, Port)
+
+		if ctx.Err() != nil {
+			return metainfo.TorrentFile{}, nil, ctx.Err()
+		}
+
+		if err != nil {
+			log.Printf("Could not get peers from %s: %v\n", tracker, err)
+			continue
+		}
+
+		found = append(found, trackerPeers...)
 	}
 
-	numHashes := len(piecesBuf) / hashLen
-	hashes := make([][20]byte, numHashes)
+	if len(found) == 0 && node != nil {
+		dhtPeers, err := node.GetPeers(ctx, link.InfoHash)
+
+		if ctx.Err() != nil {
+			return metainfo.TorrentFile{}, nil, ctx.Err()
+		}
+
+		if err != nil {
+			log.Println("Could not get peers from the DHT:", err)
+		}
 
-	for i := 0; i < numHashes; i++ {
-		// The : in the second arg to copy is a [ : ]
-		// For i = 0, would look like [0 : 20]
-		// For i = 0, would look like [20 : 40]
-		copy(hashes[i][:], piecesBuf[i*hashLen:(i+1)*hashLen])
+		found = append(found, dhtPeers...)
 	}
 
-	return hashes, nil
-}
+	if len(found) == 0 {
+		return metainfo.TorrentFile{}, nil, fmt.Errorf("Found no peers to fetch metadata from")
+	}
+
+	info, err := metadata.Fetch(ctx, found, peerID, link.InfoHash, policy)
+
+	if err != nil {
+		return metainfo.TorrentFile{}, nil, err
+	}
+
+	tf, err := metainfo.ParseInfo(info, "")
+
+	if err != nil {
+		return metainfo.TorrentFile{}, nil, err
+	}
 
-func (b *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
-	tf := TorrentFile{}
+	// Each tracker from the link gets a tier of its own, in the order given
+	for _, tracker := range link.Trackers {
+		tf.AnnounceList = append(tf.AnnounceList, []string{tracker})
+	}
 
-	infoHash, err := b.Info.hash()
+	return tf, link.Peers, nil
+}
+
+// dhtPath is where the DHT routing table is kept between runs
+func dhtPath() string {
+	dir, err := os.UserCacheDir()
 
 	if err != nil {
-		return TorrentFile{}, err
+		return "dht.state"
 	}
 
-	pieceHashes, err := b.Info.splitPieces()
+	return filepath.Join(dir, "bittorrent-go", "dht.state")
+}
+
+// startDHT joins the DHT, starting from the routing table of the last run if
+// there is one. It returns nil if we can't listen for DHT traffic.
+func startDHT(ctx context.Context) *dht.DHT {
+	addr := fmt.Sprintf(":%d", Port)
+	node, err := dht.Load(dhtPath(), addr)
+
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Could not load the DHT routing table:", err)
+		}
+
+		node, err = dht.New(addr, dht.ID{})
+	}
 
 	if err != nil {
-		return TorrentFile{}, err
+		log.Println("Not using the DHT:", err)
+		return nil
 	}
 
-	tf.Announce = b.Announce
-	tf.InfoHash = infoHash
-	tf.PieceHashes = pieceHashes
-	tf.PieceLength = b.Info.PieceLength
-	tf.Length = b.Info.Length
-	tf.Name = b.Info.Name
+	err = node.Bootstrap(ctx, dht.DefaultBootstrap)
 
-	return tf, nil
+	if err != nil {
+		log.Println("Could not join the DHT:", err)
+	}
+
+	return node
 }
 
-func (t *TorrentFile) toTrackerURL(peerID [20]byte, port uint16) (string, error) {
-	announceURL, err := url.Parse(t.Announce)
+// stopDHT saves the routing table for the next run and leaves the DHT
+func stopDHT(node *dht.DHT) {
+	if node == nil {
+		return
+	}
+
+	path := dhtPath()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+
+	if err == nil {
+		err = node.Save(path)
+	}
 
 	if err != nil {
-		return "", err
+		log.Println("Could not save the DHT routing table:", err)
 	}
 
-	// Build query params
-	params := url.Values{
-		// NOTE: What if I just don't include the slice portion?
-		"info_hash":  []string{string(t.InfoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(t.Length)},
+	node.Close()
+}
+
+// dataPath is where a torrent is downloaded to. Single file torrents get a
+// .download suffix until they're complete. A finished file from an earlier
+// run is used where it is, so it gets checked and seeded rather than
+// downloaded all over again.
+func dataPath(torrent *p2p.Torrent, multiFile bool) string {
+	if multiFile {
+		return torrent.Name
 	}
 
-	// Append query params to announce base url and return
-	// the stringified version.
-	announceURL.RawQuery = params.Encode()
-	return announceURL.String(), nil
+	partial := torrent.Name + ".download"
+
+	if _, err := os.Stat(partial); os.IsNotExist(err) {
+		if _, err := os.Stat(torrent.Name); err == nil {
+			return torrent.Name
+		}
+	}
+
+	return partial
 }
 
-type bencodeTrackerResp struct {
-	Interval 	int 	`bencode:"interval"`
-	Peers 		string	`bencode:"peers"`
+// openStorage opens the torrent's files without throwing away anything an
+// earlier run already downloaded into them
+func openStorage(tf metainfo.TorrentFile, path string) (storage.Storage, error) {
+	layout := storage.Layout{
+		PieceLength: tf.PieceLength,
+		Length:      tf.Length,
+	}
+
+	if !tf.IsMultiFile() {
+		return storage.OpenFile(path, layout)
+	}
+
+	for _, f := range tf.Files {
+		layout.Files = append(layout.Files, storage.File{Path: f.Path, Length: f.Length, Offset: f.Offset})
+	}
+
+	fmt.Println("Creating directory at", path)
+	return storage.OpenDir(path, layout)
 }
 
-func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]peers.Peer, error) {
-	url, err := t.toTrackerURL(peerID, port)
+// resume works out which pieces an earlier run already downloaded. The
+// resume file saves hashing everything again, but without one every piece
+// on disk gets checked.
+func resume(torrent *p2p.Torrent, store storage.Storage, existed bool) {
+	torrent.ResumePath = torrent.Name + ".resume"
 
-	if err != nil {
-		return nil, err
+	// A resume file for data that's gone is no use
+	if !existed {
+		os.Remove(torrent.ResumePath)
+		return
 	}
-	c := &http.Client{Timeout: 15 * time.Second}
 
-	log.Println("Asking for peers from tracker at url", url)
-	resp, err := c.Get(url)
+	have, err := p2p.LoadResume(torrent.ResumePath, torrent.InfoHash)
 
 	if err != nil {
-		return nil, err
+		if !os.IsNotExist(err) {
+			log.Println(err)
+		}
+
+		fmt.Println("Checking pieces that are already downloaded")
+		have = torrent.Verify(store)
 	}
 
-	defer resp.Body.Close()
+	torrent.Resume(have)
+}
 
-	fmt.Println("Lenght", resp)
-	trackerResp := bencodeTrackerResp{}
-	err = bencode.Unmarshal(resp.Body, &trackerResp)
+// download fetches the rest of the torrent into store, which is at path. A
+// single file torrent is renamed from <name>.download when it's finished.
+// finished is called once the download is in place, while it can still be
+// read to upload to other peers.
+func download(ctx context.Context, torrent *p2p.Torrent, store storage.Storage, path string, finished func()) error {
+	err := torrent.Download(ctx, store)
 
-	fmt.Println(trackerResp)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	// Renaming doesn't affect the open file, so we can keep uploading from it
+	if path != torrent.Name {
+		err = os.Rename(path, torrent.Name)
+
+		if err != nil {
+			return err
+		}
 	}
 
-	return peers.Unmarshal([]byte(trackerResp.Peers))
+	// Nothing to resume once everything is downloaded
+	os.Remove(torrent.ResumePath)
+
+	finished()
+	return nil
+}
+
+// printProgress prints a line for every piece we finish, until events is
+// closed
+func printProgress(torrent *p2p.Torrent, events <-chan p2p.Event) {
+	for e := range events {
+		if e.Type != p2p.EventPieceDone {
+			continue
+		}
+
+		stats := torrent.Stats()
+		percent := float64(stats.PiecesDone) / float64(stats.PiecesTotal) * 100
+
+		eta := "unknown"
+		if stats.ETA > 0 {
+			eta = stats.ETA.Round(time.Second).String()
+		}
+
+		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers at %0.1f KiB/s, ETA %s\n",
+			percent, e.Piece, len(stats.Peers), stats.DownloadRate/1024, eta)
+	}
+}
+
+// scrape prints the swarm health of each torrent, from the first of its
+// trackers that answers
+func scrape(ctx context.Context, filenames []string) error {
+	for _, filename := range filenames {
+		tf, err := metainfo.Open(filename)
+
+		if err != nil {
+			return err
+		}
+
+		answered := false
+
+		for _, tier := range tf.Trackers() {
+			for _, announceURL := range tier {
+				results, err := tracker.Scrape(ctx, announceURL, [][20]byte{tf.InfoHash})
+
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+
+				if err != nil {
+					log.Printf("Could not scrape %s: %v\n", announceURL, err)
+					continue
+				}
+
+				result, ok := results[tf.InfoHash]
+				if !ok {
+					log.Printf("Tracker %s doesn't know about %s\n", announceURL, tf.Name)
+					continue
+				}
+
+				fmt.Printf("%s: %d seeders, %d leechers, %d completed (%s)\n",
+					tf.Name, result.Seeders, result.Leechers, result.Completed, announceURL)
+				answered = true
+				break
+			}
+
+			if answered {
+				break
+			}
+		}
+
+		if !answered {
+			fmt.Printf("%s: no tracker answered\n", tf.Name)
+		}
+	}
+
+	return nil
 }
 
 func main() {
@@ -170,84 +372,174 @@ func main() {
 
 	if err != nil {
 		fmt.Println(err)
-		fmt.Println("Usage:", os.Args[0], "<filename>")
+		fmt.Println("Usage:", os.Args[0], "[--seed] [--encryption=disabled|preferred|required] <filename|magnet link>")
+		fmt.Println("      ", os.Args[0], "scrape <filename>...")
 		os.Exit(1)
 	}
 
+	ctx := withSignals()
+
+	if args.scrape {
+		err := scrape(ctx, args.filenames)
+
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	fmt.Println(args.filename)
 
-	r, err := os.Open(args.filename)
+	var peerID [20]byte
+	_, randErr := rand.Read(peerID[:])
 
-	if err != nil {
-		fmt.Println(err)
+	if randErr != nil {
+		fmt.Println(randErr)
 		os.Exit(1)
 	}
 
-	torrentInfo := bencodeTorrent{}
-	bencode.Unmarshal(r, &torrentInfo)
-	fmt.Println(torrentInfo.Announce)
-	outfile := torrentInfo.Info.Name
-	fmt.Println("Creating file at", outfile)
-	_, createErr := os.Create(outfile)
+	var tf metainfo.TorrentFile
+	var magnetPeers []peers.Peer
+
+	// The DHT finds peers for torrents whose trackers are gone
+	node := startDHT(ctx)
 
-	if createErr != nil {
+	if magnet.IsMagnet(args.filename) {
+		tf, magnetPeers, err = openMagnet(ctx, args.filename, peerID, node, args.encryption)
+	} else {
+		tf, err = metainfo.Open(args.filename)
+	}
+
+	if err != nil {
 		fmt.Println(err)
+		stopDHT(node)
 		os.Exit(1)
 	}
 
-	tf, err := torrentInfo.toTorrentFile()
+	fmt.Println(tf.Announce)
+
+	torrent := &p2p.Torrent{
+		Peers: magnetPeers,
+		PeerID: peerID,
+		InfoHash: tf.InfoHash,
+		PieceHashes: tf.PieceHashes,
+		PieceLength: tf.PieceLength,
+		Length: tf.Length,
+		Name: tf.Name,
+		Encryption: args.encryption,
+	}
+
+	path := dataPath(torrent, tf.IsMultiFile())
+	_, statErr := os.Stat(path)
+	store, err := openStorage(tf, path)
 
 	if err != nil {
 		fmt.Println(err)
+		stopDHT(node)
 		os.Exit(1)
 	}
 
-	fmt.Println(tf.toTrackerURL(tf.PieceHashes[0], 6881))
+	resume(torrent, store, statErr == nil)
 
-	var peerID [20]byte
-	_, randErr := rand.Read(peerID[:])
+	// Let peers that hear about us from the tracker connect to us
+	server, err := p2p.Listen(Port, peerID)
 
-	if randErr != nil {
-		fmt.Println(randErr)
-		os.Exit(1)
+	if err != nil {
+		log.Println("Not accepting incoming connections:", err)
+	} else {
+		server.Encryption = args.encryption
+		server.Add(torrent)
+		go server.Serve()
 	}
 
-	peers, err := tf.requestPeers(peerID, Port)
+	// The tracker session keeps announcing for as long as we're downloading,
+	// and feeds any new peers it hears about into the download.
+	session := tracker.NewSession(tracker.NewTiers(tf.Trackers()), tf.InfoHash, peerID, Port)
+	session.Stats = func() (int64, int64, int64) {
+		return torrent.Uploaded(), torrent.Downloaded(), torrent.Left()
+	}
+	session.OnPeers = torrent.AddPeers
+	session.IPv6 = localIPv6()
 
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	if len(tf.Trackers()) > 0 {
+		trackerPeers, err := session.Start(ctx)
+
+		// Peers from a magnet link or the DHT might be enough on their own
+		if err != nil {
+			log.Println("Could not get peers from the trackers:", err)
+		}
+
+		torrent.AddPeers(trackerPeers)
 	}
 
-	if len(peers) == 0 {
+	if node != nil {
+		if len(torrent.KnownPeers()) == 0 && ctx.Err() == nil {
+			dhtPeers, err := node.GetPeers(ctx, tf.InfoHash)
+
+			if err != nil {
+				log.Println("Could not get peers from the DHT:", err)
+			}
+
+			torrent.AddPeers(dhtPeers)
+		}
+
+		go node.Track(ctx, tf.InfoHash, Port, torrent.AddPeers)
+	}
+
+	knownPeers := torrent.KnownPeers()
+
+	if len(knownPeers) == 0 || ctx.Err() != nil {
 		fmt.Println("Found no peers, cannot download.")
+		session.Stop()
+		stopDHT(node)
+		store.Close()
 		os.Exit(0)
 	}
 
-	fmt.Println(peers)
+	fmt.Println(knownPeers)
 
-	torrent := p2p.Torrent{
-		Peers: peers,
-		PeerID: peerID,
-		InfoHash: tf.InfoHash,
-		PieceHashes: tf.PieceHashes,
-		PieceLength: tf.PieceLength,
-		Length: tf.Length,
-		Name: tf.Name,
+	events, unsubscribe := torrent.Subscribe()
+	go printProgress(torrent, events)
+
+	err = download(ctx, torrent, store, path, func() {
+		session.Completed()
+
+		if args.seed && server != nil {
+			fmt.Println("Download complete, seeding until interrupted")
+			<-ctx.Done()
+		}
+	})
+
+	unsubscribe()
+
+	if server != nil {
+		server.Close()
 	}
 
-	tempFileName := torrent.Name + ".download"
+	session.Stop()
+	stopDHT(node)
 
-	tempFile, err := os.Create(tempFileName)
-	err = torrent.Download(tempFile)
+	// Peers we're seeding to may still be reading pieces
+	torrent.Close()
+
+	// Flush whatever we got to disk, however the download ended
+	closeErr := store.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if errors.Is(err, context.Canceled) {
+		fmt.Println("Stopped, run again to pick up where we left off")
+		os.Exit(1)
+	}
 
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	os.Rename(tempFileName, torrent.Name)
-
 	// outFile, err := os.Create(torrent.Name)
 	// buf, err := torrent.Download()
 	// if err != nil {
@@ -267,18 +559,75 @@ func main() {
 	fmt.Println("Holy shit did that work?")
 }
 
+// withSignals returns a context that's cancelled on Ctrl-C or SIGTERM, so
+// that we can stop cleanly. A second signal quits straight away.
+func withSignals() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		fmt.Println("Stopping, interrupt again to quit right away")
+		cancel()
+
+		<-signals
+		os.Exit(1)
+	}()
+
+	return ctx
+}
+
 type arguments struct {
 	filename string
+	// seed keeps uploading after the download finishes
+	seed bool
+	// encryption is whether connections to peers are MSE encrypted
+	encryption mse.Policy
+	// scrape is set for the scrape command, which takes any number of files
+	scrape    bool
+	filenames []string
 }
 
 const numArgs = 1
 
 func validateArgs(args []string) (arguments, error) {
+	if len(args) > 0 && args[0] == "scrape" {
+		if len(args) < 2 {
+			return arguments{}, fmt.Errorf("Error: Expected at least one torrent to scrape")
+		}
+
+		return arguments{scrape: true, filenames: args[1:]}, nil
+	}
+
+	seed := false
+	encryption := mse.Preferred
+
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		switch {
+		case args[0] == "--seed":
+			seed = true
+		case strings.HasPrefix(args[0], "--encryption="):
+			policy, err := mse.ParsePolicy(strings.TrimPrefix(args[0], "--encryption="))
+			if err != nil {
+				return arguments{}, fmt.Errorf("Error: %v", err)
+			}
+			encryption = policy
+		default:
+			return arguments{}, fmt.Errorf("Error: Unknown option %s", args[0])
+		}
+
+		args = args[1:]
+	}
+
 	if len(args) != numArgs {
 		return arguments{}, fmt.Errorf("Error: Expected %v arguments, but got %v", numArgs, len(args))
 	}
 
 	return arguments{
-		args[0],
+		filename: args[0],
+		seed: seed,
+		encryption: encryption,
 	}, nil
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/copperwall/bittorrent-go/p2p"
+)
+
+func TestDataPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datapath")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	torrent := &p2p.Torrent{Name: filepath.Join(dir, "file")}
+
+	if path := dataPath(torrent, true); path != torrent.Name {
+		t.Errorf("Multi-file torrents download to %s", path)
+	}
+
+	// Nothing there yet
+	if path := dataPath(torrent, false); path != torrent.Name+".download" {
+		t.Errorf("Expected a new download to go to .download, got %s", path)
+	}
+
+	// Finished by an earlier run, so it's used where it is
+	ioutil.WriteFile(torrent.Name, []byte("done"), 0644)
+
+	if path := dataPath(torrent, false); path != torrent.Name {
+		t.Errorf("Expected the finished file, got %s", path)
+	}
+
+	// A download in progress wins
+	ioutil.WriteFile(torrent.Name+".download", []byte("partial"), 0644)
+
+	if path := dataPath(torrent, false); path != torrent.Name+".download" {
+		t.Errorf("Expected the partial download, got %s", path)
+	}
+}
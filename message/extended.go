@@ -0,0 +1,172 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// ExtendedHandshake is the dictionary in an extension handshake (BEP 10),
+// the extended message with ID 0 that each side sends once after the
+// BitTorrent handshake
+type ExtendedHandshake struct {
+	// M maps each extension the sender speaks to the extended message ID
+	// it wants that extension's messages sent to it with. 0 means the
+	// sender turned the extension off.
+	M map[string]uint8
+	// V is the client's name and version
+	V string
+	// P is the port the sender accepts connections on
+	P uint16
+	// Reqq is how many outstanding requests the sender will queue
+	Reqq int
+	// MetadataSize is the size of the info dictionary (BEP 9)
+	MetadataSize int
+	// YourIP is the receiver's address as the sender sees it
+	YourIP net.IP
+}
+
+// FormatExtendedHandshake returns an extension handshake message. Fields
+// left at their zero value are left out.
+func FormatExtendedHandshake(hs *ExtendedHandshake) (*Message, error) {
+	m := map[string]interface{}{}
+	for name, id := range hs.M {
+		m[name] = int(id)
+	}
+
+	dict := map[string]interface{}{"m": m}
+
+	if hs.V != "" {
+		dict["v"] = hs.V
+	}
+
+	if hs.P != 0 {
+		dict["p"] = int(hs.P)
+	}
+
+	if hs.Reqq != 0 {
+		dict["reqq"] = hs.Reqq
+	}
+
+	if hs.MetadataSize != 0 {
+		dict["metadata_size"] = hs.MetadataSize
+	}
+
+	if ip := hs.YourIP.To4(); ip != nil {
+		dict["yourip"] = string(ip)
+	} else if ip := hs.YourIP.To16(); ip != nil {
+		dict["yourip"] = string(ip)
+	}
+
+	buf := bytes.Buffer{}
+	err := bencode.Marshal(&buf, dict)
+	if err != nil {
+		return nil, err
+	}
+
+	return FormatExtended(0, buf.Bytes()), nil
+}
+
+// ParseExtendedHandshake reads the payload of an extension handshake, what
+// ParseExtended returns for extended message ID 0. The dictionary comes
+// from the peer as is, so keys with values of the wrong type are skipped
+// rather than failing the whole handshake.
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	v, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Extension handshake is not a dictionary")
+	}
+
+	hs := &ExtendedHandshake{M: map[string]uint8{}}
+
+	m, _ := dict["m"].(map[string]interface{})
+	for name, value := range m {
+		if id, ok := value.(int64); ok && id >= 0 && id <= 255 {
+			hs.M[name] = uint8(id)
+		}
+	}
+
+	hs.V, _ = dict["v"].(string)
+
+	if p, ok := dict["p"].(int64); ok && p > 0 && p <= 65535 {
+		hs.P = uint16(p)
+	}
+
+	if reqq, ok := dict["reqq"].(int64); ok && reqq > 0 {
+		hs.Reqq = int(reqq)
+	}
+
+	if size, ok := dict["metadata_size"].(int64); ok && size > 0 {
+		hs.MetadataSize = int(size)
+	}
+
+	if ip, _ := dict["yourip"].(string); len(ip) == net.IPv4len || len(ip) == net.IPv6len {
+		hs.YourIP = net.IP(ip)
+	}
+
+	return hs, nil
+}
+
+// Registry hands out the extended message IDs peers send our extensions'
+// messages to us with. Extensions are registered by name, like
+// "ut_metadata", and get IDs in the order they're registered, starting at
+// 1 since 0 is the handshake. Register everything before the first
+// handshake goes out.
+type Registry struct {
+	names []string
+}
+
+// Register adds an extension and returns its ID. Registering the same name
+// twice returns the same ID.
+func (r *Registry) Register(name string) uint8 {
+	if id := r.ID(name); id != 0 {
+		return id
+	}
+
+	r.names = append(r.names, name)
+
+	return uint8(len(r.names))
+}
+
+// ID is the ID of the extension called name, or 0 if it isn't registered
+func (r *Registry) ID(name string) uint8 {
+	for i, registered := range r.names {
+		if registered == name {
+			return uint8(i + 1)
+		}
+	}
+
+	return 0
+}
+
+// Name is the name of the extension with ID id, or "" if there isn't one
+func (r *Registry) Name(id uint8) string {
+	if id == 0 || int(id) > len(r.names) {
+		return ""
+	}
+
+	return r.names[id - 1]
+}
+
+// Names lists every registered extension
+func (r *Registry) Names() []string {
+	return append([]string(nil), r.names...)
+}
+
+// Handshake returns an extension handshake offering every registered
+// extension. The rest of the fields are up to the caller.
+func (r *Registry) Handshake() *ExtendedHandshake {
+	hs := &ExtendedHandshake{M: map[string]uint8{}}
+	for i, name := range r.names {
+		hs.M[name] = uint8(i + 1)
+	}
+
+	return hs
+}
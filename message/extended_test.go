@@ -0,0 +1,103 @@
+package message
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestExtendedHandshakeRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		hs   ExtendedHandshake
+	}{
+		{"empty", ExtendedHandshake{M: map[string]uint8{}}},
+		{"all fields IPv4", ExtendedHandshake{
+			M:            map[string]uint8{"ut_metadata": 1, "ut_pex": 2, "lt_donthave": 0},
+			V:            "bittorrent-go 0.1",
+			P:            6881,
+			Reqq:         250,
+			MetadataSize: 31337,
+			YourIP:       net.IPv4(10, 0, 0, 7).To4(),
+		}},
+		{"IPv6 yourip", ExtendedHandshake{
+			M:      map[string]uint8{"ut_pex": 3},
+			P:      65535,
+			YourIP: net.ParseIP("2001:db8::1"),
+		}},
+	}
+
+	for _, tc := range cases {
+		msg, err := FormatExtendedHandshake(&tc.hs)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		msg, err = Read(bytes.NewReader(msg.Serialize()))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		id, payload, err := ParseExtended(msg)
+		if err != nil || id != 0 {
+			t.Fatalf("%s: Extended ID %d, %v", tc.name, id, err)
+		}
+
+		got, err := ParseExtendedHandshake(payload)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if !reflect.DeepEqual(*got, tc.hs) {
+			t.Errorf("%s: Got %+v, want %+v", tc.name, *got, tc.hs)
+		}
+	}
+}
+
+func TestParseExtendedHandshakeSkipsBadValues(t *testing.T) {
+	payload := []byte("d1:md11:ut_metadatai300e6:ut_pexi2ee1:pi70000e4:reqqi-1e6:yourip3:abce")
+
+	hs, err := ParseExtendedHandshake(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := ExtendedHandshake{M: map[string]uint8{"ut_pex": 2}}
+	if !reflect.DeepEqual(*hs, want) {
+		t.Errorf("Got %+v, want %+v", *hs, want)
+	}
+
+	if _, err := ParseExtendedHandshake([]byte("li1ee")); err == nil {
+		t.Error("Parsed a list as a handshake")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	var r Registry
+
+	if id := r.Register("ut_metadata"); id != 1 {
+		t.Errorf("ut_metadata got ID %d", id)
+	}
+	if id := r.Register("ut_pex"); id != 2 {
+		t.Errorf("ut_pex got ID %d", id)
+	}
+	if id := r.Register("ut_metadata"); id != 1 {
+		t.Errorf("Registering ut_metadata again got ID %d", id)
+	}
+
+	if r.ID("lt_donthave") != 0 || r.Name(0) != "" || r.Name(3) != "" {
+		t.Error("Unregistered extensions have IDs or names")
+	}
+	if r.Name(2) != "ut_pex" {
+		t.Errorf("ID 2 is %q", r.Name(2))
+	}
+	if names := r.Names(); !reflect.DeepEqual(names, []string{"ut_metadata", "ut_pex"}) {
+		t.Errorf("Names %v", names)
+	}
+
+	want := map[string]uint8{"ut_metadata": 1, "ut_pex": 2}
+	if hs := r.Handshake(); !reflect.DeepEqual(hs.M, want) {
+		t.Errorf("Handshake offers %v", hs.M)
+	}
+}
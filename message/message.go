@@ -18,6 +18,14 @@ const (
 	MsgRequest messageID = 6
 	MsgPiece messageID = 7
 	MsgCancel messageID = 8
+	// The fast extension (BEP 6) adds these
+	MsgSuggest messageID = 13
+	MsgHaveAll messageID = 14
+	MsgHaveNone messageID = 15
+	MsgReject messageID = 16
+	MsgAllowedFast messageID = 17
+	// MsgExtended carries extension protocol messages (BEP 10)
+	MsgExtended messageID = 20
 )
 
 type Message struct {
@@ -49,6 +57,18 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgSuggest:
+		return "Suggest"
+	case MsgHaveAll:
+		return "HaveAll"
+	case MsgHaveNone:
+		return "HaveNone"
+	case MsgReject:
+		return "Reject"
+	case MsgAllowedFast:
+		return "AllowedFast"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
@@ -96,6 +116,42 @@ func FormatRequest(index, begin, length int) *Message {
 	return &Message{ID: MsgRequest, Payload: payload}
 }
 
+// FormatCancel returns a CANCEL for a block we requested earlier. The
+// payload is the same as the REQUEST's.
+func FormatCancel(index, begin, length int) *Message {
+	msg := FormatRequest(index, begin, length)
+	msg.ID = MsgCancel
+
+	return msg
+}
+
+// FormatReject returns a REJECT, telling the peer we won't send a block it
+// asked for. The payload is the same as the REQUEST's.
+func FormatReject(index, begin, length int) *Message {
+	msg := FormatRequest(index, begin, length)
+	msg.ID = MsgReject
+
+	return msg
+}
+
+// FormatSuggest returns a SUGGEST, a hint that the peer might want to
+// download a piece from us next
+func FormatSuggest(index int) *Message {
+	msg := FormatHave(index)
+	msg.ID = MsgSuggest
+
+	return msg
+}
+
+// FormatAllowedFast returns an ALLOWED FAST, which lets the peer download
+// a piece from us even while we're choking it
+func FormatAllowedFast(index int) *Message {
+	msg := FormatHave(index)
+	msg.ID = MsgAllowedFast
+
+	return msg
+}
+
 func FormatHave(index int) *Message {
 	payload := make([]byte, 4)
 
@@ -106,6 +162,33 @@ func FormatHave(index int) *Message {
 	}
 }
 
+// FormatPiece returns a Message with a block of a piece
+// Payload is
+//		4 bytes of the index
+//		4 bytes of the begin offset
+//		the block itself
+func FormatPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8 + len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+// FormatExtended returns an extension protocol message.
+// The first byte of the payload is the extended message ID (0 is the
+// extension handshake), the rest is the extension's own payload.
+func FormatExtended(extendedID uint8, payload []byte) *Message {
+	buf := make([]byte, 1 + len(payload))
+	buf[0] = extendedID
+	copy(buf[1:], payload)
+
+	return &Message{
+		ID: MsgExtended,
+		Payload: buf,
+	}
+}
 
 func Read(r io.Reader) (*Message, error) {
 	lengthBuf := make([]byte, 4)
@@ -179,3 +262,98 @@ func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 
 	return len(data), nil
 }
+
+// ParseExtended splits an extended message into its extended message ID and payload
+func ParseExtended(msg *Message) (uint8, []byte, error) {
+	if msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("Expected EXTENDED (ID %d), got ID %d", MsgExtended, msg.ID)
+	}
+
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("Expected payload length of at least 1, got length %d", len(msg.Payload))
+	}
+
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+// ParseBlock returns the index, begin offset and data of a PIECE
+func ParseBlock(msg *Message) (int, int, []byte, error) {
+	if msg.ID != MsgPiece {
+		return 0, 0, nil, fmt.Errorf("Expected PIECE (ID %d), but got ID %d", MsgPiece, msg.ID)
+	}
+
+	if len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("Payload too short, expected 8 or more but got %d", len(msg.Payload))
+	}
+
+	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+
+	return index, begin, msg.Payload[8:], nil
+}
+
+// ParseRequest returns the index, begin offset and length of a REQUEST
+func ParseRequest(msg *Message) (int, int, int, error) {
+	if msg.ID != MsgRequest {
+		return 0, 0, 0, fmt.Errorf("Expected REQUEST (ID %d), got ID %d", MsgRequest, msg.ID)
+	}
+
+	return parseBlock(msg)
+}
+
+// ParseCancel returns the index, begin offset and length of a CANCEL,
+// which has the same payload as the REQUEST it cancels
+func ParseCancel(msg *Message) (int, int, int, error) {
+	if msg.ID != MsgCancel {
+		return 0, 0, 0, fmt.Errorf("Expected CANCEL (ID %d), got ID %d", MsgCancel, msg.ID)
+	}
+
+	return parseBlock(msg)
+}
+
+// ParseReject returns the index, begin offset and length of a REJECT
+func ParseReject(msg *Message) (int, int, int, error) {
+	if msg.ID != MsgReject {
+		return 0, 0, 0, fmt.Errorf("Expected REJECT (ID %d), got ID %d", MsgReject, msg.ID)
+	}
+
+	return parseBlock(msg)
+}
+
+// ParseSuggest returns the piece index of a SUGGEST
+func ParseSuggest(msg *Message) (int, error) {
+	if msg.ID != MsgSuggest {
+		return 0, fmt.Errorf("Expected SUGGEST (ID %d), got ID %d", MsgSuggest, msg.ID)
+	}
+
+	return parseIndex(msg)
+}
+
+// ParseAllowedFast returns the piece index of an ALLOWED FAST
+func ParseAllowedFast(msg *Message) (int, error) {
+	if msg.ID != MsgAllowedFast {
+		return 0, fmt.Errorf("Expected ALLOWED FAST (ID %d), got ID %d", MsgAllowedFast, msg.ID)
+	}
+
+	return parseIndex(msg)
+}
+
+func parseIndex(msg *Message) (int, error) {
+	if len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("Expected payload length 4, got length %d", len(msg.Payload))
+	}
+
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+func parseBlock(msg *Message) (int, int, int, error) {
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("Expected payload length 12, got length %d", len(msg.Payload))
+	}
+
+	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+
+	return index, begin, length, nil
+}
@@ -0,0 +1,92 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+)
+
+// roundTrip serializes msg and reads it back
+func roundTrip(t *testing.T, msg *Message) *Message {
+	t.Helper()
+
+	read, err := Read(bytes.NewReader(msg.Serialize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return read
+}
+
+func TestFastIndexMessages(t *testing.T) {
+	cases := []struct {
+		format func(int) *Message
+		parse  func(*Message) (int, error)
+		id     messageID
+		name   string
+	}{
+		{FormatSuggest, ParseSuggest, MsgSuggest, "Suggest"},
+		{FormatAllowedFast, ParseAllowedFast, MsgAllowedFast, "AllowedFast"},
+	}
+
+	for _, tc := range cases {
+		msg := roundTrip(t, tc.format(1313))
+
+		if msg.ID != tc.id || msg.String() != tc.name+" [4]" {
+			t.Errorf("%s: Got %s with ID %d", tc.name, msg, msg.ID)
+		}
+
+		index, err := tc.parse(msg)
+		if err != nil || index != 1313 {
+			t.Errorf("%s: Parsed %d, %v", tc.name, index, err)
+		}
+
+		// The payload has to be exactly one index
+		msg.Payload = append(msg.Payload, 0)
+		if _, err := tc.parse(msg); err == nil {
+			t.Errorf("%s: Parsed a 5 byte payload", tc.name)
+		}
+
+		if _, err := tc.parse(FormatHave(1)); err == nil {
+			t.Errorf("%s: Parsed a Have", tc.name)
+		}
+	}
+}
+
+func TestReject(t *testing.T) {
+	msg := roundTrip(t, FormatReject(7, 16384, 16384))
+
+	if msg.ID != MsgReject {
+		t.Fatalf("Got ID %d", msg.ID)
+	}
+
+	index, begin, length, err := ParseReject(msg)
+	if err != nil || index != 7 || begin != 16384 || length != 16384 {
+		t.Errorf("Parsed %d, %d, %d, %v", index, begin, length, err)
+	}
+
+	// Same payload as the request it rejects, but not the same message
+	if _, _, _, err := ParseReject(FormatRequest(7, 16384, 16384)); err == nil {
+		t.Error("Parsed a Request as a Reject")
+	}
+
+	msg.Payload = msg.Payload[:8]
+	if _, _, _, err := ParseReject(msg); err == nil {
+		t.Error("Parsed an 8 byte payload")
+	}
+}
+
+func TestHaveAllHaveNone(t *testing.T) {
+	for _, id := range []messageID{MsgHaveAll, MsgHaveNone} {
+		sent := &Message{ID: id}
+
+		// Just the length and the ID
+		if raw := sent.Serialize(); !bytes.Equal(raw, []byte{0, 0, 0, 1, byte(id)}) {
+			t.Errorf("Serialized %d as %x", id, raw)
+		}
+
+		msg := roundTrip(t, sent)
+		if msg.ID != id || len(msg.Payload) != 0 {
+			t.Errorf("Read back %s", msg)
+		}
+	}
+}
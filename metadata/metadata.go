@@ -0,0 +1,267 @@
+// Package metadata fetches a torrent's info dictionary from peers using the
+// ut_metadata extension (BEP 9), which is what makes magnet links work.
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/client"
+	"github.com/copperwall/bittorrent-go/handshake"
+	"github.com/copperwall/bittorrent-go/message"
+	"github.com/copperwall/bittorrent-go/mse"
+	"github.com/copperwall/bittorrent-go/peers"
+	"github.com/jackpal/bencode-go"
+)
+
+// BlockSize is the size of every metadata piece except the last one
+const BlockSize = 16384
+
+// MaxSize is the largest info dictionary we're willing to download
+const MaxSize = 16 * 1024 * 1024
+
+// ExtensionName is what ut_metadata is called in extension handshakes
+const ExtensionName = "ut_metadata"
+
+const (
+	msgRequest = 0
+	msgData    = 1
+	msgReject  = 2
+)
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// Fetch asks each peer in turn for the info dictionary until one of them
+// gives us one that matches infoHash. policy decides if the connections are
+// encrypted.
+func Fetch(ctx context.Context, ps []peers.Peer, peerID, infoHash [20]byte, policy mse.Policy) ([]byte, error) {
+	for _, peer := range ps {
+		info, err := FetchFromPeer(ctx, peer, peerID, infoHash, policy)
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if err != nil {
+			log.Printf("Could not get metadata from %s: %v\n", peer, err)
+			continue
+		}
+
+		return info, nil
+	}
+
+	return nil, fmt.Errorf("None of %d peers gave us the metadata", len(ps))
+}
+
+// FetchFromPeer downloads and verifies the info dictionary from a single peer
+func FetchFromPeer(ctx context.Context, peer peers.Peer, peerID, infoHash [20]byte, policy mse.Policy) ([]byte, error) {
+	conn, err := client.Dial(ctx, peer, infoHash, policy)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	// Closing the connection interrupts whatever read is in progress
+	finished := make(chan struct{})
+	defer close(finished)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	req := handshake.New(infoHash, peerID)
+	// Let the peer know we speak the extension protocol
+	req.Reserved.Set(handshake.ExtensionProtocol)
+
+	_, err = conn.Write(req.Serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := handshake.Read(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(res.InfoHash[:], infoHash[:]) {
+		return nil, fmt.Errorf("Expected infohash %x but got %x", infoHash, res.InfoHash)
+	}
+
+	if !res.Reserved.Has(handshake.ExtensionProtocol) {
+		return nil, fmt.Errorf("Peer does not support the extension protocol")
+	}
+
+	// ut_metadata is the only extension we speak here. Peers send its
+	// messages to us using the ID it gets.
+	extensions := message.Registry{}
+	localMetadataID := extensions.Register(ExtensionName)
+
+	hsMsg, err := message.FormatExtendedHandshake(extensions.Handshake())
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(hsMsg.Serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	var remoteID uint8
+	var size int
+	var dl *download
+
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		// Skip keep-alives and anything that isn't an extension message
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
+
+		extendedID, payload, err := message.ParseExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		switch extendedID {
+		case 0:
+			if dl != nil {
+				continue
+			}
+
+			hs, err := message.ParseExtendedHandshake(payload)
+			if err != nil {
+				return nil, err
+			}
+
+			remoteID = hs.M[ExtensionName]
+			size = hs.MetadataSize
+
+			if remoteID == 0 {
+				return nil, fmt.Errorf("Peer does not support ut_metadata")
+			}
+
+			if size <= 0 || size > MaxSize {
+				return nil, fmt.Errorf("Peer sent a bad metadata size %d", size)
+			}
+
+			dl = &download{info: make([]byte, size), received: map[int]bool{}}
+
+			// Ask for every piece up front, they're tiny
+			for i := 0; i*BlockSize < size; i++ {
+				err := sendExtended(conn, remoteID, metadataMsg{MsgType: msgRequest, Piece: i})
+				if err != nil {
+					return nil, err
+				}
+			}
+		case localMetadataID:
+			if dl == nil {
+				return nil, fmt.Errorf("Got metadata before the extension handshake")
+			}
+
+			done, err := dl.readPiece(payload)
+			if err != nil {
+				return nil, err
+			}
+
+			if !done {
+				continue
+			}
+
+			sha := sha1.Sum(dl.info)
+			if !bytes.Equal(sha[:], infoHash[:]) {
+				return nil, fmt.Errorf("Metadata failed integrity check")
+			}
+
+			return dl.info, nil
+		}
+	}
+}
+
+// download is the info dictionary as it's being put together
+type download struct {
+	info     []byte
+	received map[int]bool
+}
+
+// readPiece copies a ut_metadata data message into the info buffer and
+// reports whether every piece has now been received.
+func (dl *download) readPiece(payload []byte) (bool, error) {
+	// The payload is a bencoded dictionary with the raw piece data
+	// tacked on after it, so we need to know where the dictionary ends.
+	r := bytes.NewReader(payload)
+	br := bufio.NewReader(r)
+
+	msg := metadataMsg{}
+	err := bencode.Unmarshal(br, &msg)
+	if err != nil {
+		return false, err
+	}
+
+	switch msg.MsgType {
+	case msgReject:
+		return false, fmt.Errorf("Peer rejected our request for metadata piece %d", msg.Piece)
+	case msgData:
+	default:
+		// We have nothing to share, so requests just go unanswered
+		return false, nil
+	}
+
+	dictLen := len(payload) - r.Len() - br.Buffered()
+	data := payload[dictLen:]
+
+	begin := msg.Piece * BlockSize
+	if begin < 0 || begin >= len(dl.info) {
+		return false, fmt.Errorf("Metadata piece %d is out of range", msg.Piece)
+	}
+
+	expected := BlockSize
+	if len(dl.info)-begin < expected {
+		expected = len(dl.info) - begin
+	}
+
+	if len(data) != expected {
+		return false, fmt.Errorf("Metadata piece %d has length %d, expected %d", msg.Piece, len(data), expected)
+	}
+
+	copy(dl.info[begin:], data)
+	dl.received[msg.Piece] = true
+
+	numPieces := (len(dl.info) + BlockSize - 1) / BlockSize
+	return len(dl.received) == numPieces, nil
+}
+
+func sendExtended(conn net.Conn, extendedID uint8, v interface{}) error {
+	buf := bytes.Buffer{}
+
+	err := bencode.Marshal(&buf, v)
+	if err != nil {
+		return err
+	}
+
+	msg := message.FormatExtended(extendedID, buf.Bytes())
+	_, err = conn.Write(msg.Serialize())
+
+	return err
+}
@@ -0,0 +1,212 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/copperwall/bittorrent-go/handshake"
+	"github.com/copperwall/bittorrent-go/message"
+	"github.com/copperwall/bittorrent-go/mse"
+	"github.com/copperwall/bittorrent-go/peers"
+	"github.com/jackpal/bencode-go"
+)
+
+// testInfo is an info dictionary stand-in that takes two metadata pieces
+func testInfo() []byte {
+	info := make([]byte, BlockSize+100)
+	for i := range info {
+		info[i] = byte(i % 251)
+	}
+
+	return info
+}
+
+// pieceMsg is a ut_metadata message payload with data tacked on after the
+// dictionary
+func pieceMsg(t *testing.T, msg metadataMsg, data []byte) []byte {
+	t.Helper()
+
+	buf := bytes.Buffer{}
+	if err := bencode.Marshal(&buf, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	return append(buf.Bytes(), data...)
+}
+
+func TestReadPiece(t *testing.T) {
+	info := testInfo()
+	dl := &download{info: make([]byte, len(info)), received: map[int]bool{}}
+
+	// The last piece first, pieces can arrive in any order
+	last := pieceMsg(t, metadataMsg{MsgType: msgData, Piece: 1, TotalSize: len(info)}, info[BlockSize:])
+	done, err := dl.readPiece(last)
+	if err != nil || done {
+		t.Fatalf("Last piece: done %v, %v", done, err)
+	}
+
+	// Requests from the peer are ignored
+	done, err = dl.readPiece(pieceMsg(t, metadataMsg{MsgType: msgRequest, Piece: 0}, nil))
+	if err != nil || done {
+		t.Fatalf("Request: done %v, %v", done, err)
+	}
+
+	first := pieceMsg(t, metadataMsg{MsgType: msgData, Piece: 0, TotalSize: len(info)}, info[:BlockSize])
+	done, err = dl.readPiece(first)
+	if err != nil || !done {
+		t.Fatalf("First piece: done %v, %v", done, err)
+	}
+
+	if !bytes.Equal(dl.info, info) {
+		t.Error("Reassembled metadata doesn't match")
+	}
+}
+
+func TestReadPieceErrors(t *testing.T) {
+	info := testInfo()
+
+	cases := []struct {
+		name    string
+		msg     metadataMsg
+		data    []byte
+		errText string
+	}{
+		{"reject", metadataMsg{MsgType: msgReject, Piece: 1}, nil, "rejected"},
+		{"out of range", metadataMsg{MsgType: msgData, Piece: 2}, info[:10], "out of range"},
+		{"short piece", metadataMsg{MsgType: msgData, Piece: 0}, info[:BlockSize-1], "has length"},
+		{"long last piece", metadataMsg{MsgType: msgData, Piece: 1}, info[:101], "has length"},
+	}
+
+	for _, tc := range cases {
+		dl := &download{info: make([]byte, len(info)), received: map[int]bool{}}
+
+		_, err := dl.readPiece(pieceMsg(t, tc.msg, tc.data))
+		if err == nil || !strings.Contains(err.Error(), tc.errText) {
+			t.Errorf("%s: Got %v, want an error containing %q", tc.name, err, tc.errText)
+		}
+	}
+}
+
+// servePeer accepts one connection and answers ut_metadata requests with
+// pieces of info, or rejects them if reject is set
+func servePeer(t *testing.T, infoHash [20]byte, info []byte, reject bool) peers.Peer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err := handshake.Read(conn); err != nil {
+			return
+		}
+
+		var peerID [20]byte
+		res := handshake.New(infoHash, peerID)
+		res.Reserved.Set(handshake.ExtensionProtocol)
+		conn.Write(res.Serialize())
+
+		// Our ID for ut_metadata is deliberately not 1
+		hs, _ := message.FormatExtendedHandshake(&message.ExtendedHandshake{
+			M:            map[string]uint8{ExtensionName: 3},
+			MetadataSize: len(info),
+		})
+		conn.Write(hs.Serialize())
+
+		var remoteID uint8
+		for {
+			msg, err := message.Read(conn)
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.ID != message.MsgExtended {
+				continue
+			}
+
+			id, payload, err := message.ParseExtended(msg)
+			if err != nil {
+				return
+			}
+
+			if id == 0 {
+				theirs, err := message.ParseExtendedHandshake(payload)
+				if err != nil {
+					return
+				}
+				remoteID = theirs.M[ExtensionName]
+				continue
+			}
+
+			req := metadataMsg{}
+			if id != 3 || bencode.Unmarshal(bytes.NewReader(payload), &req) != nil {
+				return
+			}
+
+			res := metadataMsg{MsgType: msgData, Piece: req.Piece, TotalSize: len(info)}
+			var data []byte
+			if reject {
+				res = metadataMsg{MsgType: msgReject, Piece: req.Piece}
+			} else {
+				end := (req.Piece + 1) * BlockSize
+				if end > len(info) {
+					end = len(info)
+				}
+				data = info[req.Piece*BlockSize : end]
+			}
+
+			reply := message.FormatExtended(remoteID, pieceMsg(t, res, data))
+			conn.Write(reply.Serialize())
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestFetchFromPeer(t *testing.T) {
+	info := testInfo()
+	infoHash := sha1.Sum(info)
+
+	corrupt := append([]byte(nil), info...)
+	corrupt[BlockSize+5] ^= 0xff
+
+	cases := []struct {
+		name    string
+		info    []byte
+		reject  bool
+		errText string
+	}{
+		{"good", info, false, ""},
+		{"hash mismatch", corrupt, false, "integrity"},
+		{"reject", info, true, "rejected"},
+	}
+
+	var peerID [20]byte
+	copy(peerID[:], "-GO0001-metadatatest")
+
+	for _, tc := range cases {
+		peer := servePeer(t, infoHash, tc.info, tc.reject)
+
+		got, err := FetchFromPeer(context.Background(), peer, peerID, infoHash, mse.Disabled)
+
+		if tc.errText == "" {
+			if err != nil || !bytes.Equal(got, info) {
+				t.Errorf("%s: Got %d bytes, %v", tc.name, len(got), err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.errText) {
+			t.Errorf("%s: Got %v, want an error containing %q", tc.name, err, tc.errText)
+		}
+	}
+}
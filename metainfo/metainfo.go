@@ -0,0 +1,265 @@
+// Package metainfo parses .torrent files into a TorrentFile.
+package metainfo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Errors returned by Parse and Open. They are wrapped with more detail, so
+// compare against them with errors.Is.
+var (
+	ErrMalformed      = errors.New("Torrent is not valid bencode")
+	ErrNoName         = errors.New("Torrent has no name")
+	ErrBadPieceLength = errors.New("Torrent has an invalid piece length")
+	ErrBadPieces      = errors.New("Torrent has invalid piece hashes")
+	ErrBadLength      = errors.New("Torrent has an invalid length")
+	ErrBadPath        = errors.New("Torrent has an invalid file path")
+)
+
+// TorrentFile : Everything we need lol
+type TorrentFile struct {
+	Announce     string
+	AnnounceList [][]string
+	InfoHash     [20]byte
+	PieceHashes  [][20]byte
+	PieceLength  int
+	Length       int
+	Name         string
+	Files        []File
+	multiFile    bool
+}
+
+// File is a single file within the torrent. Offset is where the file
+// starts within the torrent's data, which is every file back to back.
+type File struct {
+	Path   []string
+	Length int
+	Offset int
+}
+
+// Trackers returns the tiers of trackers to announce to. When there's an
+// announce-list (BEP 12) the plain announce key is ignored.
+func (t *TorrentFile) Trackers() [][]string {
+	tiers := [][]string{}
+
+	for _, tier := range t.AnnounceList {
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+
+	if len(tiers) == 0 && t.Announce != "" {
+		tiers = append(tiers, []string{t.Announce})
+	}
+
+	return tiers
+}
+
+// IsMultiFile is true when the torrent describes a directory of files
+// rather than a single file.
+func (t *TorrentFile) IsMultiFile() bool {
+	return t.multiFile
+}
+
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type bencodeInfo struct {
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length,omitempty"`
+	Files       []bencodeFile `bencode:"files,omitempty"`
+	Name        string        `bencode:"name"`
+}
+
+type bencodeTorrent struct {
+	Announce     string      `bencode:"announce"`
+	AnnounceList [][]string  `bencode:"announce-list"`
+	Info         bencodeInfo `bencode:"info"`
+}
+
+// Open reads and parses the .torrent file at path
+func Open(path string) (TorrentFile, error) {
+	r, err := os.Open(path)
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	defer r.Close()
+
+	return Parse(r)
+}
+
+// Parse reads a bencoded torrent from r and validates it
+func Parse(r io.Reader) (TorrentFile, error) {
+	data, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	bto := bencodeTorrent{}
+	err = bencode.Unmarshal(bytes.NewReader(data), &bto)
+
+	if err != nil {
+		return TorrentFile{}, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	// The info hash is over the info dictionary exactly as it appears in the file
+	rawInfo, err := rawValue(data, "info")
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	return bto.toTorrentFile(sha1.Sum(rawInfo))
+}
+
+// ParseInfo builds a TorrentFile from a raw info dictionary, like the one
+// fetched from peers for a magnet link. The info dictionary doesn't include
+// a tracker, so that's passed in separately.
+func ParseInfo(rawInfo []byte, announce string) (TorrentFile, error) {
+	info := bencodeInfo{}
+	err := bencode.Unmarshal(bytes.NewReader(rawInfo), &info)
+
+	if err != nil {
+		return TorrentFile{}, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	bto := bencodeTorrent{Announce: announce, Info: info}
+
+	return bto.toTorrentFile(sha1.Sum(rawInfo))
+}
+
+func (info *bencodeInfo) splitPieces() ([][20]byte, error) {
+	// split pieces into 20 byte sections
+	hashLen := 20
+
+	// Cast Pieces into a buf
+	piecesBuf := []byte(info.Pieces)
+
+	// If pieces isn't divisible by the sha1 hash length, we have a problem
+	if len(piecesBuf)%hashLen != 0 {
+		err := fmt.Errorf("%w: length %v isn't divisible by %v", ErrBadPieces, len(piecesBuf), hashLen)
+
+		return nil, err
+	}
+
+	numHashes := len(piecesBuf) / hashLen
+	hashes := make([][20]byte, numHashes)
+
+	for i := 0; i < numHashes; i++ {
+		// The : in the second arg to copy is a [ : ]
+		// For i = 0, would look like [0 : 20]
+		// For i = 0, would look like [20 : 40]
+		copy(hashes[i][:], piecesBuf[i*hashLen:(i+1)*hashLen])
+	}
+
+	return hashes, nil
+}
+
+// buildFiles lays the files in the info dictionary out back to back.
+// A single-file torrent is treated as a list with one file named after the torrent.
+func (info *bencodeInfo) buildFiles() ([]File, int, error) {
+	if len(info.Files) == 0 {
+		if info.Length <= 0 {
+			return nil, 0, fmt.Errorf("%w: %d", ErrBadLength, info.Length)
+		}
+
+		return []File{{Path: []string{info.Name}, Length: info.Length}}, info.Length, nil
+	}
+
+	files := make([]File, len(info.Files))
+	offset := 0
+
+	for i, f := range info.Files {
+		if len(f.Path) == 0 {
+			return nil, 0, fmt.Errorf("%w: file #%d has an empty path", ErrBadPath, i)
+		}
+
+		if f.Length < 0 {
+			return nil, 0, fmt.Errorf("%w: file #%d has length %d", ErrBadLength, i, f.Length)
+		}
+
+		// Don't let a torrent write outside of its own directory
+		for _, part := range f.Path {
+			if part == "" || part == "." || part == ".." || filepath.Base(part) != part {
+				return nil, 0, fmt.Errorf("%w: file #%d has path %q", ErrBadPath, i, f.Path)
+			}
+		}
+
+		files[i] = File{Path: f.Path, Length: f.Length, Offset: offset}
+		offset += f.Length
+	}
+
+	if offset == 0 {
+		return nil, 0, fmt.Errorf("%w: every file is empty", ErrBadLength)
+	}
+
+	return files, offset, nil
+}
+
+// validate checks that the info dictionary describes something we can download
+func (info *bencodeInfo) validate() error {
+	if info.Name == "" || info.Name == "." || info.Name == ".." || filepath.Base(info.Name) != info.Name {
+		return fmt.Errorf("%w: %q", ErrNoName, info.Name)
+	}
+
+	if info.PieceLength <= 0 {
+		return fmt.Errorf("%w: %d", ErrBadPieceLength, info.PieceLength)
+	}
+
+	return nil
+}
+
+func (b *bencodeTorrent) toTorrentFile(infoHash [20]byte) (TorrentFile, error) {
+	tf := TorrentFile{}
+
+	err := b.Info.validate()
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	pieceHashes, err := b.Info.splitPieces()
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	files, length, err := b.Info.buildFiles()
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	// Every piece but the last is full sized, so the number of pieces is fixed by the length
+	expectedPieces := (length + b.Info.PieceLength - 1) / b.Info.PieceLength
+	if len(pieceHashes) != expectedPieces {
+		return TorrentFile{}, fmt.Errorf("%w: expected %d pieces but got %d", ErrBadPieces, expectedPieces, len(pieceHashes))
+	}
+
+	tf.Announce = b.Announce
+	tf.AnnounceList = b.AnnounceList
+	tf.InfoHash = infoHash
+	tf.PieceHashes = pieceHashes
+	tf.PieceLength = b.Info.PieceLength
+	tf.Length = length
+	tf.Name = b.Info.Name
+	tf.Files = files
+	tf.multiFile = len(b.Info.Files) > 0
+
+	return tf, nil
+}
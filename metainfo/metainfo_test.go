@@ -0,0 +1,198 @@
+package metainfo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// testInfo is an info dictionary with keys TorrentFile doesn't model
+var testInfo = "d6:lengthi10e4:name4:test12:piece lengthi16e" +
+	"6:pieces20:" + strings.Repeat("x", 20) +
+	"7:privatei1e6:source3:abce"
+
+func TestInfoHash(t *testing.T) {
+	data := "d8:announce20:http://t.example/ann7:comment5:hello4:info" + testInfo + "e"
+
+	tf, err := Parse(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// private and source count towards the hash even though we drop them
+	if want := sha1.Sum([]byte(testInfo)); tf.InfoHash != want {
+		t.Errorf("Info hash %x, expected %x", tf.InfoHash, want)
+	}
+
+	if tf.Name != "test" || tf.Length != 10 || len(tf.PieceHashes) != 1 {
+		t.Errorf("Parsed %+v", tf)
+	}
+
+	// Fetching the same info dictionary for a magnet link gives the same hash
+	fromMagnet, err := ParseInfo([]byte(testInfo), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fromMagnet.InfoHash != tf.InfoHash {
+		t.Errorf("Info hash from ParseInfo %x, from Parse %x", fromMagnet.InfoHash, tf.InfoHash)
+	}
+}
+
+func TestRawValue(t *testing.T) {
+	data := []byte("d1:ad1:bli1e3:xyzee4:infod1:ci-2ee1:zle")
+
+	raw, err := rawValue(data, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(raw) != "d1:ci-2ee" {
+		t.Errorf("Got %q", raw)
+	}
+
+	for _, bad := range []string{
+		"d1:ai1ee",
+		"li1ee",
+		"d4:infod1:ci1e",
+		"d4:info5:abce",
+		"d4:infoi1",
+	} {
+		_, err := rawValue([]byte(bad), "info")
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("%q: Expected ErrMalformed, got %v", bad, err)
+		}
+	}
+}
+
+// encodeTorrent bencodes a torrent with the given info dictionary
+func encodeTorrent(t *testing.T, info map[string]interface{}) string {
+	t.Helper()
+
+	buf := bytes.Buffer{}
+	err := bencode.Marshal(&buf, map[string]interface{}{
+		"announce": "http://t.example/ann",
+		"info":     info,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+// multiFile is a valid info dictionary with a file at each path
+func multiFile(paths ...[]interface{}) map[string]interface{} {
+	files := []interface{}{}
+	for _, path := range paths {
+		files = append(files, map[string]interface{}{"length": 8, "path": path})
+	}
+
+	return map[string]interface{}{
+		"name":         "test",
+		"piece length": 16,
+		"pieces":       strings.Repeat("x", 20*((8*len(paths)+15)/16)),
+		"files":        files,
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	single := func(key string, value interface{}) map[string]interface{} {
+		info := map[string]interface{}{
+			"name":         "test",
+			"piece length": 16,
+			"pieces":       strings.Repeat("x", 20),
+			"length":       10,
+		}
+
+		if value == nil {
+			delete(info, key)
+		} else {
+			info[key] = value
+		}
+
+		return info
+	}
+
+	cases := []struct {
+		name string
+		data string
+		want error
+	}{
+		{"not bencode", "d8:announce", ErrMalformed},
+		{"not a dictionary", "li1ee", ErrMalformed},
+		{"no info", "d8:announce3:abce", ErrMalformed},
+		{"no name", encodeTorrent(t, single("name", nil)), ErrNoName},
+		{"name is ..", encodeTorrent(t, single("name", "..")), ErrNoName},
+		{"absolute name", encodeTorrent(t, single("name", "/etc")), ErrNoName},
+		{"name with a separator", encodeTorrent(t, single("name", "a/b")), ErrNoName},
+		{"no piece length", encodeTorrent(t, single("piece length", nil)), ErrBadPieceLength},
+		{"negative piece length", encodeTorrent(t, single("piece length", -16)), ErrBadPieceLength},
+		{"pieces not a multiple of 20", encodeTorrent(t, single("pieces", strings.Repeat("x", 21))), ErrBadPieces},
+		{"too few pieces", encodeTorrent(t, single("length", 17)), ErrBadPieces},
+		{"too many pieces", encodeTorrent(t, single("pieces", strings.Repeat("x", 40))), ErrBadPieces},
+		{"no length", encodeTorrent(t, single("length", nil)), ErrBadLength},
+		{"negative length", encodeTorrent(t, single("length", -1)), ErrBadLength},
+		{"negative file length", encodeTorrent(t, map[string]interface{}{
+			"name":         "test",
+			"piece length": 16,
+			"pieces":       strings.Repeat("x", 20),
+			"files": []interface{}{
+				map[string]interface{}{"length": 20, "path": []interface{}{"a"}},
+				map[string]interface{}{"length": -10, "path": []interface{}{"b"}},
+			},
+		}), ErrBadLength},
+		{"every file empty", encodeTorrent(t, map[string]interface{}{
+			"name":         "test",
+			"piece length": 16,
+			"pieces":       "",
+			"files": []interface{}{
+				map[string]interface{}{"length": 0, "path": []interface{}{"a"}},
+			},
+		}), ErrBadLength},
+		{"empty path", encodeTorrent(t, multiFile([]interface{}{"a"}, []interface{}{})), ErrBadPath},
+		{"empty path component", encodeTorrent(t, multiFile([]interface{}{"a", ""})), ErrBadPath},
+		{". component", encodeTorrent(t, multiFile([]interface{}{".", "a"})), ErrBadPath},
+		{".. component", encodeTorrent(t, multiFile([]interface{}{"a", "..", "..", "b"})), ErrBadPath},
+		{"absolute path", encodeTorrent(t, multiFile([]interface{}{"/etc", "passwd"})), ErrBadPath},
+		{"component with a separator", encodeTorrent(t, multiFile([]interface{}{"a/../../b"})), ErrBadPath},
+	}
+
+	errs := []error{ErrMalformed, ErrNoName, ErrBadPieceLength, ErrBadPieces, ErrBadLength, ErrBadPath}
+
+	for _, tc := range cases {
+		_, err := Parse(strings.NewReader(tc.data))
+
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: Expected %v, got %v", tc.name, tc.want, err)
+			continue
+		}
+
+		for _, other := range errs {
+			if other != tc.want && errors.Is(err, other) {
+				t.Errorf("%s: %v also matches %v", tc.name, err, other)
+			}
+		}
+	}
+}
+
+func TestParseMultiFile(t *testing.T) {
+	data := encodeTorrent(t, multiFile([]interface{}{"a"}, []interface{}{"dir", "b"}, []interface{}{"..."}))
+
+	tf, err := Parse(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !tf.IsMultiFile() || tf.Length != 24 || len(tf.Files) != 3 {
+		t.Fatalf("Parsed %+v", tf)
+	}
+
+	if f := tf.Files[1]; f.Offset != 8 || f.Length != 8 || strings.Join(f.Path, "/") != "dir/b" {
+		t.Errorf("Second file %+v", f)
+	}
+}
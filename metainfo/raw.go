@@ -0,0 +1,108 @@
+package metainfo
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// rawValue returns the exact bytes of the value stored under key in the
+// top level dictionary of data. Re-encoding a decoded struct drops every key
+// we don't model, so anything that needs to be hashed has to come from here.
+func rawValue(data []byte, key string) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, fmt.Errorf("%w: top level value is not a dictionary", ErrMalformed)
+	}
+
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		// Dictionary keys are always strings
+		keyEnd, err := skipValue(data, pos)
+		if err != nil {
+			return nil, err
+		}
+
+		k, err := parseString(data[pos:keyEnd])
+		if err != nil {
+			return nil, err
+		}
+
+		valueEnd, err := skipValue(data, keyEnd)
+		if err != nil {
+			return nil, err
+		}
+
+		if k == key {
+			return data[keyEnd:valueEnd], nil
+		}
+
+		pos = valueEnd
+	}
+
+	return nil, fmt.Errorf("%w: no %q key", ErrMalformed, key)
+}
+
+// skipValue returns the offset just past the bencoded value starting at pos
+func skipValue(data []byte, pos int) (int, error) {
+	if pos >= len(data) {
+		return 0, fmt.Errorf("%w: unexpected end of data", ErrMalformed)
+	}
+
+	switch c := data[pos]; {
+	case c == 'i':
+		end := indexByte(data, pos, 'e')
+		if end < 0 {
+			return 0, fmt.Errorf("%w: unterminated integer at %d", ErrMalformed, pos)
+		}
+
+		return end + 1, nil
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			next, err := skipValue(data, pos)
+			if err != nil {
+				return 0, err
+			}
+
+			pos = next
+		}
+
+		if pos >= len(data) {
+			return 0, fmt.Errorf("%w: unterminated list or dictionary", ErrMalformed)
+		}
+
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		colon := indexByte(data, pos, ':')
+		if colon < 0 {
+			return 0, fmt.Errorf("%w: string at %d has no length", ErrMalformed, pos)
+		}
+
+		length, err := strconv.Atoi(string(data[pos:colon]))
+		if err != nil || length < 0 || colon+1+length > len(data) {
+			return 0, fmt.Errorf("%w: string at %d has a bad length", ErrMalformed, pos)
+		}
+
+		return colon + 1 + length, nil
+	default:
+		return 0, fmt.Errorf("%w: unexpected byte %q at %d", ErrMalformed, c, pos)
+	}
+}
+
+func parseString(data []byte) (string, error) {
+	colon := indexByte(data, 0, ':')
+	if colon < 0 || data[0] < '0' || data[0] > '9' {
+		return "", fmt.Errorf("%w: expected a string", ErrMalformed)
+	}
+
+	return string(data[colon+1:]), nil
+}
+
+func indexByte(data []byte, from int, b byte) int {
+	for i := from; i < len(data); i++ {
+		if data[i] == b {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,328 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rc4"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// handshakeTimeout is how long the other side has to finish the MSE
+// handshake
+const handshakeTimeout = 10 * time.Second
+
+// plaintextStart is how a plaintext BitTorrent handshake starts, which is
+// how Accept tells it apart from an MSE one
+var plaintextStart = []byte("\x13BitTorrent protocol")
+
+// Initiate runs the MSE handshake on a connection we opened, for the
+// torrent infoHash. With Preferred the peer may pick plaintext, with
+// Required it has to encrypt. Disabled skips the handshake altogether.
+func Initiate(conn net.Conn, infoHash [20]byte, policy Policy) (*Conn, error) {
+	if policy == Disabled {
+		return &Conn{Conn: conn, r: conn}, nil
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(append(keys.public, padA...))
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+
+	theirs := make([]byte, keyLength)
+
+	_, err = io.ReadFull(r, theirs)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := keys.secret(theirs)
+	if err != nil {
+		return nil, err
+	}
+
+	skey := infoHash[:]
+	enc := newCipher("keyA", s, skey)
+	dec := newCipher("keyB", s, skey)
+
+	provide := cryptoRC4
+	if policy == Preferred {
+		provide |= cryptoPlaintext
+	}
+
+	// VC, crypto_provide, no padding and no initial payload. The
+	// BitTorrent handshake follows once this is done.
+	offer := make([]byte, 8+4+2+2)
+	copy(offer, vc)
+	binary.BigEndian.PutUint32(offer[8:], provide)
+	enc.XORKeyStream(offer, offer)
+
+	req := hash([]byte("req1"), s)
+	req = append(req, xor(hash([]byte("req2"), skey), hash([]byte("req3"), s))...)
+	req = append(req, offer...)
+
+	_, err = conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The peer's reply starts after up to maxPad bytes of padding, with
+	// VC encrypted the same way we expect it
+	wantVC := make([]byte, len(vc))
+	dec.XORKeyStream(wantVC, vc)
+
+	err = synchronize(r, wantVC, maxPad+len(vc))
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 4+2)
+
+	_, err = io.ReadFull(r, reply)
+	if err != nil {
+		return nil, err
+	}
+
+	dec.XORKeyStream(reply, reply)
+
+	selected := binary.BigEndian.Uint32(reply)
+	if selected&provide == 0 || selected != cryptoRC4 && selected != cryptoPlaintext {
+		return nil, fmt.Errorf("Peer picked encryption method %#x, which we didn't offer", selected)
+	}
+
+	err = skipPad(r, dec, int(binary.BigEndian.Uint16(reply[4:])))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{Conn: conn, r: r}
+	if selected == cryptoRC4 {
+		c.enc = enc
+		c.dec = dec
+	}
+
+	return c, nil
+}
+
+// Accept runs the MSE handshake on a connection a peer opened to us, or
+// lets a plaintext handshake through if policy allows it. infoHashes lists
+// the torrents the peer may be asking for, the handshake only gives us a
+// hash of the one it wants.
+func Accept(conn net.Conn, policy Policy, infoHashes func() [][20]byte) (*Conn, error) {
+	if policy == Disabled {
+		return &Conn{Conn: conn, r: conn}, nil
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+
+	start, err := r.Peek(len(plaintextStart))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(start, plaintextStart) {
+		if policy == Required {
+			return nil, fmt.Errorf("Peer didn't encrypt the connection")
+		}
+
+		return &Conn{Conn: conn, r: r}, nil
+	}
+
+	theirs := make([]byte, keyLength)
+
+	_, err = io.ReadFull(r, theirs)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := keys.secret(theirs)
+	if err != nil {
+		return nil, err
+	}
+
+	padB, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(append(keys.public, padB...))
+	if err != nil {
+		return nil, err
+	}
+
+	req1 := hash([]byte("req1"), s)
+
+	err = synchronize(r, req1, maxPad+len(req1))
+	if err != nil {
+		return nil, err
+	}
+
+	obfuscated := make([]byte, 20)
+
+	_, err = io.ReadFull(r, obfuscated)
+	if err != nil {
+		return nil, err
+	}
+
+	skey := findSKey(obfuscated, s, infoHashes())
+	if skey == nil {
+		return nil, fmt.Errorf("Peer asked for an unknown torrent")
+	}
+
+	enc := newCipher("keyB", s, skey)
+	dec := newCipher("keyA", s, skey)
+
+	offer := make([]byte, 8+4+2)
+
+	_, err = io.ReadFull(r, offer)
+	if err != nil {
+		return nil, err
+	}
+
+	dec.XORKeyStream(offer, offer)
+
+	if !bytes.Equal(offer[:8], vc) {
+		return nil, fmt.Errorf("Peer sent a bad verification constant")
+	}
+
+	provide := binary.BigEndian.Uint32(offer[8:])
+
+	err = skipPad(r, dec, int(binary.BigEndian.Uint16(offer[12:])))
+	if err != nil {
+		return nil, err
+	}
+
+	// The initial payload, normally the start of the BitTorrent handshake
+	iaLength := make([]byte, 2)
+
+	_, err = io.ReadFull(r, iaLength)
+	if err != nil {
+		return nil, err
+	}
+
+	dec.XORKeyStream(iaLength, iaLength)
+
+	ia := make([]byte, binary.BigEndian.Uint16(iaLength))
+
+	_, err = io.ReadFull(r, ia)
+	if err != nil {
+		return nil, err
+	}
+
+	dec.XORKeyStream(ia, ia)
+
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && policy != Required:
+		selected = cryptoPlaintext
+	default:
+		return nil, fmt.Errorf("Peer offered encryption methods %#x, none of which we accept", provide)
+	}
+
+	padD, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 8+4+2, 8+4+2+len(padD))
+	copy(reply, vc)
+	binary.BigEndian.PutUint32(reply[8:], selected)
+	binary.BigEndian.PutUint16(reply[12:], uint16(len(padD)))
+	reply = append(reply, padD...)
+	enc.XORKeyStream(reply, reply)
+
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{Conn: conn, r: r, pending: ia}
+	if selected == cryptoRC4 {
+		c.enc = enc
+		c.dec = dec
+	}
+
+	return c, nil
+}
+
+// synchronize reads up to and including pattern, which has to turn up
+// within the next limit bytes
+func synchronize(r *bufio.Reader, pattern []byte, limit int) error {
+	window := make([]byte, 0, limit)
+
+	for len(window) < limit {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		window = append(window, b)
+
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Could not find the start of the peer's encrypted stream")
+}
+
+// skipPad reads and throws away length bytes of encrypted padding. The
+// padding still has to go through dec to keep the stream in step.
+func skipPad(r io.Reader, dec *rc4.Cipher, length int) error {
+	if length > maxPad {
+		return fmt.Errorf("Peer sent %d bytes of padding, more than %d", length, maxPad)
+	}
+
+	pad := make([]byte, length)
+
+	_, err := io.ReadFull(r, pad)
+	if err != nil {
+		return err
+	}
+
+	dec.XORKeyStream(pad, pad)
+
+	return nil
+}
+
+// findSKey returns the info hash whose obfuscated form the peer sent
+func findSKey(obfuscated, s []byte, infoHashes [][20]byte) []byte {
+	req3 := hash([]byte("req3"), s)
+
+	for _, infoHash := range infoHashes {
+		skey := infoHash
+		if bytes.Equal(xor(hash([]byte("req2"), skey[:]), req3), obfuscated) {
+			return skey[:]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+// Package mse implements Message Stream Encryption, also called Protocol
+// Encryption: a Diffie-Hellman key exchange followed by an RC4 stream that
+// hides BitTorrent traffic from ISPs that throttle it. It runs before the
+// BitTorrent handshake, on the raw connection.
+package mse
+
+import (
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Policy decides whether connections get encrypted
+type Policy int
+
+const (
+	// Disabled only speaks plaintext, like peers from before MSE
+	Disabled Policy = iota
+	// Preferred encrypts whenever the peer can, and falls back to
+	// plaintext when it can't
+	Preferred
+	// Required refuses peers that won't encrypt
+	Required
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Disabled:
+		return "disabled"
+	case Preferred:
+		return "preferred"
+	case Required:
+		return "required"
+	default:
+		return fmt.Sprintf("Policy(%d)", int(p))
+	}
+}
+
+// ParsePolicy reads a policy written the way String writes it
+func ParsePolicy(s string) (Policy, error) {
+	for _, p := range []Policy{Disabled, Preferred, Required} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+
+	return Disabled, fmt.Errorf("Unknown encryption policy %q", s)
+}
+
+// The methods each side can offer in crypto_provide and pick in
+// crypto_select
+const (
+	cryptoPlaintext uint32 = 0x01
+	cryptoRC4       uint32 = 0x02
+)
+
+// maxPad is the most random padding either side sends at each step
+const maxPad = 512
+
+// keyLength is the size of the public keys and the shared secret
+const keyLength = 96
+
+// prime is the 768 bit safe prime MSE does its key exchange modulo, with
+// generator 2
+var prime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+
+var generator = big.NewInt(2)
+
+// vc is the verification constant. Each side finds where the other's
+// encrypted stream starts by looking for it.
+var vc = make([]byte, 8)
+
+// Conn is a connection after the MSE handshake. If RC4 was picked, reads
+// are decrypted and writes encrypted, otherwise they pass straight
+// through.
+type Conn struct {
+	net.Conn
+
+	// r reads what's left of the handshake's buffer before the
+	// connection itself
+	r io.Reader
+	// pending is payload that came with the handshake, the initial
+	// payload, already decrypted. Read returns it first.
+	pending []byte
+	dec     *rc4.Cipher
+
+	// Writes go out in order, so the RC4 stream on both sides stays in
+	// step
+	mu  sync.Mutex
+	enc *rc4.Cipher
+}
+
+// Encrypted is true if the connection is RC4 encrypted
+func (c *Conn) Encrypted() bool {
+	return c.enc != nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+
+		return n, nil
+	}
+
+	n, err := c.r.Read(b)
+
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Don't scribble over the caller's buffer
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+
+	return c.Conn.Write(buf)
+}
+
+// keyPair is one side's half of the key exchange
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+func newKeyPair() (*keyPair, error) {
+	// 160 bits is what the spec recommends for the private key
+	private := make([]byte, 20)
+
+	_, err := rand.Read(private)
+	if err != nil {
+		return nil, err
+	}
+
+	x := new(big.Int).SetBytes(private)
+	y := new(big.Int).Exp(generator, x, prime)
+
+	return &keyPair{private: x, public: padKey(y)}, nil
+}
+
+// secret works out the shared secret S from the other side's public key
+func (k *keyPair) secret(theirs []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(theirs)
+
+	// 0, 1 and P-1 would give away the secret
+	max := new(big.Int).Sub(prime, big.NewInt(1))
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(max) >= 0 {
+		return nil, fmt.Errorf("Peer sent a bad public key")
+	}
+
+	return padKey(new(big.Int).Exp(y, k.private, prime)), nil
+}
+
+// padKey writes n big endian, padded to keyLength bytes
+func padKey(n *big.Int) []byte {
+	b := n.Bytes()
+	padded := make([]byte, keyLength)
+	copy(padded[keyLength-len(b):], b)
+
+	return padded
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+
+	return h.Sum(nil)
+}
+
+// newCipher returns the RC4 stream for one direction. name is "keyA" for
+// what the side that connected sends, "keyB" for what it receives.
+func newCipher(name string, s, skey []byte) *rc4.Cipher {
+	// Keys are 20 bytes, which RC4 always accepts
+	c, _ := rc4.NewCipher(hash([]byte(name), s, skey))
+
+	// The start of an RC4 stream is weak, the spec throws it away
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+
+	return c
+}
+
+// randomPad returns up to maxPad random bytes
+func randomPad() ([]byte, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(maxPad+1))
+	if err != nil {
+		return nil, err
+	}
+
+	pad := make([]byte, n.Int64())
+
+	_, err = rand.Read(pad)
+	if err != nil {
+		return nil, err
+	}
+
+	return pad, nil
+}
+
+func xor(a, b []byte) []byte {
+	x := make([]byte, len(a))
+	for i := range a {
+		x[i] = a[i] ^ b[i]
+	}
+
+	return x
+}
@@ -0,0 +1,251 @@
+package mse
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"crypto/sha1"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+)
+
+// recorder keeps a copy of everything read from a connection
+type recorder struct {
+	net.Conn
+
+	mu   sync.Mutex
+	read []byte
+}
+
+func (r *recorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+
+	r.mu.Lock()
+	r.read = append(r.read, b[:n]...)
+	r.mu.Unlock()
+
+	return n, err
+}
+
+func (r *recorder) bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]byte(nil), r.read...)
+}
+
+type result struct {
+	conn *Conn
+	err  error
+}
+
+// connect runs Initiate with infoHash against Accept knowing known, over
+// loopback. wire records what the accepting side read.
+func connect(t *testing.T, initiator, acceptor Policy, infoHash, known [20]byte) (out, in result, wire *recorder) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	accepted := make(chan result)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			accepted <- result{err: err}
+			return
+		}
+
+		wire = &recorder{Conn: conn}
+		c, err := Accept(wire, acceptor, func() [][20]byte { return [][20]byte{known} })
+		if err != nil {
+			conn.Close()
+		}
+
+		accepted <- result{conn: c, err: err}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	c, err := Initiate(conn, infoHash, initiator)
+	if err != nil {
+		conn.Close()
+	}
+
+	out = result{conn: c, err: err}
+
+	// A plaintext initiator sends nothing until the BitTorrent handshake
+	if err == nil && initiator == Disabled {
+		c.Write(plaintextStart)
+	}
+
+	in = <-accepted
+	if in.conn != nil {
+		t.Cleanup(func() { in.conn.Close() })
+	}
+
+	return out, in, wire
+}
+
+func TestHandshake(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+
+	cases := []struct {
+		initiator, acceptor Policy
+		encrypted           bool
+	}{
+		{Preferred, Preferred, true},
+		{Preferred, Required, true},
+		{Required, Preferred, true},
+		{Required, Required, true},
+		{Disabled, Disabled, false},
+		{Disabled, Preferred, false},
+	}
+
+	for _, tc := range cases {
+		out, in, wire := connect(t, tc.initiator, tc.acceptor, infoHash, infoHash)
+		if out.err != nil || in.err != nil {
+			t.Errorf("%v to %v: %v, %v", tc.initiator, tc.acceptor, out.err, in.err)
+			continue
+		}
+
+		if out.conn.Encrypted() != tc.encrypted || in.conn.Encrypted() != tc.encrypted {
+			t.Errorf("%v to %v: Expected encrypted to be %v", tc.initiator, tc.acceptor, tc.encrypted)
+		}
+
+		if !tc.encrypted {
+			start := make([]byte, len(plaintextStart))
+
+			_, err := io.ReadFull(in.conn, start)
+			if err != nil || !bytes.Equal(start, plaintextStart) {
+				t.Errorf("%v to %v: Read %q, %v", tc.initiator, tc.acceptor, start, err)
+			}
+
+			continue
+		}
+
+		sent := []byte("the BitTorrent handshake goes here")
+		out.conn.Write(sent)
+
+		got := make([]byte, len(sent))
+
+		_, err := io.ReadFull(in.conn, got)
+		if err != nil || !bytes.Equal(got, sent) {
+			t.Errorf("%v to %v: Read %q, %v", tc.initiator, tc.acceptor, got, err)
+		}
+
+		if bytes.Contains(wire.bytes(), sent) {
+			t.Errorf("%v to %v: Sent in the clear", tc.initiator, tc.acceptor)
+		}
+
+		// And back the other way
+		in.conn.Write(sent)
+
+		_, err = io.ReadFull(out.conn, got)
+		if err != nil || !bytes.Equal(got, sent) {
+			t.Errorf("%v to %v: Read back %q, %v", tc.initiator, tc.acceptor, got, err)
+		}
+	}
+}
+
+func TestRequiredRefusesPlaintext(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+
+	_, in, _ := connect(t, Disabled, Required, infoHash, infoHash)
+	if in.err == nil {
+		t.Fatal("Accepted a plaintext connection when encryption is required")
+	}
+}
+
+func TestUnknownTorrent(t *testing.T) {
+	out, in, _ := connect(t, Preferred, Preferred, [20]byte{1}, [20]byte{2})
+
+	if in.err == nil {
+		t.Error("Accepted a connection for a torrent we don't have")
+	}
+
+	if out.err == nil {
+		t.Error("Initiate succeeded against a peer that hung up")
+	}
+}
+
+func TestCipherDiscard(t *testing.T) {
+	s := bytes.Repeat([]byte{0xab}, keyLength)
+	skey := []byte("01234567890123456789")
+
+	key := sha1.Sum(append(append([]byte("keyA"), s...), skey...))
+	raw, err := rc4.NewCipher(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([]byte, 1024+64)
+	raw.XORKeyStream(want, want)
+
+	got := make([]byte, 64)
+	newCipher("keyA", s, skey).XORKeyStream(got, got)
+
+	// The stream starts after the first 1024 bytes of keystream
+	if !bytes.Equal(got, want[1024:]) {
+		t.Errorf("Keystream %x, expected %x", got[:16], want[1024:1040])
+	}
+}
+
+func TestBadPublicKey(t *testing.T) {
+	keys, err := newKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	max := new(big.Int).Sub(prime, big.NewInt(1))
+
+	for _, y := range []*big.Int{big.NewInt(0), big.NewInt(1), max, prime} {
+		_, err := keys.secret(padKey(y))
+		if err == nil {
+			t.Errorf("Accepted public key %x", y)
+		}
+	}
+
+	// Both sides work out the same secret
+	theirs, err := newKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := keys.secret(theirs.public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := theirs.secret(keys.public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(a, b) {
+		t.Error("The two sides worked out different secrets")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range []Policy{Disabled, Preferred, Required} {
+		parsed, err := ParsePolicy(p.String())
+		if err != nil || parsed != p {
+			t.Errorf("Parsed %q as %v, %v", p, parsed, err)
+		}
+	}
+
+	_, err := ParsePolicy("sometimes")
+	if err == nil {
+		t.Error("Parsed an unknown policy")
+	}
+}
@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"log"
+
+	"github.com/copperwall/bittorrent-go/client"
+	"github.com/copperwall/bittorrent-go/peers"
+)
+
+// MaxBadPieces is how many pieces that fail their hash check a peer can
+// send us before it's disconnected and banned for the rest of the session
+const MaxBadPieces = 3
+
+// blame gives a strike to every peer that sent part of a bad piece. We
+// can't tell which block was bad, so everyone involved shares the blame.
+// Peers are tracked by IP so that reconnecting from another port doesn't
+// wipe the slate.
+func (t *Torrent) blame(contributors []*client.Client) {
+	t.mu.Lock()
+	if t.strikes == nil {
+		t.strikes = map[string]int{}
+		t.banned = map[string]bool{}
+	}
+
+	// One strike per piece, even for a peer with several connections
+	ips := map[string]bool{}
+	for _, c := range contributors {
+		ips[c.Peer().IP.String()] = true
+	}
+
+	toBan := map[string]bool{}
+	for ip := range ips {
+		t.strikes[ip]++
+		if t.strikes[ip] >= MaxBadPieces && !t.banned[ip] {
+			t.banned[ip] = true
+			toBan[ip] = true
+		}
+	}
+
+	// Disconnect every connection from a banned peer
+	bad := []*client.Client{}
+	banned := []peers.Peer{}
+	for c := range t.uploaders {
+		if toBan[c.Peer().IP.String()] {
+			bad = append(bad, c)
+		}
+	}
+
+	for _, c := range contributors {
+		ip := c.Peer().IP.String()
+		if toBan[ip] {
+			banned = append(banned, c.Peer())
+			delete(toBan, ip)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, peer := range banned {
+		log.Printf("Banning %s for sending %d bad pieces\n", peer.IP, MaxBadPieces)
+		t.emit(Event{Type: EventPeerBanned, Peer: peer})
+	}
+
+	for _, c := range bad {
+		c.Conn.Close()
+	}
+}
+
+func (t *Torrent) isBanned(peer peers.Peer) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.banned[peer.IP.String()]
+}
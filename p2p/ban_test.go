@@ -0,0 +1,167 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/client"
+	"github.com/copperwall/bittorrent-go/handshake"
+	"github.com/copperwall/bittorrent-go/message"
+	"github.com/copperwall/bittorrent-go/mse"
+	"github.com/copperwall/bittorrent-go/peers"
+	"github.com/copperwall/bittorrent-go/storage"
+)
+
+// dialTestPeer connects to a peer on the loopback address that has every
+// piece and throws away whatever we send it
+func dialTestPeer(t *testing.T, tor *Torrent) *client.Client {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		var id [20]byte
+		rand.Read(id[:])
+
+		c, err := client.Accept(conn, id, func(infoHash [20]byte) bool { return true })
+		if err != nil {
+			return
+		}
+
+		c.SendBitfield(fullBitfield(len(tor.PieceHashes)))
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+
+	c, err := client.New(context.Background(), peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}, tor.PeerID, tor.InfoHash, mse.Disabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { c.Conn.Close() })
+	c.Choked = false
+
+	return c
+}
+
+func TestBanCorruptPeer(t *testing.T) {
+	tor := testTorrent(2)
+	c := dialTestPeer(t, tor)
+	u := newUploader(tor, c)
+	tor.uploaders = map[*client.Client]*uploader{c: u}
+
+	// None of the pieces match their all zero hashes
+	garbage := bytes.Repeat([]byte{7}, MaxBlockSize)
+
+	for i := 0; i < MaxBadPieces; i++ {
+		if tor.isBanned(c.Peer()) {
+			t.Fatalf("Banned after %d bad pieces", i)
+		}
+
+		piece, ok := tor.pickPiece(c, u)
+		if !ok {
+			t.Fatalf("Nothing to pick after %d bad pieces", i)
+		}
+
+		msgs := make(chan readResult, 1)
+		msgs <- readResult{msg: message.FormatPiece(piece.index, 0, garbage)}
+
+		err := tor.downloadPiece(c, u, piece, msgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tor.hasPiece(piece.index) {
+			t.Fatalf("Kept bad piece %d", piece.index)
+		}
+	}
+
+	if !tor.isBanned(c.Peer()) {
+		t.Fatalf("Not banned after %d bad pieces", MaxBadPieces)
+	}
+
+	// Every bad piece was given back for someone else to try
+	if _, ok := tor.picker.pick(fullBitfield(2), nil); !ok {
+		t.Error("Bad pieces aren't wanted again")
+	}
+
+	// The ban disconnects the peer
+	c.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Read(); err == nil {
+		t.Error("Still connected to a banned peer")
+	}
+
+	// Nobody dials a banned peer again, whatever port it's on
+	other := peers.Peer{IP: c.Peer().IP, Port: c.Peer().Port + 1}
+
+	m := tor.peerManager()
+	m.add([]peers.Peer{c.Peer(), other})
+	m.connectReady()
+
+	m.mu.Lock()
+	known := len(m.known)
+	m.mu.Unlock()
+
+	if known != 0 {
+		t.Error("Kept a banned peer to dial")
+	}
+
+	// or lets it back in. The server only takes peers for a torrent that
+	// has storage to upload from.
+	tor.storage = storage.NewMemory(storage.Layout{PieceLength: tor.PieceLength, Length: tor.Length})
+
+	srv, err := Listen(0, tor.PeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Add(tor)
+	go srv.Serve()
+	defer srv.Close()
+
+	port := srv.listener.Addr().(*net.TCPAddr).Port
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	var id [20]byte
+	rand.Read(id[:])
+
+	conn.Write(handshake.New(tor.InfoHash, id).Serialize())
+
+	_, err = handshake.Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Anyone else would get our bitfield straight away
+	msg, err := message.Read(conn)
+	if err != io.EOF {
+		t.Errorf("Expected a banned peer to be hung up on, got %v, %v", msg, err)
+	}
+}
@@ -0,0 +1,174 @@
+package p2p
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultUploadSlots is how many peers we upload to at once, not counting
+// the optimistic unchoke
+const DefaultUploadSlots = 4
+
+// RechokeInterval is how often the choker re-ranks peers
+const RechokeInterval = 10 * time.Second
+
+// The optimistic unchoke moves to a new peer every third rechoke (30 seconds)
+const optimisticRounds = 3
+
+// SnubTimeout is how long a peer can go without sending us a block, while
+// we want something from it, before it loses its regular upload slot
+const SnubTimeout = time.Minute
+
+// choker implements tit-for-tat. Every RechokeInterval the interested peers
+// that upload to us the fastest get our upload slots. Once we're seeding
+// there's nothing to get back, so slots go to the peers we upload to the
+// fastest instead. One more peer is unchoked at random, the optimistic
+// unchoke, so that new peers get a chance to show what they can do.
+type choker struct {
+	torrent    *Torrent
+	round      int
+	optimistic *uploader
+	// wake makes the choker run early, e.g. when a peer becomes interested
+	wake chan struct{}
+}
+
+func newChoker(t *Torrent) *choker {
+	return &choker{
+		torrent: t,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// rechokeSoon asks for a rechoke without waiting for the next interval
+func (ch *choker) rechokeSoon() {
+	select {
+	case ch.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (ch *choker) run(ctx context.Context) {
+	ticker := time.NewTicker(RechokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ch.tick()
+		case <-ch.wake:
+			ch.rechoke(false)
+		}
+	}
+}
+
+// tick is a regular rechoke, every RechokeInterval
+func (ch *choker) tick() {
+	ch.updateRates(RechokeInterval)
+	ch.rechoke(ch.round%optimisticRounds == 0)
+	ch.round++
+}
+
+// updateRates turns each peer's byte counters into rates over the last interval
+func (ch *choker) updateRates(interval time.Duration) {
+	for _, u := range ch.torrent.connectedUploaders() {
+		downloaded := atomic.LoadInt64(&u.downloaded)
+		uploaded := atomic.LoadInt64(&u.uploaded)
+
+		u.mu.Lock()
+		u.downloadRate = float64(downloaded-u.lastDownloaded) / interval.Seconds()
+		u.uploadRate = float64(uploaded-u.lastUploaded) / interval.Seconds()
+		u.mu.Unlock()
+
+		u.lastDownloaded = downloaded
+		u.lastUploaded = uploaded
+	}
+}
+
+func (ch *choker) rechoke(rotateOptimistic bool) {
+	t := ch.torrent
+	seeding := t.Left() == 0
+	slots := t.UploadSlots
+	if slots <= 0 {
+		slots = DefaultUploadSlots
+	}
+
+	all := t.connectedUploaders()
+	candidates := []*uploader{}
+	optimisticStillHere := false
+
+	for _, u := range all {
+		if u == ch.optimistic {
+			optimisticStillHere = true
+		}
+
+		if !u.interested() {
+			continue
+		}
+
+		// A peer that stopped sending us blocks only gets the optimistic slot
+		if !seeding && u.snubbed() {
+			continue
+		}
+
+		candidates = append(candidates, u)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if seeding {
+			return candidates[i].uploadRate > candidates[j].uploadRate
+		}
+
+		return candidates[i].downloadRate > candidates[j].downloadRate
+	})
+
+	if len(candidates) > slots {
+		candidates = candidates[:slots]
+	}
+
+	unchoked := map[*uploader]bool{}
+	for _, u := range candidates {
+		unchoked[u] = true
+	}
+
+	if !optimisticStillHere || (ch.optimistic != nil && !ch.optimistic.interested()) {
+		ch.optimistic = nil
+	}
+
+	if rotateOptimistic || ch.optimistic == nil {
+		ch.optimistic = pickOptimistic(all, unchoked)
+	}
+
+	if ch.optimistic != nil {
+		unchoked[ch.optimistic] = true
+	}
+
+	for _, u := range all {
+		if unchoked[u] {
+			u.unchoke()
+		} else {
+			u.choke()
+		}
+	}
+}
+
+// pickOptimistic picks a random interested peer that didn't get a regular slot
+func pickOptimistic(all []*uploader, unchoked map[*uploader]bool) *uploader {
+	choices := []*uploader{}
+
+	for _, u := range all {
+		if !unchoked[u] && u.interested() {
+			choices = append(choices, u)
+		}
+	}
+
+	if len(choices) == 0 {
+		return nil
+	}
+
+	return choices[rand.Intn(len(choices))]
+}
@@ -0,0 +1,162 @@
+package p2p
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/client"
+)
+
+// testUploaders connects n interested peers that we're choking
+func testUploaders(t *testing.T, tor *Torrent, n int) []*uploader {
+	tor.uploaders = map[*client.Client]*uploader{}
+	us := []*uploader{}
+
+	for i := 0; i < n; i++ {
+		c := testPeer(t, fullBitfield(len(tor.PieceHashes)))
+		c.AmChoking = true
+		c.PeerInterested = true
+
+		u := newUploader(tor, c)
+		tor.uploaders[c] = u
+		us = append(us, u)
+	}
+
+	return us
+}
+
+func unchoked(us []*uploader) map[*uploader]bool {
+	m := map[*uploader]bool{}
+	for _, u := range us {
+		if !u.client.AmChoking {
+			m[u] = true
+		}
+	}
+
+	return m
+}
+
+func TestRechokeByDownloadRate(t *testing.T) {
+	tor := testTorrent(4)
+	tor.UploadSlots = 2
+	us := testUploaders(t, tor, 5)
+
+	for i, rate := range []float64{10, 50, 30, 40, 20} {
+		us[i].downloadRate = rate
+		// Uploading to them doesn't count while we're downloading
+		us[i].uploadRate = 100 - rate
+	}
+
+	ch := newChoker(tor)
+	ch.rechoke(false)
+
+	got := unchoked(us)
+	if !got[us[1]] || !got[us[3]] {
+		t.Error("Expected the two fastest uploaders to us to be unchoked")
+	}
+
+	// Plus one optimistic unchoke that didn't get a regular slot
+	if len(got) != 3 || ch.optimistic == nil || ch.optimistic == us[1] || ch.optimistic == us[3] {
+		t.Errorf("Unchoked %d peers with optimistic unchoke %p", len(got), ch.optimistic)
+	}
+}
+
+func TestRechokeSeeding(t *testing.T) {
+	tor := testTorrent(4)
+	tor.UploadSlots = 2
+	atomic.StoreInt64(&tor.completed, int64(tor.Length))
+	us := testUploaders(t, tor, 5)
+
+	for i, rate := range []float64{10, 50, 30, 40, 20} {
+		us[i].downloadRate = 100 - rate
+		us[i].uploadRate = rate
+	}
+
+	ch := newChoker(tor)
+	ch.rechoke(false)
+
+	got := unchoked(us)
+	if !got[us[1]] || !got[us[3]] || len(got) != 3 {
+		t.Error("Expected the two peers we upload to fastest and an optimistic unchoke")
+	}
+}
+
+func TestOptimisticRotation(t *testing.T) {
+	tor := testTorrent(4)
+	tor.UploadSlots = 1
+	testUploaders(t, tor, 4)
+
+	ch := newChoker(tor)
+	changes := 0
+
+	for round := 0; round < 20*optimisticRounds; round++ {
+		before := ch.optimistic
+		ch.tick()
+
+		if ch.optimistic == nil {
+			t.Fatalf("No optimistic unchoke in round %d", round)
+		}
+
+		if round > 0 && ch.optimistic != before {
+			if round%optimisticRounds != 0 {
+				t.Fatalf("Optimistic unchoke moved in round %d", round)
+			}
+
+			changes++
+		}
+
+		// A rechoke between rounds, e.g. for a newly interested peer,
+		// leaves it alone
+		before = ch.optimistic
+		ch.rechoke(false)
+
+		if ch.optimistic != before {
+			t.Fatalf("Optimistic unchoke moved outside of a rotation in round %d", round)
+		}
+	}
+
+	// Three peers to choose from each time, so it can't stay put for long
+	if changes == 0 {
+		t.Error("Optimistic unchoke never moved")
+	}
+}
+
+func TestRechokeSnubbed(t *testing.T) {
+	tor := testTorrent(4)
+	tor.UploadSlots = 1
+	us := testUploaders(t, tor, 3)
+
+	for i, rate := range []float64{100, 10, 5} {
+		us[i].downloadRate = rate
+	}
+
+	// The fastest peer hasn't sent us anything in a long time
+	us[0].setAmInterested(true)
+	atomic.StoreInt64(&us[0].lastBlock, time.Now().Add(-2*SnubTimeout).UnixNano())
+
+	ch := newChoker(tor)
+	ch.rechoke(false)
+
+	got := unchoked(us)
+	if !got[us[1]] {
+		t.Error("Expected the next fastest peer to get the regular slot")
+	}
+
+	// It can still be the optimistic unchoke
+	if got[us[0]] && ch.optimistic != us[0] {
+		t.Error("A snubbed peer got a regular slot")
+	}
+
+	// Snubbing doesn't matter once we're seeding
+	atomic.StoreInt64(&tor.completed, int64(tor.Length))
+	for i, rate := range []float64{100, 10, 5} {
+		us[i].uploadRate = rate
+	}
+
+	ch.rechoke(false)
+
+	if !unchoked(us)[us[0]] {
+		t.Error("Expected the snubbed peer to be unchoked while seeding")
+	}
+}
@@ -0,0 +1,207 @@
+package p2p
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/mse"
+	"github.com/copperwall/bittorrent-go/peers"
+	"github.com/copperwall/bittorrent-go/storage"
+)
+
+// testSwarm is a torrent of random data
+type testSwarm struct {
+	data     []byte
+	hashes   [][20]byte
+	infoHash [20]byte
+}
+
+func newTestSwarm(t *testing.T, pieces int) *testSwarm {
+	s := &testSwarm{data: make([]byte, pieces*2*MaxBlockSize-100)}
+	rand.Read(s.data)
+	rand.Read(s.infoHash[:])
+
+	for begin := 0; begin < len(s.data); begin += 2 * MaxBlockSize {
+		end := begin + 2*MaxBlockSize
+		if end > len(s.data) {
+			end = len(s.data)
+		}
+
+		s.hashes = append(s.hashes, sha1.Sum(s.data[begin:end]))
+	}
+
+	return s
+}
+
+// torrent returns a Torrent for the swarm with a random peer ID
+func (s *testSwarm) torrent() *Torrent {
+	t := &Torrent{
+		InfoHash:    s.infoHash,
+		PieceHashes: s.hashes,
+		PieceLength: 2 * MaxBlockSize,
+		Length:      len(s.data),
+		Name:        "test",
+	}
+	rand.Read(t.PeerID[:])
+
+	return t
+}
+
+func (s *testSwarm) layout() storage.Layout {
+	return storage.Layout{PieceLength: 2 * MaxBlockSize, Length: len(s.data)}
+}
+
+// seed serves every piece of the swarm on a loopback port until the test
+// ends
+func (s *testSwarm) seed(t *testing.T, configure func(*Server, *Torrent)) peers.Peer {
+	st := s.torrent()
+
+	srv, err := Listen(0, st.PeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if configure != nil {
+		configure(srv, st)
+	}
+
+	mem := storage.NewMemory(s.layout())
+	copy(mem.Bytes(), s.data)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	st.Resume(fullBitfield(len(s.hashes)))
+	go func() { done <- st.Download(ctx, mem) }()
+
+	// Download returns straight away with nothing to fetch, and the
+	// torrent keeps serving until ctx is cancelled
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Add(st)
+	go srv.Serve()
+
+	t.Cleanup(func() {
+		srv.Close()
+		cancel()
+	})
+
+	port := srv.listener.Addr().(*net.TCPAddr).Port
+
+	return peers.Peer{IP: net.IPv4(127, 0, 0, 1), Port: uint16(port)}
+}
+
+// failingStorage is memory storage that can't be written to
+type failingStorage struct {
+	*storage.Memory
+}
+
+var errWriteFailed = errors.New("disk full")
+
+func (f failingStorage) WriteBlock(index, begin int, block []byte) error {
+	return errWriteFailed
+}
+
+func TestDownload(t *testing.T) {
+	swarm := newTestSwarm(t, 12)
+	dl := swarm.torrent()
+	dl.Peers = []peers.Peer{swarm.seed(t, nil), swarm.seed(t, nil)}
+
+	mem := storage.NewMemory(swarm.layout())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	err := dl.Download(ctx, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(mem.Bytes()) != string(swarm.data) {
+		t.Fatal("Downloaded data doesn't match")
+	}
+
+	if dl.Left() != 0 {
+		t.Errorf("Expected nothing left, got %d bytes", dl.Left())
+	}
+}
+
+func TestClose(t *testing.T) {
+	swarm := newTestSwarm(t, 4)
+	dl := swarm.torrent()
+	dl.Peers = []peers.Peer{swarm.seed(t, nil)}
+
+	err := dl.Download(context.Background(), storage.NewMemory(swarm.layout()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Download leaves the seed connected so we can upload to it
+	if len(dl.connectedUploaders()) == 0 {
+		t.Fatal("Expected the seed to still be connected")
+	}
+
+	dl.Close()
+
+	if n := len(dl.connectedUploaders()); n != 0 {
+		t.Errorf("%d peers still connected after Close", n)
+	}
+}
+
+func TestDownloadEncrypted(t *testing.T) {
+	swarm := newTestSwarm(t, 4)
+	required := func(srv *Server, st *Torrent) {
+		srv.Encryption = mse.Required
+		st.Encryption = mse.Required
+	}
+
+	dl := swarm.torrent()
+	dl.Encryption = mse.Required
+	dl.Peers = []peers.Peer{swarm.seed(t, required)}
+
+	mem := storage.NewMemory(swarm.layout())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	err := dl.Download(ctx, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(mem.Bytes()) != string(swarm.data) {
+		t.Fatal("Downloaded data doesn't match")
+	}
+}
+
+func TestDownloadWriteFails(t *testing.T) {
+	swarm := newTestSwarm(t, 4)
+	dl := swarm.torrent()
+	dl.Peers = []peers.Peer{swarm.seed(t, nil)}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- dl.Download(context.Background(), failingStorage{storage.NewMemory(swarm.layout())})
+	}()
+
+	select {
+	case err := <-done:
+		if err != errWriteFailed {
+			t.Fatalf("Expected the write error, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Download didn't give up after a failed write")
+	}
+
+	// Every peer Download started has been waited for by now
+	if n := len(dl.connectedUploaders()); n != 0 {
+		t.Errorf("%d peers still connected after a failed write", n)
+	}
+}
@@ -0,0 +1,182 @@
+package p2p
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/peers"
+)
+
+// EventType says what happened in an Event
+type EventType int
+
+const (
+	// EventPieceDone is sent when a piece has been written to storage
+	EventPieceDone EventType = iota
+	// EventPieceFailed is sent when a piece fails its hash check
+	EventPieceFailed
+	// EventPeerConnected is sent when a peer has finished its handshake,
+	// whether we dialed it or it dialed us
+	EventPeerConnected
+	// EventPeerDisconnected is sent when a connected peer goes away
+	EventPeerDisconnected
+	// EventPeerBanned is sent when a peer has sent too many bad pieces
+	EventPeerBanned
+	// EventComplete is sent once every piece has been downloaded
+	EventComplete
+	// EventStopped is sent when Download's context is cancelled before
+	// the download is complete
+	EventStopped
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventPieceDone:
+		return "piece done"
+	case EventPieceFailed:
+		return "piece failed"
+	case EventPeerConnected:
+		return "peer connected"
+	case EventPeerDisconnected:
+		return "peer disconnected"
+	case EventPeerBanned:
+		return "peer banned"
+	case EventComplete:
+		return "complete"
+	case EventStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is something that happened to a torrent. Piece is set for piece
+// events and Peer for peer events.
+type Event struct {
+	Type  EventType
+	Piece int
+	Peer  peers.Peer
+}
+
+// EventBuffer is how many events a subscriber can fall behind by before
+// events are dropped
+const EventBuffer = 64
+
+// Stats is a snapshot of a torrent's progress. Rates are in bytes per
+// second, averaged over the last RechokeInterval.
+type Stats struct {
+	PiecesDone   int
+	PiecesTotal  int
+	Downloaded   int64
+	Uploaded     int64
+	Left         int64
+	DownloadRate float64
+	UploadRate   float64
+	// ETA is how long the rest of the download will take at the current
+	// rate. It's zero when we're done or not downloading anything.
+	ETA   time.Duration
+	Peers []PeerStats
+}
+
+// PeerStats is the state of a single connected peer
+type PeerStats struct {
+	Peer           peers.Peer
+	ID             [20]byte
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+	// Pieces is how many pieces the peer has
+	Pieces       int
+	Downloaded   int64
+	Uploaded     int64
+	DownloadRate float64
+	UploadRate   float64
+}
+
+// Subscribe returns a channel that receives the torrent's events. If the
+// channel's buffer fills up, events are dropped rather than holding up the
+// download, so read it promptly. Call cancel to stop receiving events; the
+// channel is closed.
+func (t *Torrent) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, EventBuffer)
+
+	t.mu.Lock()
+	if t.subscribers == nil {
+		t.subscribers = map[chan Event]bool{}
+	}
+	t.subscribers[ch] = true
+	t.mu.Unlock()
+
+	cancel := func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if t.subscribers[ch] {
+			delete(t.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return ch, cancel
+}
+
+func (t *Torrent) emit(e Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for ch := range t.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Stats returns the torrent's progress right now
+func (t *Torrent) Stats() Stats {
+	t.mu.Lock()
+	piecesDone := t.countPieces(t.have)
+	t.mu.Unlock()
+
+	stats := Stats{
+		PiecesDone:  piecesDone,
+		PiecesTotal: len(t.PieceHashes),
+		Downloaded:  t.Downloaded(),
+		Uploaded:    t.Uploaded(),
+		Left:        t.Left(),
+	}
+
+	for _, u := range t.connectedUploaders() {
+		ps := u.stats()
+
+		stats.Peers = append(stats.Peers, ps)
+		stats.DownloadRate += ps.DownloadRate
+		stats.UploadRate += ps.UploadRate
+	}
+
+	if stats.Left > 0 && stats.DownloadRate > 0 {
+		stats.ETA = time.Duration(float64(stats.Left) / stats.DownloadRate * float64(time.Second))
+	}
+
+	return stats
+}
+
+func (u *uploader) stats() PeerStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return PeerStats{
+		Peer:           u.client.Peer(),
+		ID:             u.client.RemoteID,
+		AmChoking:      u.client.AmChoking,
+		AmInterested:   atomic.LoadInt32(&u.amInterested) == 1,
+		PeerChoking:    atomic.LoadInt32(&u.peerChoking) == 1,
+		PeerInterested: u.client.PeerInterested,
+		Pieces:         u.pieces(),
+		Downloaded:     atomic.LoadInt64(&u.downloaded),
+		Uploaded:       atomic.LoadInt64(&u.uploaded),
+		DownloadRate:   u.downloadRate,
+		UploadRate:     u.uploadRate,
+	}
+}
@@ -0,0 +1,117 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	tor := testTorrent(4)
+
+	first, cancelFirst := tor.Subscribe()
+	second, cancelSecond := tor.Subscribe()
+	defer cancelSecond()
+
+	tor.emit(Event{Type: EventPieceDone, Piece: 2})
+
+	for i, ch := range []<-chan Event{first, second} {
+		select {
+		case e := <-ch:
+			if e.Type != EventPieceDone || e.Piece != 2 {
+				t.Errorf("Subscriber %d got %v for piece %d", i, e.Type, e.Piece)
+			}
+		default:
+			t.Errorf("Subscriber %d got nothing", i)
+		}
+	}
+
+	cancelFirst()
+	// Cancelling twice is harmless
+	cancelFirst()
+
+	tor.emit(Event{Type: EventComplete})
+
+	if e, ok := <-first; ok {
+		t.Errorf("Got %v after unsubscribing", e.Type)
+	}
+
+	select {
+	case e := <-second:
+		if e.Type != EventComplete {
+			t.Errorf("Got %v, expected %v", e.Type, EventComplete)
+		}
+	default:
+		t.Error("Remaining subscriber got nothing")
+	}
+}
+
+func TestSubscribeDropsEvents(t *testing.T) {
+	tor := testTorrent(4)
+
+	events, cancel := tor.Subscribe()
+	defer cancel()
+
+	// Nobody is reading, so this would block if events weren't dropped
+	for i := 0; i < EventBuffer+10; i++ {
+		tor.emit(Event{Type: EventPieceDone, Piece: i})
+	}
+
+	if len(events) != EventBuffer {
+		t.Fatalf("Expected %d buffered events, got %d", EventBuffer, len(events))
+	}
+
+	// The oldest events are the ones kept
+	if e := <-events; e.Piece != 0 {
+		t.Errorf("First event is for piece %d", e.Piece)
+	}
+}
+
+func TestStats(t *testing.T) {
+	tor := testTorrent(4)
+	tor.Resume(bitfieldOf(4, 0, 3))
+	tor.downloaded = 5 * MaxBlockSize
+	tor.uploaded = MaxBlockSize
+
+	us := testUploaders(t, tor, 2)
+	us[0].downloadRate = 1000
+	us[0].uploadRate = 10
+	us[1].downloadRate = 3000
+	us[1].uploadRate = 30
+	us[1].client.AmChoking = false
+	us[1].setPeerPieces(4)
+
+	stats := tor.Stats()
+
+	if stats.PiecesDone != 2 || stats.PiecesTotal != 4 {
+		t.Errorf("%d of %d pieces done, expected 2 of 4", stats.PiecesDone, stats.PiecesTotal)
+	}
+
+	if stats.Left != 2*MaxBlockSize || stats.Downloaded != 5*MaxBlockSize || stats.Uploaded != MaxBlockSize {
+		t.Errorf("Left %d, downloaded %d, uploaded %d", stats.Left, stats.Downloaded, stats.Uploaded)
+	}
+
+	if stats.DownloadRate != 4000 || stats.UploadRate != 40 {
+		t.Errorf("Download rate %v, upload rate %v", stats.DownloadRate, stats.UploadRate)
+	}
+
+	if want := time.Duration(2 * MaxBlockSize / 4000.0 * float64(time.Second)); stats.ETA != want {
+		t.Errorf("ETA %v, expected %v", stats.ETA, want)
+	}
+
+	if len(stats.Peers) != 2 {
+		t.Fatalf("Expected 2 peers, got %d", len(stats.Peers))
+	}
+
+	for _, ps := range stats.Peers {
+		fast := ps.DownloadRate == 3000
+		if ps.AmChoking == fast || (ps.Pieces == 4) != fast || !ps.PeerInterested {
+			t.Errorf("Peer stats %+v", ps)
+		}
+	}
+
+	// Nothing left means no ETA, however fast we're going
+	tor.Resume(fullBitfield(4))
+	if stats := tor.Stats(); stats.Left != 0 || stats.ETA != 0 {
+		t.Errorf("Left %d, ETA %v after finishing", stats.Left, stats.ETA)
+	}
+}
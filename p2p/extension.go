@@ -0,0 +1,118 @@
+package p2p
+
+import (
+	"fmt"
+
+	"github.com/copperwall/bittorrent-go/client"
+	"github.com/copperwall/bittorrent-go/message"
+)
+
+// clientVersion is how we introduce ourselves in extension handshakes
+const clientVersion = "bittorrent-go"
+
+// Extension handles an extension protocol (BEP 10) extension, like ut_pex,
+// for a torrent
+type Extension interface {
+	// Handshake is called when a peer's extension handshake arrives. id
+	// is the ID the peer wants the extension's messages sent to it with,
+	// 0 if it doesn't speak the extension.
+	Handshake(c *client.Client, id uint8, hs *message.ExtendedHandshake)
+	// Handle deals with one of the extension's messages from c. Returning
+	// an error disconnects the peer.
+	Handle(c *client.Client, payload []byte) error
+	// Disconnected is called when c goes away
+	Disconnected(c *client.Client)
+}
+
+// AddExtension lets the torrent speak the extension called name, with ext
+// handling its messages. Call it before Download.
+func (t *Torrent) AddExtension(name string, ext Extension) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.initExtensions()
+	t.extensions.Register(name)
+	t.handlers[name] = ext
+}
+
+// initExtensions registers the extensions every torrent speaks. t.mu must
+// be held.
+func (t *Torrent) initExtensions() {
+	if t.handlers != nil {
+		return
+	}
+
+	t.handlers = map[string]Extension{}
+
+	t.extensions.Register(pexName)
+	t.handlers[pexName] = newPex(t)
+}
+
+// extensionHandlers returns every extension by name
+func (t *Torrent) extensionHandlers() map[string]Extension {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.initExtensions()
+
+	handlers := make(map[string]Extension, len(t.handlers))
+	for name, ext := range t.handlers {
+		handlers[name] = ext
+	}
+
+	return handlers
+}
+
+// sendExtHandshake tells c which extensions we speak
+func (t *Torrent) sendExtHandshake(c *client.Client) {
+	t.mu.Lock()
+	t.initExtensions()
+	hs := t.extensions.Handshake()
+	hs.P = t.listenPort
+	t.mu.Unlock()
+
+	hs.V = clientVersion
+	hs.YourIP = c.Peer().IP
+
+	c.SendExtendedHandshake(hs)
+}
+
+// handleExtended hands an extension protocol message to the extension it's
+// for. The handshake goes to every extension.
+func (t *Torrent) handleExtended(c *client.Client, msg *message.Message) error {
+	extendedID, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+
+	if extendedID == 0 {
+		hs, err := message.ParseExtendedHandshake(payload)
+		if err != nil {
+			return fmt.Errorf("Bad extension handshake: %v", err)
+		}
+
+		for name, ext := range t.extensionHandlers() {
+			ext.Handshake(c, hs.M[name], hs)
+		}
+
+		return nil
+	}
+
+	t.mu.Lock()
+	ext := t.handlers[t.extensions.Name(extendedID)]
+	t.mu.Unlock()
+
+	// An extension we never offered, most likely sent by mistake
+	if ext == nil {
+		return nil
+	}
+
+	return ext.Handle(c, payload)
+}
+
+// extensionsDisconnected lets every extension forget c
+func (t *Torrent) extensionsDisconnected(c *client.Client) {
+	for _, ext := range t.extensionHandlers() {
+		ext.Disconnected(c)
+	}
+}
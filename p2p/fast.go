@@ -0,0 +1,68 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+
+	"github.com/copperwall/bittorrent-go/bitfield"
+)
+
+// allowedFastCount is how many pieces each fast peer may download from us
+// while we're choking it
+const allowedFastCount = 10
+
+// maxSuggestions is how many of a peer's Suggest hints we remember
+const maxSuggestions = 32
+
+// allowedFastSet works out which pieces a peer at ip may download while
+// choked, using the algorithm from BEP 6. Every client that follows it
+// gives a peer the same set, so it can't get more by reconnecting. The set
+// depends on the peer's /24, so peers behind the same NAT share one. BEP 6
+// doesn't cover IPv6 peers, they get no allowed fast pieces.
+func allowedFastSet(ip net.IP, infoHash [20]byte, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+
+	if k > numPieces {
+		k = numPieces
+	}
+
+	x := make([]byte, 0, 4+len(infoHash))
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+
+	set := []int{}
+	seen := map[int]bool{}
+
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+
+	return set
+}
+
+// onlyPieces returns a copy of bf with every piece not in indexes cleared
+func onlyPieces(bf bitfield.Bitfield, indexes map[int]bool) bitfield.Bitfield {
+	only := make(bitfield.Bitfield, len(bf))
+
+	for index := range indexes {
+		if bf.HasPiece(index) {
+			only.SetPiece(index)
+		}
+	}
+
+	return only
+}
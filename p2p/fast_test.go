@@ -0,0 +1,53 @@
+package p2p
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	var infoHash [20]byte
+	copy(infoHash[:], bytes.Repeat([]byte{0xaa}, 20))
+
+	// The reference vectors from BEP 6
+	cases := []struct {
+		k    int
+		want []int
+	}{
+		{7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{9, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+	}
+
+	for _, tc := range cases {
+		got := allowedFastSet(net.IPv4(80, 4, 4, 200), infoHash, 1313, tc.k)
+
+		if len(got) != len(tc.want) {
+			t.Fatalf("k=%d: Got %v, expected %v", tc.k, got, tc.want)
+		}
+
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Fatalf("k=%d: Got %v, expected %v", tc.k, got, tc.want)
+			}
+		}
+	}
+
+	// The whole /24 shares a set
+	a := allowedFastSet(net.IPv4(80, 4, 4, 1), infoHash, 1313, 7)
+	b := allowedFastSet(net.IPv4(80, 4, 4, 200), infoHash, 1313, 7)
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatal("Peers in the same /24 got different sets")
+		}
+	}
+
+	if set := allowedFastSet(net.ParseIP("2001:db8::1"), infoHash, 1313, 7); len(set) != 0 {
+		t.Errorf("Gave an IPv6 peer %v", set)
+	}
+
+	// Never more pieces than the torrent has
+	if set := allowedFastSet(net.IPv4(80, 4, 4, 200), infoHash, 3, 10); len(set) != 3 {
+		t.Errorf("Got %v for a torrent of 3 pieces", set)
+	}
+}
@@ -2,25 +2,42 @@ package p2p
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"fmt"
-	"io"
 	"log"
-	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/copperwall/bittorrent-go/bitfield"
 	"github.com/copperwall/bittorrent-go/client"
 	"github.com/copperwall/bittorrent-go/message"
+	"github.com/copperwall/bittorrent-go/mse"
 	"github.com/copperwall/bittorrent-go/peers"
+	"github.com/copperwall/bittorrent-go/storage"
 )
 
 const MaxBlockSize = 16384
 // MaxBacklog is the number of pending requests a client can have
 const MaxBacklog = 10
 
+// pieceTimeout is how long a peer has to send us a whole piece
+const pieceTimeout = 30 * time.Second
+
+// Peers send a keep-alive every two minutes, so anything quieter than
+// this is gone
+const idleTimeout = 3 * time.Minute
+
 // Torrent holds necessary information like PeerID, a list of Peers, the InfoHash,
 // PieceHashes and name
 type Torrent struct {
+	// Byte counters reported to the tracker. These are first so they're
+	// 64-bit aligned for sync/atomic.
+	downloaded		int64
+	uploaded		int64
+	completed		int64
+
 	Peers			[]peers.Peer
 	PeerID			[20]byte
 	InfoHash		[20]byte
@@ -28,6 +45,49 @@ type Torrent struct {
 	PieceLength		int
 	Length			int
 	Name			string
+	// UploadSlots is how many peers we upload to at once, besides the
+	// optimistic unchoke. Zero means DefaultUploadSlots.
+	UploadSlots		int
+	// ResumePath is where Download saves which pieces it has, for LoadResume
+	// to pick up after a restart. Empty means progress isn't saved.
+	ResumePath		string
+	// MaxPeers is how many peers we're connected to at once. Zero means
+	// DefaultMaxPeers.
+	MaxPeers		int
+	// Encryption decides whether connections to peers are MSE
+	// encrypted. The zero value only speaks plaintext.
+	Encryption		mse.Policy
+
+	mu				sync.Mutex
+	// ctx is Download's context. Everything the torrent starts stops
+	// when it's cancelled.
+	ctx				context.Context
+	// cancel cancels ctx, for when Download fails on its own
+	cancel			context.CancelFunc
+	// stopping is set once ctx is cancelled, after which no new peer
+	// goroutines start. peerGroup lets Download wait for the rest to exit.
+	stopping		bool
+	peerGroup		sync.WaitGroup
+	picker			*picker
+	results			chan *pieceResult
+	manager			*peerManager
+	// Peers that sent us bad pieces, by IP
+	strikes			map[string]int
+	banned			map[string]bool
+	done			bool
+	storage			storage.Storage
+	// have is the pieces we've downloaded and can upload to others
+	have			bitfield.Bitfield
+	uploaders		map[*client.Client]*uploader
+	subscribers		map[chan Event]bool
+	choker			*choker
+	// extensions gives each extension protocol extension we speak its
+	// ID, and handlers handles their messages, by name
+	extensions		message.Registry
+	handlers		map[string]Extension
+	// listenPort is where the Server accepts connections for us, which
+	// peers learn through our extension handshake
+	listenPort		uint16
 }
 
 type pieceWork struct {
@@ -42,90 +102,476 @@ type pieceResult struct {
 }
 
 type pieceProgress struct {
-	index 		int
+	piece 		*activePiece
+	torrent		*Torrent
 	client 		*client.Client
-	buf 		[]byte
-	downloaded 	int
-	requested 	int
-	backlog 	int
+	uploads		*uploader
 }
 
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read()
+// readResult is a message, or the error that ended the connection, passed
+// from a peer's read loop to the goroutine driving the peer
+type readResult struct {
+	msg *message.Message
+	err error
+}
+
+// handleMessage returns true once the message completed the piece
+func (state *pieceProgress) handleMessage(msg *message.Message) (bool, error) {
+	if msg != nil && msg.ID == message.MsgChoke && !state.client.SupportsFast() {
+		// The peer throws away our requests when it chokes us. Fast peers
+		// reject each one instead.
+		state.piece.forget(state.client)
+	}
+
+	if msg != nil && msg.ID == message.MsgReject && state.client.SupportsFast() {
+		index, _, _, err := message.ParseReject(msg)
+		if err != nil {
+			return false, err
+		}
+
+		// The peer won't give us this piece for now, leave it to others
+		if index == state.piece.index {
+			state.uploads.refused[index] = true
+			return false, nil
+		}
+	}
+
+	if msg == nil || msg.ID != message.MsgPiece {
+		return false, state.torrent.handleMessage(state.client, state.uploads, msg)
+	}
+
+	index, begin, block, err := message.ParseBlock(msg)
+	if err != nil {
+		return false, err
+	}
 
+	// A block from a piece we gave up on
+	if index != state.piece.index {
+		return false, nil
+	}
+
+	atomic.AddInt64(&state.torrent.downloaded, int64(len(block)))
+	state.uploads.recordDownload(len(block))
+
+	others, complete, err := state.piece.receive(state.client, begin, block)
 	if err != nil {
-		return err
+		return false, err
 	}
 
+	// In endgame mode other peers might be about to send the same block
+	for _, other := range others {
+		other.SendCancel(index, begin, len(block))
+	}
+
+	return complete, nil
+}
+
+// handleMessage deals with everything a peer sends us besides the blocks
+// of the piece we're downloading from it
+func (t *Torrent) handleMessage(c *client.Client, u *uploader, msg *message.Message) error {
 	// keep-alive
 	if msg == nil {
 		return nil
 	}
 
+	switch msg.ID {
+	case message.MsgHaveAll, message.MsgHaveNone, message.MsgSuggest, message.MsgReject, message.MsgAllowedFast:
+		if !c.SupportsFast() {
+			return fmt.Errorf("Peer sent %s without the fast extension", msg)
+		}
+	}
+
 	switch msg.ID {
 	case message.MsgUnchoke:
-		state.client.Choked = false
+		c.Choked = false
+		u.setPeerChoking(false)
+		// Pieces the peer rejected get another chance
+		u.refused = map[int]bool{}
 	case message.MsgChoke:
-		state.client.Choked = true
+		c.Choked = true
+		u.setPeerChoking(true)
 	case message.MsgHave:
 		index, err := message.ParseHave(msg)
 		if err != nil {
 			return err
 		}
-		state.client.Bitfield.SetPiece(index)
-	case message.MsgPiece:
-		n, err := message.ParsePiece(state.index, state.buf, msg)
+		t.peerHas(c, u, index)
+	case message.MsgBitfield:
+		t.setPeerBitfield(c, u, t.sizeBitfield(msg.Payload))
+	case message.MsgHaveAll:
+		bf := t.sizeBitfield(nil)
+		for index := range t.PieceHashes {
+			bf.SetPiece(index)
+		}
+		t.setPeerBitfield(c, u, bf)
+	case message.MsgHaveNone:
+		t.setPeerBitfield(c, u, t.sizeBitfield(nil))
+	case message.MsgSuggest:
+		index, err := message.ParseSuggest(msg)
 		if err != nil {
 			return err
 		}
-
-		state.downloaded += n
-		state.backlog--
+		u.suggest(index)
+	case message.MsgAllowedFast:
+		index, err := message.ParseAllowedFast(msg)
+		if err != nil {
+			return err
+		}
+		u.peerAllows(index)
+	case message.MsgReject:
+		// A reject for a piece we gave up on, nothing to do with it
+	case message.MsgPiece:
+		// A block of a piece we gave up on, nothing to do with it
+	case message.MsgExtended:
+		return t.handleExtended(c, msg)
+	default:
+		return u.handleMessage(msg)
 	}
 
 	return nil
 }
 
-func (t *Torrent) Download(w io.WriterAt) error {
-	fmt.Println("Starting download for", t.Name)
+// setPeerBitfield replaces the pieces a peer has
+func (t *Torrent) setPeerBitfield(c *client.Client, u *uploader, bf bitfield.Bitfield) {
+	t.picker.removePeer(c.Bitfield)
+	c.Bitfield = bf
+	t.picker.addPeer(c.Bitfield)
+	u.setPeerPieces(t.countPieces(c.Bitfield))
+}
 
-	// Start the work queue
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
-	results := make(chan *pieceResult)
+// peerHas records that a peer got a new piece
+func (t *Torrent) peerHas(c *client.Client, u *uploader, index int) {
+	if index < 0 || index >= len(t.PieceHashes) || c.Bitfield.HasPiece(index) {
+		return
+	}
+
+	c.Bitfield.SetPiece(index)
+	t.picker.peerHas(index)
+	u.setPeerPieces(t.countPieces(c.Bitfield))
+}
 
-	// Place work pieces in the work queue
-	for index, hash := range t.PieceHashes {
-		length := t.calculatePieceSize(index)
-		workQueue <- &pieceWork{index, hash, length}
+// sizeBitfield copies a peer's bitfield into one that's exactly big enough
+// for this torrent, so setting a piece never falls off the end
+func (t *Torrent) sizeBitfield(bf bitfield.Bitfield) bitfield.Bitfield {
+	sized := make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	copy(sized, bf)
+
+	// Ignore spare bits past the last piece
+	for i := len(t.PieceHashes); i < len(sized)*8; i++ {
+		sized[i/8] &^= 1 << (7 - uint(i%8))
 	}
 
-	// Kick off the workers
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, results)
+	return sized
+}
+
+// Download fetches every piece Resume didn't find and writes it to s. Peers
+// can download from us through s for as long as we're connected to them,
+// which is until ctx is cancelled. If that happens before the download is
+// complete, Download disconnects every peer, saves its progress to
+// ResumePath and returns ctx.Err(). The same goes if writing to s fails,
+// then the write's error is returned.
+func (t *Torrent) Download(ctx context.Context, s storage.Storage) error {
+	fmt.Println("Starting download for", t.Name)
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	t.mu.Lock()
+	t.ctx = ctx
+	t.cancel = cancel
+	t.storage = s
+	if t.have == nil {
+		t.have = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
 	}
+	t.picker = newPicker(len(t.PieceHashes), t.calculatePieceSize)
+	t.results = make(chan *pieceResult)
+	results := t.results
+	known := t.Peers
 
 	// make a buffer the length of the entire torrent output
 	// buf := make([]byte, t.Length)
 	donePieces := 0
 
+	// Only download what Resume didn't find already
+	for index := range t.PieceHashes {
+		if t.have.HasPiece(index) {
+			t.picker.finish(index)
+			donePieces++
+		}
+	}
+	t.mu.Unlock()
+
+	if donePieces > 0 {
+		log.Printf("Resuming with %d of %d pieces\n", donePieces, len(t.PieceHashes))
+	}
+
+	// Kick off the workers, unless there's nothing left to get
+	if donePieces < len(t.PieceHashes) {
+		m := t.peerManager()
+		m.add(known)
+		go m.run(ctx)
+	}
+
+	lastSave := time.Now()
+
 	for donePieces < len(t.PieceHashes) {
-		res := <- results
-		begin, _ := t.calculateBoundsForPiece(res.index)
-		w.WriteAt(res.buf, int64(begin))
-		// copy(buf[begin : end], res.buf)
+		var res *pieceResult
+
+		select {
+		case res = <- results:
+		case <-ctx.Done():
+			t.stop()
+			return ctx.Err()
+		}
+
+		err := s.WriteBlock(res.index, 0, res.buf)
+
+		if err != nil {
+			return t.fail(err)
+		}
+
+		err = s.MarkComplete(res.index)
+
+		if err != nil {
+			return t.fail(err)
+		}
+
+		// Only tell peers about the piece once it can be read back
+		t.mu.Lock()
+		t.have.SetPiece(res.index)
+		t.mu.Unlock()
+		t.broadcastHave(res.index)
 
 		donePieces++
+		atomic.AddInt64(&t.completed, int64(len(res.buf)))
+
+		t.emit(Event{Type: EventPieceDone, Piece: res.index})
 
-		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		numWorkers := runtime.NumGoroutine() - 1
-		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
+		if t.ResumePath != "" && time.Since(lastSave) >= ResumeInterval {
+			t.saveResume()
+			lastSave = time.Now()
+		}
 	}
 
-	close(workQueue)
+	t.mu.Lock()
+	t.done = true
+	t.mu.Unlock()
+
+	t.emit(Event{Type: EventComplete})
 
 	return nil
 }
 
+// AddPeers tells the torrent about more peers to download from. Peers we
+// already know are skipped. It's safe to call while Download is running,
+// for example with peers from a tracker re-announce.
+func (t *Torrent) AddPeers(ps []peers.Peer) {
+	t.mu.Lock()
+
+	// Not downloading yet, Download will pick these up
+	if t.picker == nil {
+		t.Peers = append(t.Peers, ps...)
+		t.mu.Unlock()
+		return
+	}
+
+	t.mu.Unlock()
+
+	t.peerManager().add(ps)
+}
+
+// KnownPeers lists the peers we know about so far, from Peers and every call
+// to AddPeers. It's safe to call while peers are being added.
+func (t *Torrent) KnownPeers() []peers.Peer {
+	t.mu.Lock()
+	m := t.manager
+	known := append([]peers.Peer(nil), t.Peers...)
+	t.mu.Unlock()
+
+	if m == nil {
+		return known
+	}
+
+	return m.peers()
+}
+
+// peerManager returns the torrent's peer manager, making it the first time
+func (t *Torrent) peerManager() *peerManager {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.manager == nil {
+		t.manager = newPeerManager(t)
+	}
+
+	return t.manager
+}
+
+// stop waits for every peer to disconnect after Download's context is
+// cancelled, then saves how far we got
+func (t *Torrent) stop() {
+	t.mu.Lock()
+	t.stopping = true
+	t.mu.Unlock()
+
+	t.peerGroup.Wait()
+
+	if t.ResumePath != "" {
+		t.saveResume()
+	}
+
+	t.emit(Event{Type: EventStopped})
+}
+
+// Close disconnects every peer after Download has returned and waits for
+// them to go, so nothing reads from the storage once it's closed. Download
+// only does this itself when it stops early.
+func (t *Torrent) Close() {
+	t.mu.Lock()
+	cancel := t.cancel
+	t.stopping = true
+	t.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+
+	t.peerGroup.Wait()
+}
+
+// fail stops everything Download started after an error it can't carry on
+// from
+func (t *Torrent) fail(err error) error {
+	t.cancel()
+	t.stop()
+
+	return err
+}
+
+// addPeerGoroutine counts a goroutine that talks to a peer, so that stop can
+// wait for it. It returns false if we're stopping and the peer should be
+// turned away.
+func (t *Torrent) addPeerGoroutine() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopping {
+		return false
+	}
+
+	t.peerGroup.Add(1)
+
+	return true
+}
+
+// ready is true once Download has given us somewhere to read pieces from
+func (t *Torrent) ready() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.storage != nil
+}
+
+func (t *Torrent) hasPiece(index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.have.HasPiece(index)
+}
+
+// haveBitfield returns a copy of the pieces we have, safe to send to a peer
+func (t *Torrent) haveBitfield() bitfield.Bitfield {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bf := make(bitfield.Bitfield, len(t.have))
+	copy(bf, t.have)
+
+	return bf
+}
+
+// startUploader starts serving a connected peer's requests
+func (t *Torrent) startUploader(c *client.Client) *uploader {
+	u := newUploader(t, c)
+
+	t.mu.Lock()
+	if t.uploaders == nil {
+		t.uploaders = map[*client.Client]*uploader{}
+	}
+	t.uploaders[c] = u
+
+	// The choker starts with the first connection and runs until we stop
+	if t.choker == nil {
+		t.choker = newChoker(t)
+		go t.choker.run(t.ctx)
+	}
+	t.mu.Unlock()
+
+	go u.run()
+
+	return u
+}
+
+func (t *Torrent) stopUploader(c *client.Client, u *uploader) {
+	u.close()
+
+	t.mu.Lock()
+	delete(t.uploaders, c)
+	t.mu.Unlock()
+
+	// The peer might have had an upload slot that someone else can use
+	t.rechokeSoon()
+}
+
+// connectedUploaders lists the upload side of every connected peer
+func (t *Torrent) connectedUploaders() []*uploader {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	uploaders := make([]*uploader, 0, len(t.uploaders))
+	for _, u := range t.uploaders {
+		uploaders = append(uploaders, u)
+	}
+
+	return uploaders
+}
+
+func (t *Torrent) rechokeSoon() {
+	t.mu.Lock()
+	ch := t.choker
+	t.mu.Unlock()
+
+	if ch != nil {
+		ch.rechokeSoon()
+	}
+}
+
+// broadcastHave tells every connected peer about a piece we just finished.
+// Fast peers that may download it while choked are told that too.
+func (t *Torrent) broadcastHave(index int) {
+	for _, u := range t.connectedUploaders() {
+		u.client.SendHave(index)
+
+		if u.allowedFast[index] {
+			u.client.SendAllowedFast(index)
+		}
+	}
+}
+
+// Downloaded is the number of bytes received from peers
+func (t *Torrent) Downloaded() int64 {
+	return atomic.LoadInt64(&t.downloaded)
+}
+
+// Uploaded is the number of bytes sent to peers
+func (t *Torrent) Uploaded() int64 {
+	return atomic.LoadInt64(&t.uploaded)
+}
+
+// Left is the number of bytes we still need
+func (t *Torrent) Left() int64 {
+	return int64(t.Length) - atomic.LoadInt64(&t.completed)
+}
+
 // Bounds are specified by the PieceLength and the total Length
 // The second piece will begin at 2 * PieceLength.
 // The end of the second piece will be at (2 * PieceLength) + PieceLength
@@ -148,85 +594,250 @@ func (t *Torrent) calculatePieceSize(index int) int {
 	return end - begin
 }
 
-func (t *Torrent) startDownloadWorker(peer peers.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := client.New(peer, t.PeerID, t.InfoHash)
+// runPeer talks to a connected peer until it goes away. While we're
+// downloading it asks the picker for pieces the peer can give us, and the
+// whole time it hands the peer's requests to the uploader.
+func (t *Torrent) runPeer(c *client.Client) {
+	c.Bitfield = t.sizeBitfield(c.Bitfield)
+
+	t.picker.addPeer(c.Bitfield)
+	// c.Bitfield is replaced if the peer sends a new one, so look it up late
+	defer func() { t.picker.removePeer(c.Bitfield) }()
+
+	u := t.startUploader(c)
+	defer t.stopUploader(c, u)
+
+	u.setPeerPieces(t.countPieces(c.Bitfield))
+
+	t.emit(Event{Type: EventPeerConnected, Peer: c.Peer()})
+	defer t.emit(Event{Type: EventPeerDisconnected, Peer: c.Peer()})
+
+	// Let the peer know what we can upload to it. Fast peers can be told
+	// we have everything or nothing in one go.
+	have := t.haveBitfield()
+	switch {
+	case c.SupportsFast() && t.countPieces(have) == len(t.PieceHashes):
+		c.SendHaveAll()
+	case c.SupportsFast() && isEmpty(have):
+		c.SendHaveNone()
+	case !isEmpty(have):
+		c.SendBitfield(have)
+	}
 
-	if err != nil {
-		log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
-		return
+	for index := range u.allowedFast {
+		if have.HasPiece(index) {
+			c.SendAllowedFast(index)
+		}
+	}
+
+	if c.SupportsExtensions() {
+		t.sendExtHandshake(c)
+	}
+
+	defer t.extensionsDisconnected(c)
+
+	msgs := make(chan readResult)
+	quit := make(chan struct{})
+	defer close(quit)
+
+	go readLoop(c, msgs, quit)
+
+	interested := false
+
+	for {
+		// Grab this before picking so that a change in between isn't missed
+		changed := t.picker.changed()
+
+		// Whether the peer gets to download from us is up to the choker
+		wanted := t.picker.interesting(c.Bitfield)
+		if wanted != interested {
+			if wanted {
+				c.SendInterested()
+			} else {
+				c.SendNotInterested()
+			}
+
+			u.setAmInterested(wanted)
+			interested = wanted
+		}
+
+		if wanted {
+			if piece, ok := t.pickPiece(c, u); ok {
+				err := t.downloadPiece(c, u, piece, msgs)
+				if err != nil {
+					log.Printf("Disconnecting %s: %v\n", c.Peer(), err)
+					return
+				}
+
+				continue
+			}
+		}
+
+		// Nothing to download from this peer right now. Wait until it
+		// unchokes us, gets a new piece, someone gives up on one it has,
+		// or endgame starts.
+		select {
+		case res := <-msgs:
+			if res.err != nil {
+				return
+			}
+
+			err := t.handleMessage(c, u, res.msg)
+			if err != nil {
+				log.Printf("Disconnecting %s: %v\n", c.Peer(), err)
+				return
+			}
+		case <-changed:
+		case <-t.ctx.Done():
+			return
+		}
 	}
+}
 
-	defer c.Conn.Close()
+// pickPiece asks the picker for a piece to download from the peer. While
+// the peer chokes us only pieces it lets us download anyway will do, there's
+// no point holding a piece we can't ask for. Otherwise the peer's
+// suggestions beat rarity. Pieces the peer rejected our requests for are
+// skipped until it unchokes us again.
+func (t *Torrent) pickPiece(c *client.Client, u *uploader) (*activePiece, bool) {
+	bf := c.Bitfield
+	if len(u.refused) > 0 {
+		bf = make(bitfield.Bitfield, len(c.Bitfield))
+		copy(bf, c.Bitfield)
+
+		for index := range u.refused {
+			bf[index/8] &^= 1 << (7 - uint(index%8))
+		}
+	}
 
-	log.Printf("Completed handshake with %s\n", peer.IP)
+	if c.Choked {
+		if len(u.peerAllowedFast) == 0 {
+			return nil, false
+		}
 
-	// Connections are immediately choked, so first we need to unchoke
-	c.SendUnchoke()
-	c.SendInterested()
+		return t.picker.pick(onlyPieces(bf, u.peerAllowedFast), nil)
+	}
 
-	for pw := range workQueue {
-		// If this peer doesn't have the piece, place it back on the queue for someone other 
-		// peer to pick up.
-		if !c.Bitfield.HasPiece(pw.index) {
-			workQueue <- pw
-			continue
+	return t.picker.pick(bf, u.suggestions())
+}
+
+// readLoop reads messages from the peer until the connection fails or quit
+// is closed, so the peer's goroutine can wait on the peer and the picker at
+// the same time
+func readLoop(c *client.Client, msgs chan<- readResult, quit <-chan struct{}) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		msg, err := c.Read()
+
+		select {
+		case msgs <- readResult{msg, err}:
+		case <-quit:
+			return
 		}
 
-		buf, err := attemptDownloadPiece(c, pw)
 		if err != nil {
-			log.Println("Exiting", err)
-			workQueue <- pw
 			return
 		}
+	}
+}
+
+// downloadPiece downloads a piece the picker gave us and, once it passes
+// its hash check, hands it to Download. If another peer finishes the piece
+// first, in endgame mode, there's nothing left to do.
+func (t *Torrent) downloadPiece(c *client.Client, u *uploader, piece *activePiece, msgs <-chan readResult) error {
+	complete, err := t.attemptDownloadPiece(c, u, piece, msgs)
 
-		err = checkIntegrity(pw, buf)
+	if complete {
+		pw := &pieceWork{piece.index, t.PieceHashes[piece.index], piece.length}
+
+		// Never write or announce a bad piece. Someone gets to try again,
+		// and whoever sent it to us gets the blame.
+		err = checkIntegrity(pw, piece.buf)
 		if err != nil {
 			log.Printf("Piece #%d failed integrity check\n", pw.index)
+			t.emit(Event{Type: EventPieceFailed, Piece: pw.index})
+			t.picker.retry(piece)
+			t.picker.leave(piece, c)
+			t.blame(piece.contributors())
+
+			return nil
 		}
 
-		c.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf}
+		t.picker.finish(piece.index)
+	}
+
+	t.picker.leave(piece, c)
+
+	if err != nil || !complete {
+		return err
 	}
+
+	select {
+	case t.results <- &pieceResult{piece.index, piece.buf}:
+	case <-t.ctx.Done():
+		return t.ctx.Err()
+	}
+
+	return nil
 }
 
-func attemptDownloadPiece(client *client.Client, pw *pieceWork) ([]byte, error) {
+// attemptDownloadPiece requests blocks of the piece until it's complete.
+// It returns true if this peer sent the last block.
+func (t *Torrent) attemptDownloadPiece(client *client.Client, uploads *uploader, piece *activePiece, msgs <-chan readResult) (bool, error) {
 	state := pieceProgress{
-		index: 		pw.index,
+		piece:		piece,
+		torrent:	t,
 		client: 	client,
-		buf:		make([]byte, pw.length),
+		uploads:	uploads,
 	}
 
-	client.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	// Disable deadline after function finishes.
-	defer client.Conn.SetDeadline(time.Time{})
+	timeout := time.NewTimer(pieceTimeout)
+	defer timeout.Stop()
 
-	for state.downloaded < pw.length {
-		if !state.client.Choked {
-			for state.backlog < MaxBacklog && state.requested < pw.length {
-				blockSize := MaxBlockSize
+	for {
+		if uploads.refused[piece.index] {
+			return false, nil
+		}
 
-				if pw.length - state.requested < blockSize {
-					blockSize = pw.length - state.requested
+		if !state.client.Choked || uploads.peerAllowedFast[piece.index] {
+			for piece.outstanding(client) < MaxBacklog {
+				begin, length, ok := piece.nextRequest(client)
+				if !ok {
+					break
 				}
 
-				err := client.SendRequest(pw.index, state.requested, blockSize)
+				err := client.SendRequest(piece.index, begin, length)
 
 				if err != nil {
-					return nil, err
+					return false, err
 				}
-
-				state.backlog++
-				state.requested += blockSize
 			}
 		}
 
-		err := state.readMessage()
-		if err != nil {
-			return nil, err
+		select {
+		case res := <-msgs:
+			if res.err != nil {
+				return false, res.err
+			}
+
+			complete, err := state.handleMessage(res.msg)
+			if err != nil || complete {
+				return complete, err
+			}
+
+			// Choked halfway through. Let someone else have the piece
+			// rather than sit on it until the peer unchokes us.
+			if client.Choked && !uploads.peerAllowedFast[piece.index] {
+				return false, nil
+			}
+		case <-piece.done:
+			return false, nil
+		case <-timeout.C:
+			return false, fmt.Errorf("Timed out downloading piece #%d", piece.index)
+		case <-t.ctx.Done():
+			return false, t.ctx.Err()
 		}
 	}
-
-	return state.buf, nil
 }
 
 // The hash for the buf should match the pieceWork hash
@@ -239,3 +850,26 @@ func checkIntegrity(pw *pieceWork, buf []byte) error {
 
 	return nil
 }
+
+// countPieces is how many of the torrent's pieces are set in bf
+func (t *Torrent) countPieces(bf bitfield.Bitfield) int {
+	count := 0
+
+	for index := range t.PieceHashes {
+		if bf.HasPiece(index) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func isEmpty(bf bitfield.Bitfield) bool {
+	for _, b := range bf {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,381 @@
+package p2p
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/client"
+	"github.com/copperwall/bittorrent-go/mse"
+	"github.com/copperwall/bittorrent-go/peers"
+)
+
+// DefaultMaxPeers is how many peers we're connected to at once, in and out,
+// when Torrent.MaxPeers isn't set
+const DefaultMaxPeers = 50
+
+// A peer we couldn't reach, or that dropped us, is retried after
+// retryBackoff, then twice as long after every failure up to
+// maxRetryBackoff. After maxPeerFailures failures in a row it's forgotten
+// until someone tells us about it again, and then it only gets one more try
+// after maxRetryBackoff.
+const (
+	retryBackoff    = 15 * time.Second
+	maxRetryBackoff = 10 * time.Minute
+	maxPeerFailures = 5
+)
+
+// A connection that lasts this long counts as a success, so the peer
+// starts over with a short backoff the next time it drops
+const stableConnection = 2 * time.Minute
+
+// knownPeer is a peer we can dial, from a tracker or anywhere else
+type knownPeer struct {
+	peer peers.Peer
+	// flags is what PEX last told us about the peer, 0 if we only heard
+	// of it elsewhere
+	flags      byte
+	connecting bool
+	failures   int
+	retryAt    time.Time
+}
+
+// peerManager decides which peers to connect to. It keeps every peer we've
+// been told about by address, dials them while we're under the connection
+// limit and redials the ones that went away after a backoff. Inbound
+// connections count against the same limit, and a peer ID is only ever
+// connected once.
+type peerManager struct {
+	torrent *Torrent
+
+	mu    sync.Mutex
+	known map[string]*knownPeer
+	// gone is how many times each peer we gave up on failed, so hearing
+	// about it again doesn't give it a clean slate
+	gone map[string]int
+	// ids is the peer ID of every open connection
+	ids map[[20]byte]bool
+	// conns counts open connections and dials in progress
+	conns int
+	wake  chan struct{}
+}
+
+func newPeerManager(t *Torrent) *peerManager {
+	return &peerManager{
+		torrent: t,
+		known:   map[string]*knownPeer{},
+		gone:    map[string]int{},
+		ids:     map[[20]byte]bool{},
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func (m *peerManager) maxPeers() int {
+	if m.torrent.MaxPeers > 0 {
+		return m.torrent.MaxPeers
+	}
+
+	return DefaultMaxPeers
+}
+
+// peers lists every peer the manager knows about
+func (m *peerManager) peers() []peers.Peer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ps := make([]peers.Peer, 0, len(m.known))
+	for _, kp := range m.known {
+		ps = append(ps, kp.peer)
+	}
+
+	return ps
+}
+
+// add remembers peers we haven't heard of yet. A peer we'd given up on
+// gets another try once the longest backoff is up.
+func (m *peerManager) add(ps []peers.Peer) {
+	m.mu.Lock()
+
+	for _, peer := range ps {
+		m.remember(peer)
+	}
+
+	m.mu.Unlock()
+
+	m.notify()
+}
+
+// addEntries is add for peers PEX told us about, keeping the flags that
+// came with them
+func (m *peerManager) addEntries(entries []pexEntry) {
+	m.mu.Lock()
+
+	for _, entry := range entries {
+		m.remember(entry.peer).flags = entry.flags
+	}
+
+	m.mu.Unlock()
+
+	m.notify()
+}
+
+// remember returns the known peer at peer's address, adding it if it's
+// new. m.mu must be held.
+func (m *peerManager) remember(peer peers.Peer) *knownPeer {
+	addr := peer.String()
+
+	kp := m.known[addr]
+	if kp == nil {
+		kp = &knownPeer{peer: peer}
+		m.known[addr] = kp
+
+		if failures := m.gone[addr]; failures > 0 {
+			delete(m.gone, addr)
+			kp.failures = failures
+			kp.retryAt = time.Now().Add(maxRetryBackoff)
+		}
+	}
+
+	return kp
+}
+
+// notify wakes run up to look for peers to dial
+func (m *peerManager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run dials peers until ctx is cancelled
+func (m *peerManager) run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		next := m.connectReady()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+
+		select {
+		case <-m.wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// connectReady dials every peer that's due, as long as we're under the
+// connection limit. It returns when the next peer will be due, or the
+// zero time if nobody is waiting on a backoff.
+func (m *peerManager) connectReady() time.Time {
+	t := m.torrent
+
+	// Once we're seeding, peers that want something from us connect to us
+	if t.Left() == 0 {
+		return time.Time{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	next := time.Time{}
+	due := []*knownPeer{}
+
+	for addr, kp := range m.known {
+		if kp.connecting {
+			continue
+		}
+
+		if t.isBanned(kp.peer) {
+			delete(m.known, addr)
+			continue
+		}
+
+		if kp.retryAt.After(now) {
+			if next.IsZero() || kp.retryAt.Before(next) {
+				next = kp.retryAt
+			}
+			continue
+		}
+
+		due = append(due, kp)
+	}
+
+	byPreference(due, t.Encryption)
+
+	for _, kp := range due {
+		if m.conns >= m.maxPeers() || !t.addPeerGoroutine() {
+			break
+		}
+
+		kp.connecting = true
+		m.conns++
+
+		go m.connect(kp)
+	}
+
+	return next
+}
+
+// byPreference sorts peers so the ones we'd rather dial come first. Seeds
+// have every piece we're missing, and peers that encrypt are better when
+// we'd like to.
+func byPreference(kps []*knownPeer, policy mse.Policy) {
+	rank := func(kp *knownPeer) int {
+		r := 0
+		if kp.flags&pexSeed != 0 {
+			r += 2
+		}
+
+		if kp.flags&pexEncryption != 0 && policy != mse.Disabled {
+			r++
+		}
+
+		return r
+	}
+
+	sort.SliceStable(kps, func(i, j int) bool {
+		return rank(kps[i]) > rank(kps[j])
+	})
+}
+
+// connect dials a known peer and downloads from it until it goes away
+func (m *peerManager) connect(kp *knownPeer) {
+	t := m.torrent
+	defer t.peerGroup.Done()
+
+	c, err := client.New(t.ctx, kp.peer, t.PeerID, t.InfoHash, t.Encryption)
+
+	if err != nil {
+		log.Printf("Could not handshake with %s. Disconnecting\n", kp.peer.IP)
+		m.disconnected(kp, nil, time.Time{})
+		return
+	}
+
+	defer c.Conn.Close()
+
+	if !m.register(c) {
+		// Either ourselves or a peer we already have, under another address
+		m.forget(kp)
+		return
+	}
+
+	log.Printf("Completed handshake with %s\n", kp.peer.IP)
+
+	connected := time.Now()
+	t.runPeer(c)
+
+	m.disconnected(kp, c, connected)
+}
+
+// register claims c's peer ID. It's false if we're already connected to
+// that peer, or c is us.
+func (m *peerManager) register(c *client.Client) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if c.RemoteID == m.torrent.PeerID || m.ids[c.RemoteID] {
+		return false
+	}
+
+	m.ids[c.RemoteID] = true
+
+	return true
+}
+
+// disconnected schedules a retry for a peer we couldn't connect to, or
+// that went away. c is nil if we never got through the handshake.
+func (m *peerManager) disconnected(kp *knownPeer, c *client.Client, connected time.Time) {
+	m.mu.Lock()
+
+	if c != nil {
+		delete(m.ids, c.RemoteID)
+	}
+
+	m.conns--
+	kp.connecting = false
+
+	if c != nil && time.Since(connected) >= stableConnection {
+		kp.failures = 0
+	}
+
+	kp.failures++
+
+	if kp.failures > maxPeerFailures {
+		delete(m.known, kp.peer.String())
+		m.gone[kp.peer.String()] = kp.failures
+	} else {
+		kp.retryAt = time.Now().Add(backoff(kp.failures))
+	}
+
+	m.mu.Unlock()
+
+	m.notify()
+}
+
+// forget drops a peer we shouldn't dial again, after a handshake that
+// didn't lead anywhere
+func (m *peerManager) forget(kp *knownPeer) {
+	m.mu.Lock()
+	delete(m.known, kp.peer.String())
+	m.conns--
+	m.mu.Unlock()
+
+	m.notify()
+}
+
+// accept makes room for a peer that connected to us. It's false if we're
+// at the connection limit or already connected to the peer.
+func (m *peerManager) accept(c *client.Client) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conns >= m.maxPeers() || m.ids[c.RemoteID] {
+		return false
+	}
+
+	m.ids[c.RemoteID] = true
+	m.conns++
+
+	return true
+}
+
+// release frees the slot of a peer that connected to us
+func (m *peerManager) release(c *client.Client) {
+	m.mu.Lock()
+	delete(m.ids, c.RemoteID)
+	m.conns--
+	m.mu.Unlock()
+
+	m.notify()
+}
+
+// backoff is how long to wait before retrying a peer that failed failures
+// times in a row
+func backoff(failures int) time.Duration {
+	wait := retryBackoff
+
+	for i := 1; i < failures && wait < maxRetryBackoff; i++ {
+		wait *= 2
+	}
+
+	if wait > maxRetryBackoff {
+		wait = maxRetryBackoff
+	}
+
+	return wait
+}
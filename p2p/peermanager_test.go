@@ -0,0 +1,103 @@
+package p2p
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/peers"
+)
+
+func TestKnownPeers(t *testing.T) {
+	tor := testTorrent(1)
+	tor.picker = nil
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	// Trackers and the DHT add peers while main checks on them
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 50; i++ {
+			tor.AddPeers([]peers.Peer{{IP: net.IPv4(10, 0, 0, byte(i)), Port: 6881}})
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		tor.KnownPeers()
+	}
+
+	wg.Wait()
+
+	if n := len(tor.KnownPeers()); n != 50 {
+		t.Errorf("Expected 50 peers before downloading, got %d", n)
+	}
+
+	// Once the peer manager has them, duplicates are dropped
+	m := tor.peerManager()
+	m.add(tor.Peers)
+	m.add(tor.Peers[:10])
+
+	if n := len(tor.KnownPeers()); n != 50 {
+		t.Errorf("Expected 50 peers from the peer manager, got %d", n)
+	}
+}
+
+func TestForgottenPeerBacksOff(t *testing.T) {
+	tor := testTorrent(1)
+	m := tor.peerManager()
+
+	peer := peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	addr := peer.String()
+
+	// fail stands in for connect failing to reach the peer
+	fail := func() {
+		kp := m.known[addr]
+		kp.connecting = true
+		m.conns++
+		m.disconnected(kp, nil, time.Time{})
+	}
+
+	m.add([]peers.Peer{peer})
+	for i := 0; i <= maxPeerFailures; i++ {
+		fail()
+	}
+
+	if m.known[addr] != nil {
+		t.Fatalf("Peer still known after %d failures", maxPeerFailures+1)
+	}
+
+	// A tracker telling us about it again doesn't start it over
+	before := time.Now()
+	m.add([]peers.Peer{peer})
+
+	kp := m.known[addr]
+	if kp == nil {
+		t.Fatal("Peer wasn't added again")
+	}
+
+	if kp.failures != maxPeerFailures+1 || kp.retryAt.Before(before.Add(maxRetryBackoff)) {
+		t.Errorf("Re-added with %d failures, retrying in %v", kp.failures, kp.retryAt.Sub(before))
+	}
+
+	if next := m.connectReady(); !next.Equal(kp.retryAt) || kp.connecting {
+		t.Errorf("Dialed a forgotten peer straight away, next dial at %v", next)
+	}
+
+	// One more failure and it's gone again
+	fail()
+
+	if m.known[addr] != nil || m.gone[addr] != maxPeerFailures+2 {
+		t.Errorf("Peer known %v, %d failures recorded", m.known[addr] != nil, m.gone[addr])
+	}
+
+	// Peers we never gave up on are unaffected
+	other := peers.Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	m.add([]peers.Peer{other})
+
+	if kp := m.known[other.String()]; kp.failures != 0 || !kp.retryAt.IsZero() {
+		t.Errorf("New peer has %d failures, retry at %v", kp.failures, kp.retryAt)
+	}
+}
@@ -0,0 +1,359 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/client"
+	"github.com/copperwall/bittorrent-go/message"
+	"github.com/copperwall/bittorrent-go/mse"
+	"github.com/copperwall/bittorrent-go/peers"
+	"github.com/jackpal/bencode-go"
+)
+
+// pexName is what ut_pex is called in extension handshakes
+const pexName = "ut_pex"
+
+// pexInterval is how often we tell each peer which peers we've connected
+// to and dropped since last time
+const pexInterval = time.Minute
+
+// Peers shouldn't send PEX messages more often than once a minute. Ones
+// that arrive sooner than this after the last are ignored.
+const minPexInterval = 45 * time.Second
+
+// maxPexPeers is the most peers one PEX message adds, and the most it drops
+const maxPexPeers = 50
+
+// Flags sent with each added peer (BEP 11). We don't speak uTP or do hole
+// punching, so the flags for those (0x04 and 0x08) are never sent and
+// ignored when they arrive.
+const (
+	pexEncryption = 0x01
+	pexSeed       = 0x02
+	// pexReachable means we connected to the peer, so it accepts
+	// connections
+	pexReachable = 0x10
+)
+
+// pex is the peer exchange extension (BEP 11). It tells peers which peers
+// we're connected to, and adds the peers they tell us about to the
+// download.
+type pex struct {
+	torrent *Torrent
+
+	mu      sync.Mutex
+	peers   map[*client.Client]*pexPeer
+	started bool
+}
+
+// pexPeer is the peer exchange state of a connection
+type pexPeer struct {
+	// id is the extended message ID the peer gave ut_pex in its extension
+	// handshake, 0 if it doesn't want PEX messages
+	id uint8
+	// listenPort is the port the peer said it accepts connections on
+	listenPort uint16
+	// sent is the peers we've told this peer about, by address
+	sent map[string]peers.Peer
+	// lastReceived is when the peer last sent us a PEX message
+	lastReceived time.Time
+}
+
+// pexEntry is a peer we can tell others about
+type pexEntry struct {
+	peer  peers.Peer
+	flags byte
+}
+
+func newPex(t *Torrent) *pex {
+	return &pex{
+		torrent: t,
+		peers:   map[*client.Client]*pexPeer{},
+	}
+}
+
+// Handshake starts exchanging peers with c, if it wants to
+func (p *pex) Handshake(c *client.Client, id uint8, hs *message.ExtendedHandshake) {
+	p.mu.Lock()
+
+	pp := p.peers[c]
+	if pp == nil {
+		pp = &pexPeer{sent: map[string]peers.Peer{}}
+		p.peers[c] = pp
+	}
+
+	pp.id = id
+	pp.listenPort = hs.P
+
+	// Like the choker, PEX starts with the first connection
+	if !p.started {
+		p.started = true
+		go p.run(p.torrent.ctx)
+	}
+
+	p.mu.Unlock()
+
+	// Tell the peer who we know straight away rather than waiting for
+	// the next round
+	if id != 0 {
+		p.send(c)
+	}
+}
+
+func (p *pex) Disconnected(c *client.Client) {
+	p.mu.Lock()
+	delete(p.peers, c)
+	p.mu.Unlock()
+}
+
+// Handle adds the peers a PEX message tells us about to the download
+func (p *pex) Handle(c *client.Client, payload []byte) error {
+	p.mu.Lock()
+
+	pp := p.peers[c]
+	tooSoon := pp == nil || !pp.lastReceived.IsZero() && time.Since(pp.lastReceived) < minPexInterval
+	if !tooSoon {
+		pp.lastReceived = time.Now()
+	}
+
+	p.mu.Unlock()
+
+	if tooSoon {
+		return nil
+	}
+
+	added, err := decodePex(payload)
+	if err != nil {
+		return fmt.Errorf("Bad PEX message: %v", err)
+	}
+
+	wanted := []pexEntry{}
+
+	for _, entry := range added {
+		// A peer that doesn't encrypt would only turn us away
+		if p.torrent.Encryption == mse.Required && entry.flags&pexEncryption == 0 {
+			continue
+		}
+
+		wanted = append(wanted, entry)
+	}
+
+	if len(wanted) > 0 {
+		p.torrent.peerManager().addEntries(wanted)
+	}
+
+	return nil
+}
+
+// decodePex reads the peers a PEX message adds, with the flags sent for
+// each. Peers the message has no flags for get none.
+func decodePex(payload []byte) ([]pexEntry, error) {
+	msg, err := decodeDict(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	added := []pexEntry{}
+
+	for _, key := range []string{"added", "added6"} {
+		compact, _ := msg[key].(string)
+		flags, _ := msg[key+".f"].(string)
+
+		unmarshal := peers.Unmarshal
+		if key == "added6" {
+			unmarshal = peers.Unmarshal6
+		}
+
+		ps, err := unmarshal([]byte(compact))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(ps) > maxPexPeers {
+			ps = ps[:maxPexPeers]
+		}
+
+		for i, peer := range ps {
+			entry := pexEntry{peer: peer}
+			if i < len(flags) {
+				entry.flags = flags[i]
+			}
+
+			added = append(added, entry)
+		}
+	}
+
+	return added, nil
+}
+
+// run sends every peer that wants them a PEX message each pexInterval
+func (p *pex) run(ctx context.Context) {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		p.mu.Lock()
+		clients := make([]*client.Client, 0, len(p.peers))
+		for c, pp := range p.peers {
+			if pp.id != 0 {
+				clients = append(clients, c)
+			}
+		}
+		p.mu.Unlock()
+
+		for _, c := range clients {
+			p.send(c)
+		}
+	}
+}
+
+// entries lists every connected peer we could tell others about, by
+// address. Peers that connected to us only count if they told us the
+// port they listen on.
+func (p *pex) entries() map[string]pexEntry {
+	uploaders := p.torrent.connectedUploaders()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entries := map[string]pexEntry{}
+
+	for _, u := range uploaders {
+		c := u.client
+		entry := pexEntry{peer: c.Peer()}
+
+		if c.Inbound() {
+			pp := p.peers[c]
+			if pp == nil || pp.listenPort == 0 {
+				continue
+			}
+
+			entry.peer.Port = pp.listenPort
+		} else {
+			entry.flags |= pexReachable
+		}
+
+		if c.Encrypted() {
+			entry.flags |= pexEncryption
+		}
+
+		if u.pieces() == len(p.torrent.PieceHashes) {
+			entry.flags |= pexSeed
+		}
+
+		entries[entry.peer.String()] = entry
+	}
+
+	return entries
+}
+
+// send tells c about the peers we've connected to and dropped since we
+// last told it
+func (p *pex) send(c *client.Client) {
+	entries := p.entries()
+
+	p.mu.Lock()
+	pp := p.peers[c]
+	if pp == nil || pp.id == 0 {
+		p.mu.Unlock()
+		return
+	}
+
+	// Don't tell the peer about itself
+	self := c.Peer()
+	if c.Inbound() {
+		self.Port = pp.listenPort
+	}
+
+	added := []pexEntry{}
+	for addr, entry := range entries {
+		if _, ok := pp.sent[addr]; ok || addr == self.String() || len(added) == maxPexPeers {
+			continue
+		}
+
+		added = append(added, entry)
+		pp.sent[addr] = entry.peer
+	}
+
+	dropped := []peers.Peer{}
+	for addr, peer := range pp.sent {
+		if _, ok := entries[addr]; !ok && len(dropped) < maxPexPeers {
+			dropped = append(dropped, peer)
+			delete(pp.sent, addr)
+		}
+	}
+
+	id := pp.id
+	p.mu.Unlock()
+
+	if len(added) == 0 && len(dropped) == 0 {
+		return
+	}
+
+	payload, err := encodePex(added, dropped)
+	if err == nil {
+		c.SendExtended(id, payload)
+	}
+}
+
+// encodePex writes a PEX message adding and dropping peers, with each
+// added peer's flags
+func encodePex(added []pexEntry, dropped []peers.Peer) ([]byte, error) {
+	v4, v6 := []peers.Peer{}, []peers.Peer{}
+	flags4, flags6 := []byte{}, []byte{}
+
+	for _, entry := range added {
+		if entry.peer.IP.To4() != nil {
+			v4 = append(v4, entry.peer)
+			flags4 = append(flags4, entry.flags)
+		} else {
+			v6 = append(v6, entry.peer)
+			flags6 = append(flags6, entry.flags)
+		}
+	}
+
+	msg := map[string]interface{}{
+		"added":    string(peers.Marshal(v4)),
+		"added.f":  string(flags4),
+		"added6":   string(peers.Marshal6(v6)),
+		"added6.f": string(flags6),
+		"dropped":  string(peers.Marshal(dropped)),
+		"dropped6": string(peers.Marshal6(dropped)),
+	}
+
+	var buf bytes.Buffer
+
+	err := bencode.Marshal(&buf, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decodeDict decodes a bencoded dictionary from a peer. It doesn't use a
+// struct, so a peer sending a value of the wrong type can't make decoding
+// fail, the value just isn't there.
+func decodeDict(payload []byte) (map[string]interface{}, error) {
+	v, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected a dictionary")
+	}
+
+	return d, nil
+}
@@ -0,0 +1,135 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+
+	"github.com/copperwall/bittorrent-go/mse"
+	"github.com/copperwall/bittorrent-go/peers"
+)
+
+func TestPexEncoding(t *testing.T) {
+	added := []pexEntry{
+		{peer: peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, flags: pexSeed | pexEncryption},
+		{peer: peers.Peer{IP: net.ParseIP("2001:db8::1"), Port: 51413}, flags: pexReachable},
+		{peer: peers.Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6882}},
+	}
+	dropped := []peers.Peer{
+		{IP: net.IPv4(10, 0, 0, 3), Port: 6883},
+		{IP: net.ParseIP("2001:db8::2"), Port: 6884},
+	}
+
+	payload, err := encodePex(added, dropped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodePex(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// IPv4 peers come first, then IPv6
+	want := []pexEntry{added[0], added[2], added[1]}
+	if len(decoded) != len(want) {
+		t.Fatalf("Decoded %d peers, expected %d", len(decoded), len(want))
+	}
+
+	for i, entry := range decoded {
+		if entry.peer.String() != want[i].peer.String() || entry.flags != want[i].flags {
+			t.Errorf("Peer %d is %s with flags %#x, expected %s with %#x",
+				i, entry.peer, entry.flags, want[i].peer, want[i].flags)
+		}
+	}
+
+	msg, err := decodeDict(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d, _ := msg["dropped"].(string); d != string(peers.Marshal(dropped[:1])) {
+		t.Errorf("Got dropped %x", d)
+	}
+
+	if d, _ := msg["dropped6"].(string); d != string(peers.Marshal6(dropped[1:])) {
+		t.Errorf("Got dropped6 %x", d)
+	}
+}
+
+func TestPexWithoutFlags(t *testing.T) {
+	compact := peers.Marshal([]peers.Peer{{IP: net.IPv4(10, 0, 0, 1), Port: 6881}})
+
+	// Some clients leave the flags out
+	decoded, err := decodePex([]byte("d5:added6:" + string(compact) + "e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded) != 1 || decoded[0].flags != 0 {
+		t.Fatalf("Expected one peer without flags, got %v", decoded)
+	}
+}
+
+func TestPexHandle(t *testing.T) {
+	encrypted := peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	plain := peers.Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+
+	payload, err := encodePex([]pexEntry{
+		{peer: encrypted, flags: pexEncryption | pexSeed},
+		{peer: plain},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, policy := range []mse.Policy{mse.Preferred, mse.Required} {
+		tor := testTorrent(1)
+		tor.Encryption = policy
+
+		c := testPeer(t, fullBitfield(1))
+		p := newPex(tor)
+		p.peers[c] = &pexPeer{}
+
+		err := p.Handle(c, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		known := tor.peerManager().known
+
+		kp := known[encrypted.String()]
+		if kp == nil || kp.flags != pexEncryption|pexSeed {
+			t.Errorf("%v: Expected %s with its flags, got %v", policy, encrypted, kp)
+		}
+
+		// Peers that don't encrypt are no use when we have to
+		_, ok := known[plain.String()]
+		if ok != (policy != mse.Required) {
+			t.Errorf("%v: Known %v, expected %v", policy, ok, policy != mse.Required)
+		}
+	}
+}
+
+func TestDialPreference(t *testing.T) {
+	plain := &knownPeer{}
+	encrypted := &knownPeer{flags: pexEncryption}
+	seed := &knownPeer{flags: pexSeed}
+	encryptedSeed := &knownPeer{flags: pexSeed | pexEncryption}
+
+	kps := []*knownPeer{plain, encrypted, seed, encryptedSeed}
+	byPreference(kps, mse.Preferred)
+
+	for i, want := range []*knownPeer{encryptedSeed, seed, encrypted, plain} {
+		if kps[i] != want {
+			t.Errorf("Peer %d has flags %#x, expected %#x", i, kps[i].flags, want.flags)
+		}
+	}
+
+	// Without encryption it doesn't matter who can encrypt
+	kps = []*knownPeer{encrypted, plain, seed}
+	byPreference(kps, mse.Disabled)
+
+	if kps[0] != seed || kps[1] != encrypted || kps[2] != plain {
+		t.Error("Expected the seed first, then the rest in the order they came")
+	}
+}
@@ -0,0 +1,270 @@
+package p2p
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+
+	"github.com/copperwall/bittorrent-go/bitfield"
+	"github.com/copperwall/bittorrent-go/client"
+)
+
+type pieceState uint8
+
+const (
+	pieceWanted pieceState = iota
+	pieceInProgress
+	pieceDone
+)
+
+// picker decides which piece each peer downloads next. It counts how many
+// connected peers have each piece and hands out the rarest piece the peer
+// can give us, so pieces that could disappear from the swarm get fetched
+// first. Ties are broken at random so that peers don't all go after the
+// same piece.
+//
+// Once every piece we need has been handed out, the picker goes into
+// endgame mode and lets peers join pieces that others are downloading, so
+// the last few pieces don't wait on the slowest peers.
+type picker struct {
+	mu           sync.Mutex
+	availability []int
+	state        []pieceState
+	wanted       int
+	active       map[int]*activePiece
+	pieceLength  func(int) int
+	// wake is closed, and replaced, whenever a peer might find something
+	// new to download: a piece going back to being wanted, or endgame
+	// mode starting
+	wake chan struct{}
+}
+
+func newPicker(numPieces int, pieceLength func(int) int) *picker {
+	return &picker{
+		availability: make([]int, numPieces),
+		state:        make([]pieceState, numPieces),
+		wanted:       numPieces,
+		active:       map[int]*activePiece{},
+		pieceLength:  pieceLength,
+		wake:         make(chan struct{}),
+	}
+}
+
+// addPeer counts the pieces in a newly connected peer's bitfield
+func (p *picker) addPeer(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.availability {
+		if bf.HasPiece(i) {
+			p.availability[i]++
+		}
+	}
+}
+
+// removePeer stops counting the pieces of a peer that went away
+func (p *picker) removePeer(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.availability {
+		if bf.HasPiece(i) {
+			p.availability[i]--
+		}
+	}
+}
+
+// peerHas counts a piece a peer announced with a have message
+func (p *picker) peerHas(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// interesting is true if the peer has a piece we haven't finished yet
+func (p *picker) interesting(bf bitfield.Bitfield) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, state := range p.state {
+		if state != pieceDone && bf.HasPiece(i) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pick returns the rarest wanted piece in bf, ready to download. The first
+// wanted piece in prefer, like one the peer suggested, beats rarity. In
+// endgame mode it returns a piece someone else is downloading instead. It
+// returns false if the peer has nothing we can start on right now.
+func (p *picker) pick(bf bitfield.Bitfield, prefer []int) (*activePiece, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.wanted == 0 {
+		return p.pickEndgame(bf)
+	}
+
+	best := -1
+
+	for _, i := range prefer {
+		if i >= 0 && i < len(p.state) && p.state[i] == pieceWanted && bf.HasPiece(i) {
+			best = i
+			break
+		}
+	}
+
+	if best == -1 {
+		best = p.rarest(bf)
+	}
+
+	if best == -1 {
+		return nil, false
+	}
+
+	piece := newActivePiece(best, p.pieceLength(best))
+	piece.downloaders = 1
+
+	p.state[best] = pieceInProgress
+	p.active[best] = piece
+	p.wanted--
+
+	if p.wanted == 0 {
+		log.Println("Every piece has been requested, starting endgame")
+		p.notify()
+	}
+
+	return piece, true
+}
+
+// rarest returns the wanted piece in bf the fewest peers have, or -1 if
+// there isn't one
+func (p *picker) rarest(bf bitfield.Bitfield) int {
+	best := -1
+	ties := 0
+
+	for i, state := range p.state {
+		if state != pieceWanted || !bf.HasPiece(i) {
+			continue
+		}
+
+		switch {
+		case best == -1 || p.availability[i] < p.availability[best]:
+			best = i
+			ties = 1
+		case p.availability[i] == p.availability[best]:
+			// Every piece tied for rarest ends up picked with equal chance
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+
+	return best
+}
+
+// pickEndgame returns the in progress piece in bf with the fewest peers
+// downloading it
+func (p *picker) pickEndgame(bf bitfield.Bitfield) (*activePiece, bool) {
+	var best *activePiece
+	ties := 0
+
+	for index, piece := range p.active {
+		if p.state[index] != pieceInProgress || !bf.HasPiece(index) {
+			continue
+		}
+
+		switch {
+		case best == nil || piece.downloaders < best.downloaders:
+			best = piece
+			ties = 1
+		case piece.downloaders == best.downloaders:
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = piece
+			}
+		}
+	}
+
+	if best == nil {
+		return nil, false
+	}
+
+	best.downloaders++
+
+	return best, true
+}
+
+// leave is called when a peer stops downloading a piece, whether it
+// finished or failed. A piece nobody is downloading anymore goes back up
+// for grabs unless it was finished.
+func (p *picker) leave(piece *activePiece, c *client.Client) {
+	piece.forget(c)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	piece.downloaders--
+
+	// A piece that failed its hash check has already been replaced
+	if piece.downloaders > 0 || p.active[piece.index] != piece {
+		return
+	}
+
+	delete(p.active, piece.index)
+
+	if p.state[piece.index] == pieceInProgress {
+		p.state[piece.index] = pieceWanted
+		p.wanted++
+		p.notify()
+	}
+}
+
+// finish marks a piece as downloaded
+func (p *picker) finish(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.state[index] == pieceWanted {
+		p.wanted--
+	}
+
+	p.state[index] = pieceDone
+}
+
+// retry puts a piece that failed its hash check back up for grabs. The
+// blocks we got are thrown away, the next peer starts over.
+func (p *picker) retry(piece *activePiece) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.active[piece.index] == piece {
+		delete(p.active, piece.index)
+	}
+
+	if p.state[piece.index] != pieceWanted {
+		p.state[piece.index] = pieceWanted
+		p.wanted++
+		p.notify()
+	}
+}
+
+// changed returns a channel that's closed the next time there might be
+// something new to download
+func (p *picker) changed() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.wake
+}
+
+func (p *picker) notify() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
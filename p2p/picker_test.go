@@ -0,0 +1,204 @@
+package p2p
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/bitfield"
+	"github.com/copperwall/bittorrent-go/client"
+	"github.com/copperwall/bittorrent-go/message"
+)
+
+// fullBitfield has every one of n pieces
+func fullBitfield(n int) bitfield.Bitfield {
+	bf := make(bitfield.Bitfield, (n+7)/8)
+	for i := 0; i < n; i++ {
+		bf.SetPiece(i)
+	}
+
+	return bf
+}
+
+func bitfieldOf(n int, pieces ...int) bitfield.Bitfield {
+	bf := make(bitfield.Bitfield, (n+7)/8)
+	for _, i := range pieces {
+		bf.SetPiece(i)
+	}
+
+	return bf
+}
+
+func testPicker(n int) *picker {
+	return newPicker(n, func(int) int { return MaxBlockSize })
+}
+
+func TestPickRarestFirst(t *testing.T) {
+	p := testPicker(4)
+	p.addPeer(fullBitfield(4))
+	p.addPeer(bitfieldOf(4, 0, 1, 3))
+	p.addPeer(bitfieldOf(4, 0, 3))
+
+	// Piece 2 is only on one peer, then piece 1 on two
+	for _, want := range []int{2, 1} {
+		piece, ok := p.pick(fullBitfield(4), nil)
+		if !ok || piece.index != want {
+			t.Fatalf("Expected piece %d, got %v", want, piece)
+		}
+	}
+}
+
+func TestPickPrefers(t *testing.T) {
+	p := testPicker(4)
+	p.addPeer(bitfieldOf(4, 0))
+	p.addPeer(fullBitfield(4))
+
+	// The peer suggested 3, which it has, and 1, which it doesn't
+	piece, ok := p.pick(bitfieldOf(4, 0, 2, 3), []int{1, 3})
+	if !ok || piece.index != 3 {
+		t.Fatalf("Expected the suggested piece 3, got %v", piece)
+	}
+
+	// Pieces that are already taken aren't preferred
+	piece, ok = p.pick(bitfieldOf(4, 0, 2, 3), []int{3})
+	if !ok || piece.index != 2 {
+		t.Fatalf("Expected piece 2, got %v", piece)
+	}
+}
+
+func TestPickSkipsUnavailable(t *testing.T) {
+	p := testPicker(3)
+	p.finish(1)
+
+	if piece, ok := p.pick(bitfieldOf(3, 1), nil); ok {
+		t.Fatalf("Picked piece %d, which is already done", piece.index)
+	}
+}
+
+// testTorrent is a torrent of n single block pieces, ready to download
+func testTorrent(n int) *Torrent {
+	t := &Torrent{
+		PieceHashes: make([][20]byte, n),
+		PieceLength: MaxBlockSize,
+		Length:      n * MaxBlockSize,
+		ctx:         context.Background(),
+	}
+	t.picker = newPicker(n, t.calculatePieceSize)
+
+	return t
+}
+
+// testPeer is a connected peer whose side of the connection throws away
+// whatever we send it
+func testPeer(t *testing.T, bf bitfield.Bitfield) *client.Client {
+	ours, theirs := net.Pipe()
+	go io.Copy(ioutil.Discard, theirs)
+
+	t.Cleanup(func() {
+		ours.Close()
+		theirs.Close()
+	})
+
+	return &client.Client{Conn: ours, Choked: true, Bitfield: bf}
+}
+
+func TestPickPieceWhileChoked(t *testing.T) {
+	tor := testTorrent(8)
+	c := testPeer(t, fullBitfield(8))
+	u := newUploader(tor, c)
+
+	// Holding a piece we can't ask for would keep it from everyone else
+	if piece, ok := tor.pickPiece(c, u); ok {
+		t.Fatalf("Picked piece %d while choked", piece.index)
+	}
+
+	u.peerAllows(5)
+
+	piece, ok := tor.pickPiece(c, u)
+	if !ok || piece.index != 5 {
+		t.Fatalf("Expected allowed fast piece 5, got %v", piece)
+	}
+
+	c.Choked = false
+
+	if _, ok := tor.pickPiece(c, u); !ok {
+		t.Fatal("Picked nothing once unchoked")
+	}
+}
+
+func TestChokeGivesPieceBack(t *testing.T) {
+	tor := testTorrent(2)
+	c := testPeer(t, fullBitfield(2))
+	c.Choked = false
+	u := newUploader(tor, c)
+
+	piece, ok := tor.picker.pick(c.Bitfield, nil)
+	if !ok {
+		t.Fatal("Picked nothing")
+	}
+
+	msgs := make(chan readResult, 1)
+	msgs <- readResult{msg: &message.Message{ID: message.MsgChoke}}
+
+	done := make(chan error)
+	go func() {
+		complete, err := tor.attemptDownloadPiece(c, u, piece, msgs)
+		if complete {
+			t.Error("Piece completed without any blocks")
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Kept waiting on the piece after being choked")
+	}
+
+	tor.picker.leave(piece, c)
+
+	// Back up for grabs
+	if again, ok := tor.picker.pick(c.Bitfield, []int{piece.index}); !ok || again.index != piece.index {
+		t.Fatalf("Expected piece %d to be wanted again", piece.index)
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	p := testPicker(2)
+	bf := fullBitfield(2)
+
+	first, _ := p.pick(bf, nil)
+	second, _ := p.pick(bf, nil)
+
+	// Every piece is handed out, so the next peer joins the piece with
+	// the fewest downloaders
+	second.downloaders++
+
+	joined, ok := p.pick(bf, nil)
+	if !ok || joined != first {
+		t.Fatalf("Expected to join piece %d, got %v", first.index, joined)
+	}
+
+	// A piece stays active until its last downloader leaves
+	p.leave(first, nil)
+
+	if again, _ := p.pick(bitfieldOf(2, first.index), nil); again != first {
+		t.Fatalf("Expected piece %d to still be in progress", first.index)
+	}
+
+	p.leave(first, nil)
+	p.leave(first, nil)
+
+	// Nobody's downloading it anymore, so it's wanted again and endgame
+	// is over
+	again, ok := p.pick(bitfieldOf(2, first.index), nil)
+	if !ok || again == first || again.index != first.index {
+		t.Fatalf("Expected a fresh start on piece %d", first.index)
+	}
+}
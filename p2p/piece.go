@@ -0,0 +1,179 @@
+package p2p
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/copperwall/bittorrent-go/client"
+)
+
+// activePiece is a piece that's being downloaded. Its blocks are shared by
+// every peer downloading it, which is normally just one. In endgame mode
+// several peers ask for the same blocks and whichever copy arrives first
+// is kept.
+type activePiece struct {
+	index  int
+	length int
+	// How many peers are downloading the piece. Guarded by the picker.
+	downloaders int
+
+	mu       sync.Mutex
+	buf      []byte
+	received []bool
+	// from is the peer that sent each block, to blame if the piece is bad
+	from      []*client.Client
+	remaining int
+	// pending is the blocks each peer has asked for and not received yet,
+	// by begin offset
+	pending map[*client.Client]map[int]bool
+	// done is closed once every block has arrived
+	done chan struct{}
+}
+
+func newActivePiece(index, length int) *activePiece {
+	numBlocks := (length + MaxBlockSize - 1) / MaxBlockSize
+
+	return &activePiece{
+		index:     index,
+		length:    length,
+		buf:       make([]byte, length),
+		received:  make([]bool, numBlocks),
+		from:      make([]*client.Client, numBlocks),
+		remaining: numBlocks,
+		pending:   map[*client.Client]map[int]bool{},
+		done:      make(chan struct{}),
+	}
+}
+
+func (piece *activePiece) blockLength(begin int) int {
+	if piece.length-begin < MaxBlockSize {
+		return piece.length - begin
+	}
+
+	return MaxBlockSize
+}
+
+// nextRequest picks a block for c to ask for and returns its begin offset
+// and length. Blocks nobody has asked for come first, then blocks other
+// peers are already waiting on, which only happens in endgame mode.
+func (piece *activePiece) nextRequest(c *client.Client) (int, int, bool) {
+	piece.mu.Lock()
+	defer piece.mu.Unlock()
+
+	mine := piece.pending[c]
+	if mine == nil {
+		mine = map[int]bool{}
+		piece.pending[c] = mine
+	}
+
+	duplicate := -1
+
+	for i, got := range piece.received {
+		begin := i * MaxBlockSize
+
+		if got || mine[begin] {
+			continue
+		}
+
+		if !piece.requested(begin) {
+			mine[begin] = true
+			return begin, piece.blockLength(begin), true
+		}
+
+		if duplicate == -1 {
+			duplicate = begin
+		}
+	}
+
+	if duplicate == -1 {
+		return 0, 0, false
+	}
+
+	mine[duplicate] = true
+
+	return duplicate, piece.blockLength(duplicate), true
+}
+
+// requested is true if some peer is waiting on the block at begin
+func (piece *activePiece) requested(begin int) bool {
+	for _, blocks := range piece.pending {
+		if blocks[begin] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// outstanding is how many blocks c has been asked for and not sent yet
+func (piece *activePiece) outstanding(c *client.Client) int {
+	piece.mu.Lock()
+	defer piece.mu.Unlock()
+
+	return len(piece.pending[c])
+}
+
+// receive stores a block c sent us. It returns the other peers that were
+// asked for the same block, so their requests can be cancelled, and
+// whether that was the last block of the piece. Blocks we didn't ask c
+// for, like ones that arrive after a cancel, are ignored.
+func (piece *activePiece) receive(c *client.Client, begin int, block []byte) ([]*client.Client, bool, error) {
+	piece.mu.Lock()
+	defer piece.mu.Unlock()
+
+	if !piece.pending[c][begin] {
+		return nil, false, nil
+	}
+
+	if len(block) != piece.blockLength(begin) {
+		return nil, false, fmt.Errorf("Expected %d bytes at %d of piece #%d, got %d", piece.blockLength(begin), begin, piece.index, len(block))
+	}
+
+	delete(piece.pending[c], begin)
+	copy(piece.buf[begin:], block)
+	piece.received[begin/MaxBlockSize] = true
+	piece.from[begin/MaxBlockSize] = c
+	piece.remaining--
+
+	others := []*client.Client{}
+	for other, blocks := range piece.pending {
+		if blocks[begin] {
+			delete(blocks, begin)
+			others = append(others, other)
+		}
+	}
+
+	complete := piece.remaining == 0
+	if complete {
+		close(piece.done)
+	}
+
+	return others, complete, nil
+}
+
+// forget drops c's outstanding requests, e.g. when it chokes us and throws
+// them away
+func (piece *activePiece) forget(c *client.Client) {
+	piece.mu.Lock()
+	defer piece.mu.Unlock()
+
+	delete(piece.pending, c)
+}
+
+// contributors lists every peer that sent us a block of the piece
+func (piece *activePiece) contributors() []*client.Client {
+	piece.mu.Lock()
+	defer piece.mu.Unlock()
+
+	seen := map[*client.Client]bool{}
+	contributors := []*client.Client{}
+
+	for _, c := range piece.from {
+		if c != nil && !seen[c] {
+			seen[c] = true
+			contributors = append(contributors, c)
+		}
+	}
+
+	return contributors
+}
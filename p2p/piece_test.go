@@ -0,0 +1,75 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/copperwall/bittorrent-go/client"
+)
+
+func TestNextRequestDuplicates(t *testing.T) {
+	piece := newActivePiece(0, 2*MaxBlockSize)
+	a, b := &client.Client{}, &client.Client{}
+
+	begin, length, _ := piece.nextRequest(a)
+	if begin != 0 || length != MaxBlockSize {
+		t.Fatalf("Expected the first block, got %d bytes at %d", length, begin)
+	}
+
+	// b gets the block nobody asked for before doubling up
+	if begin, _, _ := piece.nextRequest(b); begin != MaxBlockSize {
+		t.Fatalf("Expected the second block, got %d", begin)
+	}
+
+	if begin, _, _ := piece.nextRequest(b); begin != 0 {
+		t.Fatalf("Expected a duplicate of the first block, got %d", begin)
+	}
+
+	if _, _, ok := piece.nextRequest(b); ok {
+		t.Fatal("Asked b for a block twice")
+	}
+}
+
+func TestReceiveCancelsDuplicates(t *testing.T) {
+	piece := newActivePiece(0, MaxBlockSize+100)
+	a, b := &client.Client{}, &client.Client{}
+
+	piece.nextRequest(a)
+	piece.nextRequest(a)
+	piece.nextRequest(b)
+
+	block := bytes.Repeat([]byte{7}, MaxBlockSize)
+
+	others, complete, err := piece.receive(a, 0, block)
+	if err != nil || complete {
+		t.Fatalf("Got complete %v, error %v", complete, err)
+	}
+
+	if len(others) != 1 || others[0] != b {
+		t.Fatalf("Expected to cancel b's request, got %v", others)
+	}
+
+	// b's copy turns up anyway
+	if others, _, _ := piece.receive(b, 0, block); others != nil {
+		t.Fatalf("Expected b's late block to be ignored, got %v", others)
+	}
+
+	if _, _, err := piece.receive(a, MaxBlockSize, block[:99]); err == nil {
+		t.Fatal("Accepted a block of the wrong length")
+	}
+
+	_, complete, err = piece.receive(a, MaxBlockSize, block[:100])
+	if err != nil || !complete {
+		t.Fatalf("Got complete %v, error %v", complete, err)
+	}
+
+	select {
+	case <-piece.done:
+	default:
+		t.Fatal("done wasn't closed")
+	}
+
+	if contributors := piece.contributors(); len(contributors) != 1 || contributors[0] != a {
+		t.Fatalf("Expected a to be the only contributor, got %v", contributors)
+	}
+}
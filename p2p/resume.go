@@ -0,0 +1,154 @@
+package p2p
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/bitfield"
+	"github.com/copperwall/bittorrent-go/storage"
+	"github.com/jackpal/bencode-go"
+)
+
+// ResumeInterval is the most often Download saves its progress to ResumePath
+const ResumeInterval = 30 * time.Second
+
+// resumeFile is what's saved to a fast-resume file, so that a restart can
+// skip hashing every piece on disk
+type resumeFile struct {
+	InfoHash string `bencode:"info hash"`
+	Pieces   string `bencode:"pieces"`
+}
+
+// Resume tells the torrent which pieces are already in storage, from
+// Verify or a resume file, so Download only fetches the rest. Call it
+// before Download.
+func (t *Torrent) Resume(have bitfield.Bitfield) {
+	have = t.sizeBitfield(have)
+	completed := 0
+
+	for i := range t.PieceHashes {
+		if have.HasPiece(i) {
+			completed += t.calculatePieceSize(i)
+		}
+	}
+
+	t.mu.Lock()
+	t.have = have
+	t.mu.Unlock()
+
+	atomic.StoreInt64(&t.completed, int64(completed))
+}
+
+// Verify hashes the pieces already in s, in parallel, and returns the ones
+// that are correct. Pieces that can't be read, like ones past the end of a
+// partly written file, are missing.
+func (t *Torrent) Verify(s storage.Storage) bitfield.Bitfield {
+	have := make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	indexes := make(chan int)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for index := range indexes {
+				ok, err := s.Verify(index, t.PieceHashes[index])
+				if err != nil {
+					log.Printf("Could not check piece #%d: %v\n", index, err)
+				}
+
+				if !ok {
+					continue
+				}
+
+				mu.Lock()
+				have.SetPiece(index)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for index := range t.PieceHashes {
+		indexes <- index
+	}
+
+	close(indexes)
+	wg.Wait()
+
+	return have
+}
+
+// LoadResume reads the pieces saved in a resume file. The file has to be
+// for the torrent with infoHash.
+func LoadResume(path string, infoHash [20]byte) (bitfield.Bitfield, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	rf := resumeFile{}
+	err = bencode.Unmarshal(f, &rf)
+	if err != nil {
+		return nil, err
+	}
+
+	if rf.InfoHash != string(infoHash[:]) {
+		return nil, fmt.Errorf("Resume file %s is for a different torrent", path)
+	}
+
+	return bitfield.Bitfield(rf.Pieces), nil
+}
+
+// SaveResume writes the pieces we have to a resume file. It writes to a
+// temporary file first so that a crash never leaves half a resume file.
+func SaveResume(path string, infoHash [20]byte, have bitfield.Bitfield) error {
+	tempPath := path + ".tmp"
+
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+
+	err = bencode.Marshal(f, resumeFile{
+		InfoHash: string(infoHash[:]),
+		Pieces:   string(have),
+	})
+
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	return os.Rename(tempPath, path)
+}
+
+// saveResume records the pieces we have. The storage is synced first, so
+// the resume file never lists a piece that a crash could still lose.
+func (t *Torrent) saveResume() {
+	have := t.haveBitfield()
+
+	err := t.storage.Sync()
+	if err == nil {
+		err = SaveResume(t.ResumePath, t.InfoHash, have)
+	}
+
+	if err != nil {
+		log.Println("Could not save resume file:", err)
+	}
+}
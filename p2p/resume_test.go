@@ -0,0 +1,145 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/copperwall/bittorrent-go/storage"
+)
+
+func TestResumeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "t.resume")
+	infoHash := [20]byte{1, 2, 3}
+
+	err = SaveResume(path, infoHash, bitfieldOf(10, 0, 9))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have, err := LoadResume(path, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if have.HasPiece(i) != (i == 0 || i == 9) {
+			t.Errorf("Piece %d came back as %v", i, have.HasPiece(i))
+		}
+	}
+
+	if _, err := LoadResume(path, [20]byte{4}); err == nil {
+		t.Error("Loaded a resume file for a different torrent")
+	}
+
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("Left the temporary file behind")
+	}
+}
+
+func TestVerifyAndResume(t *testing.T) {
+	data := make([]byte, 3*MaxBlockSize+10)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	tor := testTorrent(4)
+	tor.Length = len(data)
+
+	for i := range tor.PieceHashes {
+		begin, end := tor.calculateBoundsForPiece(i)
+		tor.PieceHashes[i] = sha1.Sum(data[begin:end])
+	}
+
+	mem := storage.NewMemory(storage.Layout{PieceLength: tor.PieceLength, Length: tor.Length})
+	copy(mem.Bytes(), data)
+
+	// Piece 2 got corrupted
+	mem.Bytes()[2*MaxBlockSize] ^= 0xff
+
+	have := tor.Verify(mem)
+
+	for i := 0; i < 4; i++ {
+		if have.HasPiece(i) != (i != 2) {
+			t.Errorf("Piece %d verified as %v", i, have.HasPiece(i))
+		}
+	}
+
+	tor.Resume(have)
+
+	if left := tor.Left(); left != MaxBlockSize {
+		t.Errorf("Expected %d bytes left, got %d", MaxBlockSize, left)
+	}
+
+	if !tor.hasPiece(3) || tor.hasPiece(2) {
+		t.Error("Resume didn't record the pieces we have")
+	}
+}
+
+// syncStorage is memory storage that calls sync when it's synced
+type syncStorage struct {
+	*storage.Memory
+	sync func() error
+}
+
+func (s syncStorage) Sync() error {
+	return s.sync()
+}
+
+func TestSaveResumeSyncsFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	tor := testTorrent(4)
+	tor.ResumePath = filepath.Join(dir, "t.resume")
+	tor.Resume(bitfieldOf(4, 1))
+
+	synced := false
+	tor.storage = syncStorage{storage.NewMemory(storage.Layout{PieceLength: tor.PieceLength, Length: tor.Length}), func() error {
+		// Nothing is saved until the data is safe
+		if _, err := os.Stat(tor.ResumePath); !os.IsNotExist(err) {
+			t.Error("Resume file was written before syncing")
+		}
+
+		synced = true
+		return nil
+	}}
+
+	tor.saveResume()
+
+	if !synced {
+		t.Fatal("Storage wasn't synced")
+	}
+
+	have, err := LoadResume(tor.ResumePath, tor.InfoHash)
+	if err != nil || !have.HasPiece(1) || have.HasPiece(0) {
+		t.Fatalf("Loaded %v, %v", have, err)
+	}
+
+	// Nothing is saved for data that might not be on disk
+	os.Remove(tor.ResumePath)
+	tor.Resume(bitfieldOf(4, 1, 2))
+	tor.storage = syncStorage{tor.storage.(syncStorage).Memory, func() error {
+		return errors.New("disk gone")
+	}}
+
+	tor.saveResume()
+
+	if _, err := os.Stat(tor.ResumePath); !os.IsNotExist(err) {
+		t.Error("Saved a resume file for data that wasn't synced")
+	}
+}
@@ -0,0 +1,175 @@
+package p2p
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/copperwall/bittorrent-go/bitfield"
+	"github.com/copperwall/bittorrent-go/client"
+	"github.com/copperwall/bittorrent-go/mse"
+)
+
+// Server accepts connections from peers and hands each one to the torrent
+// it asks for, so that we can upload to peers that found us through a tracker.
+type Server struct {
+	PeerID [20]byte
+	// Encryption decides whether peers have to, or may, connect with MSE.
+	// It's set before Serve, the zero value only accepts plaintext.
+	Encryption mse.Policy
+
+	listener net.Listener
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+}
+
+// Listen starts listening for peers on port. Call Serve to start accepting them.
+func Listen(port uint16, peerID [20]byte) (*Server, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		PeerID:   peerID,
+		listener: listener,
+		torrents: map[[20]byte]*Torrent{},
+	}, nil
+}
+
+// Add lets peers connect to us for t
+func (s *Server) Add(t *Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.torrents[t.InfoHash] = t
+
+	if addr, ok := s.listener.Addr().(*net.TCPAddr); ok {
+		t.mu.Lock()
+		t.listenPort = uint16(addr.Port)
+		t.mu.Unlock()
+	}
+}
+
+// Remove stops accepting peers for t. Peers that are already connected
+// stay connected.
+func (s *Server) Remove(t *Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.torrents, t.InfoHash)
+}
+
+// Serve accepts connections until the server is closed
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+
+		if err != nil {
+			return err
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+// Close stops listening
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+func (s *Server) torrent(infoHash [20]byte) *Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.torrents[infoHash]
+
+	// Nothing to serve until the download has storage to read from
+	if t == nil || !t.ready() {
+		return nil
+	}
+
+	return t
+}
+
+// infoHashes lists the torrents peers can connect to us for
+func (s *Server) infoHashes() [][20]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infoHashes := make([][20]byte, 0, len(s.torrents))
+	for infoHash := range s.torrents {
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	return infoHashes
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	// An encrypted handshake only gives us a hash of the info hash, so
+	// it's checked against every torrent we serve
+	encrypted, err := mse.Accept(conn, s.Encryption, s.infoHashes)
+
+	if err != nil {
+		log.Printf("Could not set up encryption with incoming peer %s: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	c, err := client.Accept(encrypted, s.PeerID, func(infoHash [20]byte) bool {
+		return s.torrent(infoHash) != nil
+	})
+
+	if err != nil {
+		log.Printf("Could not handshake with incoming peer %s: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	// Don't talk to ourselves
+	if bytes.Equal(c.RemoteID[:], s.PeerID[:]) {
+		conn.Close()
+		return
+	}
+
+	t := s.torrent(c.InfoHash())
+	if t == nil {
+		conn.Close()
+		return
+	}
+
+	log.Printf("Accepted connection from %s\n", c.Peer())
+	t.handleInbound(c)
+}
+
+// handleInbound talks to a peer that connected to us until it goes away
+func (t *Torrent) handleInbound(c *client.Client) {
+	defer c.Conn.Close()
+
+	// The torrent might insist on encryption even if the server doesn't
+	if t.Encryption == mse.Required && !c.Encrypted() {
+		return
+	}
+
+	if t.isBanned(c.Peer()) || !t.addPeerGoroutine() {
+		return
+	}
+
+	defer t.peerGroup.Done()
+
+	m := t.peerManager()
+	if !m.accept(c) {
+		return
+	}
+
+	defer m.release(c)
+
+	// The peer might not send a bitfield at all if it has nothing yet
+	c.Bitfield = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+
+	t.runPeer(c)
+}
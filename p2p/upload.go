@@ -0,0 +1,386 @@
+package p2p
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/client"
+	"github.com/copperwall/bittorrent-go/message"
+)
+
+// MaxRequestLength is the biggest block a peer can ask us for. Asking for
+// more is a protocol violation and gets the peer disconnected.
+const MaxRequestLength = 128 * 1024
+
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// uploader is the upload side of a single peer connection. It owns our
+// choke state towards the peer and serves the peer's block requests, in
+// the order they arrived, from its own goroutine. It also keeps the
+// transfer statistics the choker ranks peers by.
+type uploader struct {
+	// Bytes received from and sent to this peer. These are first so
+	// they're 64-bit aligned for sync/atomic.
+	downloaded int64
+	uploaded   int64
+	// When we last got a block from the peer, in unix nanoseconds
+	lastBlock int64
+	// Set to 1 while we're interested in the peer
+	amInterested int32
+	// Set to 1 while the peer is choking us
+	peerChoking int32
+	// How many pieces the peer has
+	peerPieces int32
+
+	torrent *Torrent
+	client  *client.Client
+
+	// Only written by the choker. The rates are also read by Stats, so
+	// they're written with mu held.
+	lastDownloaded int64
+	lastUploaded   int64
+	downloadRate   float64
+	uploadRate     float64
+
+	// allowedFast is the pieces a fast peer may download while we're
+	// choking it. It doesn't change once the uploader is made.
+	allowedFast map[int]bool
+
+	// What the peer told us through the fast extension. Only touched by
+	// the goroutine driving the peer. peerAllowedFast is the pieces we
+	// can download while the peer chokes us, suggested the pieces it
+	// hinted we should get next, most recent last, and refused the
+	// pieces it rejected our requests for since it last unchoked us.
+	peerAllowedFast map[int]bool
+	suggested       []int
+	refused         map[int]bool
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []blockRequest
+	closed bool
+}
+
+func newUploader(t *Torrent, c *client.Client) *uploader {
+	u := &uploader{
+		torrent:         t,
+		client:          c,
+		lastBlock:       time.Now().UnixNano(),
+		peerChoking:     1,
+		allowedFast:     map[int]bool{},
+		peerAllowedFast: map[int]bool{},
+		refused:         map[int]bool{},
+	}
+	u.cond = sync.NewCond(&u.mu)
+
+	if c.SupportsFast() {
+		for _, index := range allowedFastSet(c.Peer().IP, t.InfoHash, len(t.PieceHashes), allowedFastCount) {
+			u.allowedFast[index] = true
+		}
+	}
+
+	return u
+}
+
+// handleMessage deals with the messages that are about uploading. Other
+// messages are ignored.
+func (u *uploader) handleMessage(msg *message.Message) error {
+	switch msg.ID {
+	case message.MsgInterested:
+		u.mu.Lock()
+		u.client.PeerInterested = true
+		u.mu.Unlock()
+
+		// There might be a free slot, no need to wait for the next rechoke
+		u.torrent.rechokeSoon()
+	case message.MsgNotInterested:
+		u.mu.Lock()
+		u.client.PeerInterested = false
+		u.mu.Unlock()
+
+		u.torrent.rechokeSoon()
+	case message.MsgRequest:
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+
+		if length <= 0 || length > MaxRequestLength {
+			return fmt.Errorf("Peer requested a block of %d bytes", length)
+		}
+
+		u.request(blockRequest{index, begin, length})
+	case message.MsgCancel:
+		index, begin, length, err := message.ParseCancel(msg)
+		if err != nil {
+			return err
+		}
+
+		u.cancel(blockRequest{index, begin, length})
+	}
+
+	return nil
+}
+
+func (u *uploader) request(req blockRequest) {
+	fast := u.client.SupportsFast()
+	// A fast peer gets told no rather than disconnected for asking for a
+	// piece we don't have
+	missing := fast && !u.torrent.hasPiece(req.index)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return
+	}
+
+	// Requests while choked are dropped, the peer should know better.
+	// Fast peers can still get their allowed fast pieces, and hear back
+	// about the rest.
+	if missing || u.client.AmChoking && !u.allowedFast[req.index] {
+		if fast {
+			u.client.SendReject(req.index, req.begin, req.length)
+		}
+
+		return
+	}
+
+	u.queue = append(u.queue, req)
+	u.cond.Signal()
+}
+
+// cancel drops a request that hasn't been sent yet. Fast peers expect
+// either the block or a reject for every request, so they get a reject.
+func (u *uploader) cancel(req blockRequest) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for i, queued := range u.queue {
+		if queued == req {
+			u.queue = append(u.queue[:i], u.queue[i+1:]...)
+
+			if u.client.SupportsFast() {
+				u.client.SendReject(req.index, req.begin, req.length)
+			}
+
+			return
+		}
+	}
+}
+
+// peerAllows records an AllowedFast from the peer
+func (u *uploader) peerAllows(index int) {
+	u.peerAllowedFast[index] = true
+}
+
+// suggest records a Suggest from the peer. Only the latest maxSuggestions
+// are kept.
+func (u *uploader) suggest(index int) {
+	for i, suggested := range u.suggested {
+		if suggested == index {
+			u.suggested = append(u.suggested[:i], u.suggested[i+1:]...)
+			break
+		}
+	}
+
+	u.suggested = append(u.suggested, index)
+
+	if len(u.suggested) > maxSuggestions {
+		u.suggested = u.suggested[1:]
+	}
+}
+
+// suggestions lists the pieces the peer suggested, most recent first
+func (u *uploader) suggestions() []int {
+	suggestions := make([]int, 0, len(u.suggested))
+
+	for i := len(u.suggested) - 1; i >= 0; i-- {
+		suggestions = append(suggestions, u.suggested[i])
+	}
+
+	return suggestions
+}
+
+func (u *uploader) interested() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.client.PeerInterested
+}
+
+func (u *uploader) setAmInterested(interested bool) {
+	value := int32(0)
+	if interested {
+		value = 1
+	}
+
+	atomic.StoreInt32(&u.amInterested, value)
+}
+
+func (u *uploader) setPeerChoking(choking bool) {
+	value := int32(0)
+	if choking {
+		value = 1
+	}
+
+	atomic.StoreInt32(&u.peerChoking, value)
+}
+
+func (u *uploader) setPeerPieces(n int) {
+	atomic.StoreInt32(&u.peerPieces, int32(n))
+}
+
+// pieces is how many pieces the peer has
+func (u *uploader) pieces() int {
+	return int(atomic.LoadInt32(&u.peerPieces))
+}
+
+// recordDownload counts a block the peer sent us
+func (u *uploader) recordDownload(n int) {
+	atomic.AddInt64(&u.downloaded, int64(n))
+	atomic.StoreInt64(&u.lastBlock, time.Now().UnixNano())
+}
+
+// snubbed is true when we want something from the peer but it hasn't sent
+// us a block in a long time
+func (u *uploader) snubbed() bool {
+	if atomic.LoadInt32(&u.amInterested) == 0 {
+		return false
+	}
+
+	lastBlock := time.Unix(0, atomic.LoadInt64(&u.lastBlock))
+	return time.Since(lastBlock) > SnubTimeout
+}
+
+func (u *uploader) unchoke() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.client.AmChoking {
+		return nil
+	}
+
+	u.client.AmChoking = false
+	return u.client.SendUnchoke()
+}
+
+// choke stops uploading to the peer. Any requests still queued are thrown
+// away, the peer has to ask again once it's unchoked. A fast peer keeps
+// its requests for allowed fast pieces and is sent a reject for the rest.
+func (u *uploader) choke() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.client.AmChoking {
+		return nil
+	}
+
+	u.client.AmChoking = true
+
+	err := u.client.SendChoke()
+	if err != nil || !u.client.SupportsFast() {
+		u.queue = nil
+		return err
+	}
+
+	kept := []blockRequest{}
+	for _, req := range u.queue {
+		if u.allowedFast[req.index] {
+			kept = append(kept, req)
+			continue
+		}
+
+		err = u.client.SendReject(req.index, req.begin, req.length)
+		if err != nil {
+			break
+		}
+	}
+
+	u.queue = kept
+
+	return err
+}
+
+func (u *uploader) close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closed = true
+	u.queue = nil
+	u.cond.Broadcast()
+}
+
+// next blocks until there's a request to serve. It returns false once the
+// uploader is closed.
+func (u *uploader) next() (blockRequest, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for len(u.queue) == 0 && !u.closed {
+		u.cond.Wait()
+	}
+
+	if u.closed {
+		return blockRequest{}, false
+	}
+
+	req := u.queue[0]
+	u.queue = u.queue[1:]
+
+	return req, true
+}
+
+func (u *uploader) run() {
+	for {
+		req, ok := u.next()
+		if !ok {
+			return
+		}
+
+		err := u.serve(req)
+		if err != nil {
+			log.Printf("Could not upload to %s: %v\n", u.client.Peer(), err)
+			u.client.Conn.Close()
+			return
+		}
+	}
+}
+
+// serve reads a block from storage and sends it to the peer
+func (u *uploader) serve(req blockRequest) error {
+	t := u.torrent
+
+	if !t.hasPiece(req.index) {
+		return fmt.Errorf("Peer requested piece #%d, which we don't have", req.index)
+	}
+
+	pieceLength := t.calculatePieceSize(req.index)
+	if req.begin < 0 || req.begin+req.length > pieceLength {
+		return fmt.Errorf("Peer requested %d bytes at %d, past the end of piece #%d", req.length, req.begin, req.index)
+	}
+
+	block := make([]byte, req.length)
+
+	err := t.storage.ReadBlock(req.index, req.begin, block)
+	if err != nil {
+		return err
+	}
+
+	err = u.client.SendPiece(req.index, req.begin, block)
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&t.uploaded, int64(len(block)))
+	atomic.AddInt64(&u.uploaded, int64(len(block)))
+
+	return nil
+}
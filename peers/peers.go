@@ -11,6 +11,8 @@ import (
 type Peer struct {
 	IP net.IP
 	Port uint16
+	// ID is the peer's ID if the tracker told us, otherwise all zeros
+	ID [20]byte
 }
 
 func (p Peer) String() string {
@@ -18,8 +20,19 @@ func (p Peer) String() string {
 }
 
 // Unmarshal parses a buffer into a slice of Peer structs
+// Each peer is 4 bytes of IPv4 address and 2 bytes of port
 func Unmarshal(peersBin []byte) ([]Peer, error) {
-	const peerSize = 6
+	return unmarshal(peersBin, net.IPv4len)
+}
+
+// Unmarshal6 parses a buffer of IPv6 peers (BEP 7)
+// Each peer is 16 bytes of IPv6 address and 2 bytes of port
+func Unmarshal6(peersBin []byte) ([]Peer, error) {
+	return unmarshal(peersBin, net.IPv6len)
+}
+
+func unmarshal(peersBin []byte, ipLen int) ([]Peer, error) {
+	peerSize := ipLen + 2
 	numPeers := len(peersBin) / peerSize
 	if len(peersBin) % peerSize != 0 {
 		err := fmt.Errorf("Received malformed peers")
@@ -32,9 +45,55 @@ func Unmarshal(peersBin []byte) ([]Peer, error) {
 	peers := make([]Peer, numPeers)
 	for i := 0; i < numPeers; i++ {
 		offset := i * peerSize
-		peers[i].IP = net.IP(peersBin[offset : offset + 4])
-		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset + 4 : offset + 6]))
+		// Copy the address so the peer doesn't hang on to the whole buffer
+		peers[i].IP = make(net.IP, ipLen)
+		copy(peers[i].IP, peersBin[offset : offset + ipLen])
+		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset + ipLen : offset + peerSize]))
 	}
 
 	return peers, nil
 }
+
+// Marshal packs the IPv4 peers in ps into the compact format Unmarshal
+// reads. Other peers are left out.
+func Marshal(ps []Peer) []byte {
+	return marshal(ps, net.IPv4len)
+}
+
+// Marshal6 packs the IPv6 peers in ps into the compact format Unmarshal6
+// reads. Other peers are left out.
+func Marshal6(ps []Peer) []byte {
+	return marshal(ps, net.IPv6len)
+}
+
+func marshal(ps []Peer, ipLen int) []byte {
+	buf := make([]byte, 0, len(ps) * (ipLen + 2))
+
+	for _, p := range ps {
+		ip := p.IP.To4()
+		if ipLen == net.IPv6len {
+			if ip != nil {
+				continue
+			}
+			ip = p.IP.To16()
+		}
+
+		if ip == nil {
+			continue
+		}
+
+		buf = append(buf, ip...)
+		buf = append(buf, byte(p.Port >> 8), byte(p.Port))
+	}
+
+	return buf
+}
+
+// Network is the network to dial the peer on, "tcp4" or "tcp6"
+func (p Peer) Network() string {
+	if p.IP.To4() != nil {
+		return "tcp4"
+	}
+
+	return "tcp6"
+}
@@ -0,0 +1,109 @@
+package peers
+
+import (
+	"net"
+	"testing"
+)
+
+func TestUnmarshal6(t *testing.T) {
+	packed := []byte{
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x1a, 0xe1,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x00, 0x01,
+	}
+
+	got, err := Unmarshal6(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkPeers(t, "IPv6", got, []Peer{
+		{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+		{IP: net.ParseIP("::1"), Port: 1},
+	})
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	v4 := []Peer{
+		{IP: net.IPv4(10, 0, 0, 1), Port: 6881},
+		{IP: net.IPv4(192, 168, 1, 2).To4(), Port: 65535},
+	}
+	v6 := []Peer{
+		{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+		{IP: net.ParseIP("::1"), Port: 1},
+	}
+	mixed := append(append([]Peer{}, v4...), v6...)
+
+	// Each form only takes its own family
+	got, err := Unmarshal(Marshal(mixed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkPeers(t, "IPv4", got, v4)
+
+	got, err = Unmarshal6(Marshal6(mixed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkPeers(t, "IPv6", got, v6)
+
+	if n := len(Marshal6(v4)); n != 0 {
+		t.Errorf("Marshal6 packed %d bytes of IPv4 peers", n)
+	}
+}
+
+func checkPeers(t *testing.T, name string, got, want []Peer) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("%s: Got %v, expected %v", name, got, want)
+	}
+
+	for i := range got {
+		if !got[i].IP.Equal(want[i].IP) || got[i].Port != want[i].Port {
+			t.Errorf("%s: Got %s, expected %s", name, got[i], want[i])
+		}
+	}
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	if _, err := Unmarshal(make([]byte, 7)); err == nil {
+		t.Error("Unmarshal took 7 bytes")
+	}
+
+	if _, err := Unmarshal6(make([]byte, 6)); err == nil {
+		t.Error("Unmarshal6 took an IPv4 peer")
+	}
+}
+
+func TestIPv6Address(t *testing.T) {
+	p := Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}
+
+	if p.String() != "[2001:db8::1]:6881" || p.Network() != "tcp6" {
+		t.Errorf("Got %s on %s", p, p.Network())
+	}
+
+	v4 := Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	if v4.String() != "10.0.0.1:6881" || v4.Network() != "tcp4" {
+		t.Errorf("Got %s on %s", v4, v4.Network())
+	}
+}
+
+func TestDialIPv6(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("No IPv6 loopback:", err)
+	}
+
+	defer l.Close()
+
+	p := Peer{IP: net.IPv6loopback, Port: uint16(l.Addr().(*net.TCPAddr).Port)}
+
+	conn, err := net.Dial(p.Network(), p.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+}
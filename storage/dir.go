@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Dir stores a multi-file torrent as a tree of files under a root
+// directory. Pieces don't care about file boundaries, so a single block can
+// be split across several files.
+type Dir struct {
+	blocks
+	files []File
+	fds   []*os.File
+}
+
+// OpenDir creates (or opens) every file under root, creating any
+// directories along the way. Existing data is kept.
+func OpenDir(root string, layout Layout) (*Dir, error) {
+	d := &Dir{
+		files: layout.Files,
+		fds:   make([]*os.File, len(layout.Files)),
+	}
+	d.blocks = blocks{layout, dirData{d}}
+
+	for i, f := range layout.Files {
+		path := filepath.Join(append([]string{root}, f.Path...)...)
+
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+
+		fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+
+		d.fds[i] = fd
+	}
+
+	return d, nil
+}
+
+// MarkComplete does nothing, the data is already in the files
+func (d *Dir) MarkComplete(index int) error {
+	return nil
+}
+
+// Sync flushes every file
+func (d *Dir) Sync() error {
+	for _, fd := range d.fds {
+		err := fd.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes every open file
+func (d *Dir) Close() error {
+	var firstErr error
+
+	for _, fd := range d.fds {
+		if fd == nil {
+			continue
+		}
+
+		err := fd.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// dirData is the offset based view of Dir
+type dirData struct {
+	d *Dir
+}
+
+// WriteAt writes buf at offset off of the torrent, splitting it between
+// every file that the range [off, off + len(buf)) touches.
+func (dd dirData) WriteAt(buf []byte, off int64) (int, error) {
+	written := 0
+
+	for i, f := range dd.d.files {
+		fileBegin := int64(f.Offset)
+		fileEnd := fileBegin + int64(f.Length)
+		pos := off + int64(written)
+
+		// Skip files that end before the current position
+		if fileEnd <= pos || f.Length == 0 {
+			continue
+		}
+
+		if written == len(buf) {
+			break
+		}
+
+		// Only write as much as fits in this file
+		chunk := buf[written:]
+		if int64(len(chunk)) > fileEnd-pos {
+			chunk = chunk[:fileEnd-pos]
+		}
+
+		n, err := dd.d.fds[i].WriteAt(chunk, pos-fileBegin)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if written != len(buf) {
+		return written, fmt.Errorf("Write of %d bytes at offset %d is past the end of the torrent", len(buf), off)
+	}
+
+	return written, nil
+}
+
+// ReadAt reads len(buf) bytes of the torrent at offset off, gathering them
+// from every file the range touches.
+func (dd dirData) ReadAt(buf []byte, off int64) (int, error) {
+	read := 0
+
+	for i, f := range dd.d.files {
+		fileBegin := int64(f.Offset)
+		fileEnd := fileBegin + int64(f.Length)
+		pos := off + int64(read)
+
+		if fileEnd <= pos || f.Length == 0 {
+			continue
+		}
+
+		if read == len(buf) {
+			break
+		}
+
+		chunk := buf[read:]
+		if int64(len(chunk)) > fileEnd-pos {
+			chunk = chunk[:fileEnd-pos]
+		}
+
+		n, err := dd.d.fds[i].ReadAt(chunk, pos-fileBegin)
+		read += n
+
+		if err != nil {
+			return read, err
+		}
+	}
+
+	if read != len(buf) {
+		return read, io.EOF
+	}
+
+	return read, nil
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"os"
+)
+
+// SingleFile stores a single file torrent in one file on disk
+type SingleFile struct {
+	blocks
+	f *os.File
+}
+
+// OpenFile opens (or creates) the file at path, keeping whatever is already
+// in it so an interrupted download can pick up where it left off
+func OpenFile(path string, layout Layout) (*SingleFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SingleFile{blocks{layout, f}, f}, nil
+}
+
+// MarkComplete does nothing, the data is already in the file
+func (s *SingleFile) MarkComplete(index int) error {
+	return nil
+}
+
+func (s *SingleFile) Sync() error {
+	return s.f.Sync()
+}
+
+func (s *SingleFile) Close() error {
+	return s.f.Close()
+}
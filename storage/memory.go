@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"io"
+)
+
+// Memory keeps a whole torrent in memory. It's for small torrents, and for
+// services that hand the data on somewhere else once it's complete.
+type Memory struct {
+	blocks
+	buf []byte
+}
+
+// NewMemory allocates room for every byte of the torrent
+func NewMemory(layout Layout) *Memory {
+	buf := make([]byte, layout.Length)
+
+	return &Memory{blocks{layout, memoryData(buf)}, buf}
+}
+
+// Bytes returns the torrent's data. Pieces that haven't been written are
+// zeroes.
+func (m *Memory) Bytes() []byte {
+	return m.buf
+}
+
+func (m *Memory) MarkComplete(index int) error {
+	return nil
+}
+
+// Sync does nothing, there's nothing to flush
+func (m *Memory) Sync() error {
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// memoryData is the offset based view of a buffer holding the whole
+// torrent. Bounds are already checked by blocks.
+type memoryData []byte
+
+func (d memoryData) ReadAt(buf []byte, off int64) (int, error) {
+	n := copy(buf, d[off:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (d memoryData) WriteAt(buf []byte, off int64) (int, error) {
+	return copy(d[off:], buf), nil
+}
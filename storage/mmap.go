@@ -0,0 +1,66 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// Mmap stores a single file torrent in a file that's mapped into memory,
+// so reads and writes don't need a system call each
+type Mmap struct {
+	blocks
+	f   *os.File
+	buf []byte
+}
+
+// OpenMmap opens (or creates) the file at path, grows it to the length of
+// the torrent and maps it. Existing data is kept.
+func OpenMmap(path string, layout Layout) (*Mmap, error) {
+	if layout.Length <= 0 {
+		return nil, ErrMmapEmpty
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Truncate(int64(layout.Length))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	buf, err := syscall.Mmap(int(f.Fd()), 0, layout.Length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Mmap{blocks{layout, memoryData(buf)}, f, buf}, nil
+}
+
+// MarkComplete does nothing, the kernel writes the mapping back to the file
+func (m *Mmap) MarkComplete(index int) error {
+	return nil
+}
+
+// Sync flushes the file. The mapping shares the file's page cache on every
+// platform this builds for, so that includes everything written to it.
+func (m *Mmap) Sync() error {
+	return m.f.Sync()
+}
+
+func (m *Mmap) Close() error {
+	err := syscall.Munmap(m.buf)
+	closeErr := m.f.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
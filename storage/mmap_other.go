@@ -0,0 +1,26 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package storage
+
+// Mmap isn't available on this platform
+type Mmap struct {
+	blocks
+}
+
+// OpenMmap always fails on this platform, use OpenFile instead
+func OpenMmap(path string, layout Layout) (*Mmap, error) {
+	return nil, ErrMmapUnsupported
+}
+
+func (m *Mmap) MarkComplete(index int) error {
+	return nil
+}
+
+func (m *Mmap) Sync() error {
+	return nil
+}
+
+func (m *Mmap) Close() error {
+	return nil
+}
@@ -0,0 +1,133 @@
+// Package storage is where a torrent's pieces live while they're downloaded
+// and seeded. The download engine only deals in blocks of pieces, so data
+// can be kept in files, in memory, or anywhere else that implements Storage.
+package storage
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrMmapUnsupported is returned by OpenMmap on platforms without mmap
+	ErrMmapUnsupported = errors.New("Memory mapped storage isn't supported on this platform")
+	// ErrMmapEmpty is returned by OpenMmap for a torrent with no data, which
+	// can't be mapped
+	ErrMmapEmpty = errors.New("Can't memory map an empty torrent")
+)
+
+// Storage holds the data of a single torrent
+type Storage interface {
+	// ReadBlock fills buf with the data of piece index starting at begin
+	ReadBlock(index, begin int, buf []byte) error
+	// WriteBlock stores block as the data of piece index starting at begin
+	WriteBlock(index, begin int, block []byte) error
+	// MarkComplete is called once a piece has been written and passed its
+	// hash check
+	MarkComplete(index int) error
+	// Verify checks whether the stored piece matches hash. A piece that
+	// can't be read, e.g. because it was never written, doesn't match.
+	Verify(index int, hash [20]byte) (bool, error)
+	// Sync makes sure everything written so far will survive a crash
+	Sync() error
+	Close() error
+}
+
+// File is one file inside of a torrent. Offset is where the file begins
+// within the concatenation of every file in the torrent.
+type File struct {
+	Path   []string
+	Length int
+	Offset int
+}
+
+// Layout is how a torrent's pieces map onto its data
+type Layout struct {
+	PieceLength int
+	Length      int
+	// Files is empty for single file torrents
+	Files []File
+}
+
+// offset returns where a block of a piece begins within the torrent's data
+func (l Layout) offset(index, begin, length int) (int64, error) {
+	pieceBegin := index * l.PieceLength
+	pieceEnd := pieceBegin + l.PieceLength
+
+	if pieceEnd > l.Length {
+		pieceEnd = l.Length
+	}
+
+	if index < 0 || pieceBegin >= l.Length || begin < 0 || pieceBegin+begin+length > pieceEnd {
+		return 0, fmt.Errorf("%d bytes at %d of piece #%d is outside of the torrent", length, begin, index)
+	}
+
+	return int64(pieceBegin + begin), nil
+}
+
+func (l Layout) pieceLength(index int) int {
+	begin := index * l.PieceLength
+	end := begin + l.PieceLength
+
+	if end > l.Length {
+		end = l.Length
+	}
+
+	return end - begin
+}
+
+// readerWriterAt is storage addressed by offset into the whole torrent
+type readerWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// blocks does the piece and block bookkeeping for storage that's addressed
+// by offset, which is everything in this package
+type blocks struct {
+	layout Layout
+	data   readerWriterAt
+}
+
+func (b blocks) ReadBlock(index, begin int, buf []byte) error {
+	off, err := b.layout.offset(index, begin, len(buf))
+	if err != nil {
+		return err
+	}
+
+	_, err = b.data.ReadAt(buf, off)
+
+	return err
+}
+
+func (b blocks) WriteBlock(index, begin int, block []byte) error {
+	off, err := b.layout.offset(index, begin, len(block))
+	if err != nil {
+		return err
+	}
+
+	_, err = b.data.WriteAt(block, off)
+
+	return err
+}
+
+func (b blocks) Verify(index int, hash [20]byte) (bool, error) {
+	if index < 0 || index*b.layout.PieceLength >= b.layout.Length {
+		return false, fmt.Errorf("Piece #%d is outside of the torrent", index)
+	}
+
+	buf := make([]byte, b.layout.pieceLength(index))
+
+	err := b.ReadBlock(index, 0, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return sha1.Sum(buf) == hash, nil
+}
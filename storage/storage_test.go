@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testLayout is three pieces of 10 bytes, the last one short, over files
+// that don't line up with them. The empty file sits on a file boundary
+// inside piece 0, and piece 2 straddles b and c/d.
+var testLayout = Layout{
+	PieceLength: 10,
+	Length:      25,
+	Files: []File{
+		{Path: []string{"a"}, Length: 7, Offset: 0},
+		{Path: []string{"empty"}, Length: 0, Offset: 7},
+		{Path: []string{"b"}, Length: 12, Offset: 7},
+		{Path: []string{"c", "d"}, Length: 6, Offset: 19},
+	},
+}
+
+func testData() []byte {
+	data := make([]byte, testLayout.Length)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+
+	return data
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+// backends opens every kind of storage for testLayout in a fresh directory
+func backends(t *testing.T) map[string]Storage {
+	dir := tempDir(t)
+	single := testLayout
+	single.Files = nil
+
+	all := map[string]Storage{"memory": NewMemory(single)}
+
+	f, err := OpenFile(filepath.Join(dir, "single"), single)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all["file"] = f
+
+	d, err := OpenDir(filepath.Join(dir, "dir"), testLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all["dir"] = d
+
+	m, err := OpenMmap(filepath.Join(dir, "mmap"), single)
+	if err == nil {
+		all["mmap"] = m
+	} else if err != ErrMmapUnsupported {
+		t.Fatal(err)
+	}
+
+	return all
+}
+
+func TestStorageContract(t *testing.T) {
+	data := testData()
+
+	for name, s := range backends(t) {
+		hashes := [][20]byte{}
+		for index := 0; index*10 < len(data); index++ {
+			end := index*10 + 10
+			if end > len(data) {
+				end = len(data)
+			}
+
+			hashes = append(hashes, sha1.Sum(data[index*10:end]))
+		}
+
+		for index, hash := range hashes {
+			ok, err := s.Verify(index, hash)
+			if ok || err != nil {
+				t.Errorf("%s: Piece %d verified %v, %v before being written", name, index, ok, err)
+			}
+		}
+
+		// Blocks of 3 never line up with pieces or files
+		for index := range hashes {
+			length := testLayout.pieceLength(index)
+
+			for begin := 0; begin < length; begin += 3 {
+				end := begin + 3
+				if end > length {
+					end = length
+				}
+
+				err := s.WriteBlock(index, begin, data[index*10+begin:index*10+end])
+				if err != nil {
+					t.Fatalf("%s: Writing %d of piece %d: %v", name, begin, index, err)
+				}
+			}
+
+			err := s.MarkComplete(index)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+
+		for index, hash := range hashes {
+			ok, err := s.Verify(index, hash)
+			if !ok || err != nil {
+				t.Errorf("%s: Piece %d verified %v, %v", name, index, ok, err)
+			}
+
+			ok, _ = s.Verify(index, [20]byte{})
+			if ok {
+				t.Errorf("%s: Piece %d matched the wrong hash", name, index)
+			}
+
+			buf := make([]byte, testLayout.pieceLength(index))
+
+			err = s.ReadBlock(index, 0, buf)
+			if err != nil || !bytes.Equal(buf, data[index*10:index*10+len(buf)]) {
+				t.Errorf("%s: Read piece %d as %v, %v", name, index, buf, err)
+			}
+		}
+
+		// Nothing outside of the torrent, including past the short last
+		// piece
+		outside := []struct{ index, begin, length int }{
+			{-1, 0, 1},
+			{3, 0, 1},
+			{2, 0, 6},
+			{2, 5, 1},
+			{0, -1, 1},
+			{0, 5, 6},
+		}
+
+		for _, o := range outside {
+			if s.WriteBlock(o.index, o.begin, make([]byte, o.length)) == nil {
+				t.Errorf("%s: Wrote %d bytes at %d of piece %d", name, o.length, o.begin, o.index)
+			}
+
+			if s.ReadBlock(o.index, o.begin, make([]byte, o.length)) == nil {
+				t.Errorf("%s: Read %d bytes at %d of piece %d", name, o.length, o.begin, o.index)
+			}
+		}
+
+		if _, err := s.Verify(3, [20]byte{}); err == nil {
+			t.Errorf("%s: Verified a piece past the end", name)
+		}
+
+		if err := s.Sync(); err != nil {
+			t.Errorf("%s: Sync: %v", name, err)
+		}
+
+		err := s.Close()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestDirSplitsBlocks(t *testing.T) {
+	data := testData()
+
+	cases := []struct {
+		name                 string
+		index, begin, length int
+	}{
+		{"inside one file", 0, 1, 4},
+		{"ending on a file boundary", 0, 4, 3},
+		{"starting on a file boundary", 0, 7, 3},
+		{"across the empty file", 0, 5, 5},
+		{"across a piece's files", 1, 5, 5},
+		{"last short piece", 2, 0, 5},
+		{"every file", 0, 0, 10},
+	}
+
+	for _, tc := range cases {
+		root := tempDir(t)
+
+		d, err := OpenDir(root, testLayout)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		off := tc.index*10 + tc.begin
+		want := data[off : off+tc.length]
+
+		err = d.WriteBlock(tc.index, tc.begin, want)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		got := make([]byte, tc.length)
+
+		err = d.ReadBlock(tc.index, tc.begin, got)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: Read back %v, %v", tc.name, got, err)
+		}
+
+		d.Close()
+
+		// Each file holds exactly its part of the block
+		for _, f := range testLayout.Files {
+			contents, err := ioutil.ReadFile(filepath.Join(append([]string{root}, f.Path...)...))
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+
+			for i, b := range contents {
+				pos := f.Offset + i
+				inBlock := pos >= off && pos < off+tc.length
+
+				if inBlock && b != data[pos] || !inBlock && b != 0 {
+					t.Errorf("%s: %s has %d at %d", tc.name, filepath.Join(f.Path...), b, i)
+				}
+			}
+
+			if len(contents) > f.Length {
+				t.Errorf("%s: %s grew to %d bytes", tc.name, filepath.Join(f.Path...), len(contents))
+			}
+		}
+	}
+}
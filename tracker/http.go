@@ -0,0 +1,197 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/peers"
+	"github.com/jackpal/bencode-go"
+)
+
+func buildTrackerURL(u *url.URL, req AnnounceRequest) string {
+	announceURL := *u
+
+	// Build query params
+	params := url.Values{
+		"info_hash":  []string{string(req.InfoHash[:])},
+		"peer_id":    []string{string(req.PeerID[:])},
+		"port":       []string{strconv.Itoa(int(req.Port))},
+		"uploaded":   []string{strconv.FormatInt(req.Uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(req.Downloaded, 10)},
+		"compact":    []string{"1"},
+		"left":       []string{strconv.FormatInt(req.Left, 10)},
+	}
+
+	if req.Event != EventNone {
+		params.Set("event", req.Event.String())
+	}
+
+	if req.TrackerID != "" {
+		params.Set("trackerid", req.TrackerID)
+	}
+
+	if req.IPv6 != nil {
+		params.Set("ipv6", req.IPv6.String())
+	}
+
+	// Append query params to announce base url and return
+	// the stringified version.
+	announceURL.RawQuery = params.Encode()
+	return announceURL.String()
+}
+
+func announceHTTP(ctx context.Context, u *url.URL, req AnnounceRequest) (*AnnounceResponse, error) {
+	url := buildTrackerURL(u, req)
+	c := &http.Client{Timeout: 15 * time.Second}
+
+	log.Println("Asking for peers from tracker at url", url)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(httpReq)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	trackerResp, err := parseHTTPResponse(ctx, resp.Body)
+
+	// Trackers often explain a bad status code with a failure reason, so
+	// only complain about the status if there isn't one.
+	if _, ok := err.(*FailureError); !ok && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Tracker responded with HTTP status %s", resp.Status)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if trackerResp.Warning != "" {
+		log.Printf("Tracker %s warned: %s\n", u.Host, trackerResp.Warning)
+	}
+
+	return trackerResp, nil
+}
+
+// parseHTTPResponse decodes a tracker's response dictionary. Peers can be
+// either the compact string form or a list of dictionaries. ctx bounds
+// looking up peers given by name.
+func parseHTTPResponse(ctx context.Context, r io.Reader) (*AnnounceResponse, error) {
+	decoded, err := bencode.Decode(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Tracker response is not a dictionary")
+	}
+
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, &FailureError{Reason: reason}
+	}
+
+	trackerResp := &AnnounceResponse{
+		Interval:    dictInt(dict, "interval"),
+		MinInterval: dictInt(dict, "min interval"),
+		Seeders:     dictInt(dict, "complete"),
+		Leechers:    dictInt(dict, "incomplete"),
+	}
+
+	trackerResp.Warning, _ = dict["warning message"].(string)
+	trackerResp.TrackerID, _ = dict["tracker id"].(string)
+
+	switch ps := dict["peers"].(type) {
+	case string:
+		trackerResp.Peers, err = peers.Unmarshal([]byte(ps))
+	case []interface{}:
+		trackerResp.Peers, err = parseDictPeers(ctx, ps)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// IPv6 peers always come in the compact form (BEP 7)
+	if ps6, ok := dict["peers6"].(string); ok {
+		v6, err := peers.Unmarshal6([]byte(ps6))
+		if err != nil {
+			return nil, err
+		}
+
+		trackerResp.Peers = append(trackerResp.Peers, v6...)
+	}
+
+	return trackerResp, nil
+}
+
+// parseDictPeers reads the original, non-compact, peer list where each peer
+// is a dictionary of "peer id", "ip" and "port". Peers we can't make sense
+// of are skipped.
+func parseDictPeers(ctx context.Context, list []interface{}) ([]peers.Peer, error) {
+	ps := []peers.Peer{}
+
+	for _, item := range list {
+		dict, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		host, _ := dict["ip"].(string)
+		port := dictInt(dict, "port")
+
+		if port <= 0 || port > 65535 {
+			continue
+		}
+
+		// The ip can be a DNS name as well as an address
+		ip := net.ParseIP(host)
+		if ip == nil {
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			if err != nil || len(addrs) == 0 {
+				continue
+			}
+
+			ip = addrs[0].IP
+		}
+
+		peer := peers.Peer{IP: ip, Port: uint16(port)}
+
+		if id, ok := dict["peer id"].(string); ok && len(id) == len(peer.ID) {
+			copy(peer.ID[:], id)
+		}
+
+		ps = append(ps, peer)
+	}
+
+	return ps, nil
+}
+
+// dictInt reads an integer out of a decoded dictionary, or 0 if it's missing
+func dictInt(dict map[string]interface{}, key string) int {
+	switch v := dict[key].(type) {
+	case int64:
+		return int(v)
+	case uint64:
+		return int(v)
+	default:
+		return 0
+	}
+}
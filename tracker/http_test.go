@@ -0,0 +1,168 @@
+package tracker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseHTTPResponse(t *testing.T) {
+	peerID := strings.Repeat("p", 20)
+	localhost6 := "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+
+	cases := []struct {
+		name     string
+		body     string
+		failure  string
+		want     AnnounceResponse
+		peers    []string
+		peerID   string
+		wantsErr bool
+	}{
+		{
+			name:  "compact peers",
+			body:  "d8:intervali1800e12:min intervali60e8:completei5e10:incompletei2e5:peers6:\x0a\x00\x00\x01\x1a\xe1e",
+			want:  AnnounceResponse{Interval: 1800, MinInterval: 60, Seeders: 5, Leechers: 2},
+			peers: []string{"10.0.0.1:6881"},
+		},
+		{
+			name:    "failure reason",
+			body:    "d14:failure reason12:unregisterede",
+			failure: "unregistered",
+		},
+		{
+			name:  "warning message",
+			body:  "d8:intervali60e5:peers0:15:warning message9:slow downe",
+			want:  AnnounceResponse{Interval: 60, Warning: "slow down"},
+			peers: []string{},
+		},
+		{
+			name: "dictionary peers",
+			// The second peer has no usable port
+			body:   "d5:peersld2:ip8:10.0.0.27:peer id20:" + peerID + "4:porti6882eed2:ip8:10.0.0.34:porti0eeee",
+			peers:  []string{"10.0.0.2:6882"},
+			peerID: peerID,
+		},
+		{
+			name:  "peers6",
+			body:  "d5:peers6:\x0a\x00\x00\x01\x1a\xe16:peers618:" + localhost6 + "\x1a\xe2e",
+			peers: []string{"10.0.0.1:6881", "[::1]:6882"},
+		},
+		{
+			name:  "tracker id",
+			body:  "d5:peers0:10:tracker id3:abce",
+			want:  AnnounceResponse{TrackerID: "abc"},
+			peers: []string{},
+		},
+		{
+			name:     "malformed compact peers",
+			body:     "d5:peers5:abcdee",
+			wantsErr: true,
+		},
+		{
+			name:     "malformed peers6",
+			body:     "d5:peers0:6:peers63:abce",
+			wantsErr: true,
+		},
+		{
+			name:     "not a dictionary",
+			body:     "li1ee",
+			wantsErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		resp, err := parseHTTPResponse(context.Background(), strings.NewReader(tc.body))
+
+		if tc.failure != "" {
+			failure, ok := err.(*FailureError)
+			if !ok || failure.Reason != tc.failure {
+				t.Errorf("%s: Expected failure %q, got %v", tc.name, tc.failure, err)
+			}
+
+			continue
+		}
+
+		if tc.wantsErr {
+			if err == nil {
+				t.Errorf("%s: Expected an error", tc.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+
+		got := *resp
+		got.Peers = nil
+		if got.Interval != tc.want.Interval || got.MinInterval != tc.want.MinInterval ||
+			got.Seeders != tc.want.Seeders || got.Leechers != tc.want.Leechers ||
+			got.Warning != tc.want.Warning || got.TrackerID != tc.want.TrackerID {
+			t.Errorf("%s: Got %+v, expected %+v", tc.name, got, tc.want)
+		}
+
+		if len(resp.Peers) != len(tc.peers) {
+			t.Errorf("%s: Got peers %v, expected %v", tc.name, resp.Peers, tc.peers)
+			continue
+		}
+
+		for i, p := range resp.Peers {
+			if p.String() != tc.peers[i] {
+				t.Errorf("%s: Got peer %s, expected %s", tc.name, p, tc.peers[i])
+			}
+		}
+
+		if tc.peerID != "" && string(resp.Peers[0].ID[:]) != tc.peerID {
+			t.Errorf("%s: Got peer ID %q", tc.name, resp.Peers[0].ID)
+		}
+	}
+}
+
+func TestParseHTTPResponseCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Looking up a peer given by name gives up with the announce
+	_, err := parseHTTPResponse(ctx, strings.NewReader("d5:peersld2:ip16:peer.example.com4:porti6881eeee"))
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestAnnounceHTTPStatus(t *testing.T) {
+	cases := []struct {
+		status  int
+		body    string
+		failure bool
+		ok      bool
+	}{
+		{http.StatusOK, "d8:intervali60e5:peers0:e", false, true},
+		{http.StatusInternalServerError, "d8:intervali60e5:peers0:e", false, false},
+		{http.StatusBadGateway, "<html>down</html>", false, false},
+		// A failure reason explains a bad status better than the status
+		{http.StatusBadRequest, "d14:failure reason12:unregisterede", true, false},
+	}
+
+	for _, tc := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+			w.Write([]byte(tc.body))
+		}))
+
+		u, _ := url.Parse(srv.URL + "/announce")
+		_, err := announceHTTP(context.Background(), u, AnnounceRequest{})
+		srv.Close()
+
+		_, isFailure := err.(*FailureError)
+
+		if tc.ok != (err == nil) || tc.failure != isFailure {
+			t.Errorf("Status %d: Got %v", tc.status, err)
+		}
+	}
+}
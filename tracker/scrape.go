@@ -0,0 +1,160 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// ErrScrapeNotSupported is returned for HTTP trackers whose announce URL
+// doesn't follow the convention that lets us find the scrape URL
+var ErrScrapeNotSupported = errors.New("Tracker does not support scrape")
+
+// ScrapeURL derives the scrape URL from an HTTP announce URL by replacing
+// "announce" at the start of the last path component with "scrape", so
+// http://example.com/x/announce.php becomes http://example.com/x/scrape.php
+func ScrapeURL(announceURL string) (string, error) {
+	u, err := url.Parse(announceURL)
+
+	if err != nil {
+		return "", err
+	}
+
+	dir, file := path.Split(u.Path)
+	if !strings.HasPrefix(file, "announce") {
+		return "", ErrScrapeNotSupported
+	}
+
+	u.Path = dir + "scrape" + strings.TrimPrefix(file, "announce")
+	return u.String(), nil
+}
+
+// Scrape asks the tracker at announceURL how many seeders, leechers and
+// completed downloads each torrent has. The protocol is picked from the
+// URL's scheme, like Announce. UDP trackers get the same short retry budget
+// as they do in Tiers, since the caller is usually working through a list.
+func Scrape(ctx context.Context, announceURL string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	u, err := url.Parse(announceURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(ctx, announceURL, infoHashes)
+	case "udp":
+		return failoverUDPClient.Scrape(ctx, u.Host, infoHashes)
+	default:
+		return nil, fmt.Errorf("Unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+func scrapeHTTP(ctx context.Context, announceURL string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	scrapeURL, err := ScrapeURL(announceURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(scrapeURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	params := u.Query()
+	for _, h := range infoHashes {
+		params.Add("info_hash", string(h[:]))
+	}
+	u.RawQuery = params.Encode()
+
+	c := &http.Client{Timeout: 15 * time.Second}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(httpReq)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	decoded, err := bencode.Decode(resp.Body)
+	dict, _ := decoded.(map[string]interface{})
+
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, &FailureError{Reason: reason}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Tracker responded with HTTP status %s", resp.Status)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	files, ok := dict["files"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Scrape response has no files dictionary")
+	}
+
+	// The files dictionary is keyed by the raw 20 byte info hash. A bad
+	// entry only costs us that torrent's counts.
+	results := map[[20]byte]ScrapeResult{}
+	for key, value := range files {
+		result, ok := parseScrapeFile(value)
+		if !ok || len(key) != 20 {
+			continue
+		}
+
+		var h [20]byte
+		copy(h[:], key)
+
+		results[h] = result
+	}
+
+	return results, nil
+}
+
+// parseScrapeFile reads one torrent's entry in a scrape response. It's
+// false if the entry isn't a dictionary or has a count that isn't a
+// non-negative integer. Missing counts are 0.
+func parseScrapeFile(value interface{}) (ScrapeResult, bool) {
+	file, ok := value.(map[string]interface{})
+	if !ok {
+		return ScrapeResult{}, false
+	}
+
+	counts := [3]int{}
+
+	for i, key := range []string{"complete", "downloaded", "incomplete"} {
+		switch v := file[key].(type) {
+		case nil:
+		case int64:
+			if v < 0 {
+				return ScrapeResult{}, false
+			}
+
+			counts[i] = int(v)
+		case uint64:
+			counts[i] = int(v)
+		default:
+			return ScrapeResult{}, false
+		}
+	}
+
+	return ScrapeResult{Seeders: counts[0], Completed: counts[1], Leechers: counts[2]}, true
+}
@@ -0,0 +1,118 @@
+package tracker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestScrapeURL(t *testing.T) {
+	cases := []struct {
+		announce, scrape string
+	}{
+		{"http://t.example/announce", "http://t.example/scrape"},
+		{"http://t.example/x/announce.php", "http://t.example/x/scrape.php"},
+		{"https://t.example/announce?passkey=abc", "https://t.example/scrape?passkey=abc"},
+		{"http://t.example:8080/announce_v2", "http://t.example:8080/scrape_v2"},
+		{"http://t.example/a", ""},
+		{"http://t.example/announce/x", ""},
+		{"http://t.example/x/notannounce", ""},
+		{"http://t.example", ""},
+	}
+
+	for _, tc := range cases {
+		got, err := ScrapeURL(tc.announce)
+
+		if tc.scrape == "" {
+			if err != ErrScrapeNotSupported {
+				t.Errorf("%s: Expected ErrScrapeNotSupported, got %q, %v", tc.announce, got, err)
+			}
+
+			continue
+		}
+
+		if err != nil || got != tc.scrape {
+			t.Errorf("%s: Got %q, %v, expected %q", tc.announce, got, err, tc.scrape)
+		}
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	good := [20]byte{1}
+	badCount := [20]byte{2}
+	notDict := [20]byte{3}
+	missing := [20]byte{4}
+
+	body := "d5:filesd" +
+		"20:" + string(good[:]) + "d8:completei5e10:downloadedi50e10:incompletei3ee" +
+		"20:" + string(badCount[:]) + "d8:complete4:lotse" +
+		"20:" + string(notDict[:]) + "i5e" +
+		"3:abcd8:completei1ee" +
+		"ee"
+
+	var asked []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		asked = r.URL.Query()["info_hash"]
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	infoHashes := [][20]byte{good, badCount, notDict, missing}
+
+	results, err := Scrape(context.Background(), srv.URL+"/announce", infoHashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(asked) != len(infoHashes) {
+		t.Errorf("Asked for %d info hashes, expected %d", len(asked), len(infoHashes))
+	}
+
+	// The bad entries are skipped rather than spoiling the good one
+	if len(results) != 1 {
+		t.Errorf("Got %d results, expected 1", len(results))
+	}
+
+	if r := results[good]; r.Seeders != 5 || r.Completed != 50 || r.Leechers != 3 {
+		t.Errorf("Got %+v", r)
+	}
+}
+
+func TestScrapeHTTPErrors(t *testing.T) {
+	cases := []struct {
+		status int
+		body   string
+	}{
+		{http.StatusOK, "d14:failure reason6:no waye"},
+		{http.StatusOK, "d8:intervali5ee"},
+		{http.StatusOK, "not bencode"},
+		{http.StatusInternalServerError, "d5:filesdee"},
+	}
+
+	for _, tc := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+			w.Write([]byte(tc.body))
+		}))
+
+		_, err := Scrape(context.Background(), srv.URL+"/announce", [][20]byte{{1}})
+		srv.Close()
+
+		if err == nil {
+			t.Errorf("%d %q: Expected an error", tc.status, tc.body)
+		}
+
+		failure, isFailure := err.(*FailureError)
+		if strings.Contains(tc.body, "failure") && (!isFailure || failure.Reason != "no way") {
+			t.Errorf("%q: Expected a FailureError, got %v", tc.body, err)
+		}
+	}
+}
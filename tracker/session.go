@@ -0,0 +1,236 @@
+package tracker
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/peers"
+)
+
+// DefaultInterval is how long to wait between announces when the tracker
+// doesn't say
+const DefaultInterval = 30 * time.Minute
+
+// RetryInterval is how long to wait after every tracker failed
+const RetryInterval = time.Minute
+
+// StopTimeout is how long Stop waits for trackers to hear that we're leaving
+const StopTimeout = 10 * time.Second
+
+// Session keeps a tracker up to date for the lifetime of a download. It
+// announces when we start, re-announces every interval, and tells the
+// tracker when we complete and when we stop.
+type Session struct {
+	Tiers    *Tiers
+	InfoHash [20]byte
+	PeerID   [20]byte
+	Port     uint16
+	// IPv6 is our IPv6 address to tell trackers about, if we have one
+	IPv6 net.IP
+
+	// Stats reports the byte counters that go in every announce
+	Stats func() (uploaded, downloaded, left int64)
+	// OnPeers is called with the peers from every re-announce
+	OnPeers func([]peers.Peer)
+
+	mu          sync.Mutex
+	minInterval time.Duration
+	// started is set once a tracker has taken our started event
+	started bool
+	running bool
+	// seeding is set if there was nothing left to download when Start was
+	// called, so there's no download to report completed
+	seeding bool
+	// ctx is cancelled by Stop, or by the caller of Start, and aborts any
+	// announce that's in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewSession creates a Session. Nothing is sent until Start is called.
+func NewSession(tiers *Tiers, infoHash, peerID [20]byte, port uint16) *Session {
+	return &Session{
+		Tiers:    tiers,
+		InfoHash: infoHash,
+		PeerID:   peerID,
+		Port:     port,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start sends the started event and returns the peers from it. Re-announcing
+// carries on in the background until Stop or until ctx is cancelled, even if
+// this first announce failed, in which case the started event is sent again
+// until a tracker takes it.
+func (s *Session) Start(ctx context.Context) ([]peers.Peer, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	seeding := false
+	if s.Stats != nil {
+		_, _, left := s.Stats()
+		seeding = left == 0
+	}
+
+	s.mu.Lock()
+	s.ctx = ctx
+	s.cancel = cancel
+	s.running = true
+	s.seeding = seeding
+	s.mu.Unlock()
+
+	resp, err := s.announce(ctx, EventStarted)
+
+	go s.run(ctx, s.nextWait(resp, err))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Peers, nil
+}
+
+// Completed tells the tracker that the download finished. Nothing is sent
+// if the data was already complete when the session started, or if no
+// tracker has heard that we started, since the started event will carry
+// left=0 when it does go out.
+func (s *Session) Completed() {
+	s.mu.Lock()
+	ctx := s.ctx
+	skip := s.seeding || !s.started
+	s.mu.Unlock()
+
+	if skip {
+		return
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	_, err := s.announce(ctx, EventCompleted)
+	if err != nil {
+		log.Println("Could not announce completed:", err)
+	}
+}
+
+// Stop stops re-announcing and tells the tracker we're leaving the swarm
+func (s *Session) Stop() {
+	s.stopOnce.Do(func() {
+		s.mu.Lock()
+		started := s.started
+		running := s.running
+		s.mu.Unlock()
+
+		if running {
+			s.cancel()
+			<-s.done
+		}
+
+		// No point saying goodbye to a tracker that never heard from us
+		if !started {
+			return
+		}
+
+		// Start's context is probably cancelled already, we're shutting down
+		ctx, cancel := context.WithTimeout(context.Background(), StopTimeout)
+		defer cancel()
+
+		_, err := s.announce(ctx, EventStopped)
+		if err != nil {
+			log.Println("Could not announce stopped:", err)
+		}
+	})
+}
+
+func (s *Session) run(ctx context.Context, wait time.Duration) {
+	defer close(s.done)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		s.mu.Lock()
+		event := EventNone
+		if !s.started {
+			event = EventStarted
+		}
+		s.mu.Unlock()
+
+		resp, err := s.announce(ctx, event)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			log.Println("Could not re-announce:", err)
+		} else if s.OnPeers != nil && len(resp.Peers) > 0 {
+			s.OnPeers(resp.Peers)
+		}
+
+		timer.Reset(s.nextWait(resp, err))
+	}
+}
+
+func (s *Session) announce(ctx context.Context, event Event) (*AnnounceResponse, error) {
+	req := AnnounceRequest{
+		InfoHash: s.InfoHash,
+		PeerID:   s.PeerID,
+		Port:     s.Port,
+		Event:    event,
+		IPv6:     s.IPv6,
+	}
+
+	if s.Stats != nil {
+		req.Uploaded, req.Downloaded, req.Left = s.Stats()
+	}
+
+	resp, err := s.Tiers.Announce(ctx, req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if event == EventStarted {
+		s.started = true
+	}
+	s.minInterval = time.Duration(resp.MinInterval) * time.Second
+	s.mu.Unlock()
+
+	return resp, nil
+}
+
+// nextWait is how long until the next regular announce. It's never shorter
+// than the tracker's min interval.
+func (s *Session) nextWait(resp *AnnounceResponse, err error) time.Duration {
+	wait := RetryInterval
+
+	if err == nil {
+		wait = time.Duration(resp.Interval) * time.Second
+		if wait <= 0 {
+			wait = DefaultInterval
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if wait < s.minInterval {
+		wait = s.minInterval
+	}
+
+	return wait
+}
@@ -0,0 +1,62 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// eventRecorder is a tracker that records the event of every announce
+func eventRecorder(t *testing.T) (*standIn, func() []Event) {
+	var mu sync.Mutex
+	events := []Event{}
+
+	s := newStandIn(t, func(s *standIn, packet []byte) [][]byte {
+		if binary.BigEndian.Uint32(packet[8:12]) == actionAnnounce && len(packet) >= 84 {
+			mu.Lock()
+			events = append(events, Event(binary.BigEndian.Uint32(packet[80:84])))
+			mu.Unlock()
+		}
+
+		return tracks(s, packet)
+	})
+
+	return s, func() []Event {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]Event(nil), events...)
+	}
+}
+
+func TestSessionCompleted(t *testing.T) {
+	for _, left := range []int64{0, 100} {
+		s, events := eventRecorder(t)
+
+		tiers := NewTiers([][]string{{"udp://" + s.addr()}})
+		tiers.UDPClient = testClient()
+
+		session := NewSession(tiers, [20]byte{1}, [20]byte{2}, 6881)
+		session.Stats = func() (int64, int64, int64) { return 0, 0, left }
+
+		_, err := session.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		session.Completed()
+		session.Stop()
+
+		// Data that was complete from the start was never downloaded
+		want := []Event{EventStarted, EventStopped}
+		if left > 0 {
+			want = []Event{EventStarted, EventCompleted, EventStopped}
+		}
+
+		if got := events(); !reflect.DeepEqual(got, want) {
+			t.Errorf("With %d bytes left, sent %v, expected %v", left, got, want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrNoTrackers is returned when there's nothing to announce to
+var ErrNoTrackers = errors.New("Torrent has no trackers")
+
+// AttemptTimeout is how long each tracker gets to answer before the next
+// one in the list is tried
+const AttemptTimeout = 15 * time.Second
+
+// failoverUDPClient is shared by every Tiers, and by Scrape, so connection
+// IDs carry over between requests to the same tracker. It gives up much sooner than the
+// spec's hour of retransmissions, within AttemptTimeout, so that a dead
+// tracker doesn't hold up the rest of the list.
+var failoverUDPClient = newFailoverUDPClient()
+
+func newFailoverUDPClient() *UDPClient {
+	c := NewUDPClient()
+	c.Timeout = 5 * time.Second
+	c.MaxRetries = 1
+
+	return c
+}
+
+// Tiers is a multitracker announce list (BEP 12). Trackers are tried tier
+// by tier, in order, and a tracker that answers is moved to the front of
+// its tier so it's the first one tried next time.
+type Tiers struct {
+	// UDPClient is used for udp:// trackers. NewTiers sets it to a client
+	// shared by every Tiers.
+	UDPClient *UDPClient
+
+	mu    sync.Mutex
+	tiers [][]string
+	// Tracker IDs handed out by each tracker, sent back on later announces
+	trackerIDs map[string]string
+}
+
+// NewTiers copies the announce list and shuffles each tier, as the spec asks
+func NewTiers(announceList [][]string) *Tiers {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	tiers := make([][]string, 0, len(announceList))
+
+	for _, tier := range announceList {
+		if len(tier) == 0 {
+			continue
+		}
+
+		shuffled := make([]string, len(tier))
+		copy(shuffled, tier)
+		rng.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+
+		tiers = append(tiers, shuffled)
+	}
+
+	return &Tiers{
+		UDPClient:  failoverUDPClient,
+		tiers:      tiers,
+		trackerIDs: map[string]string{},
+	}
+}
+
+// Announce announces to the first tracker that answers. Each tracker gets
+// AttemptTimeout to do so. The last error is returned if every tracker in
+// every tier fails.
+func (t *Tiers) Announce(ctx context.Context, req AnnounceRequest) (*AnnounceResponse, error) {
+	lastErr := ErrNoTrackers
+
+	for tierIndex, tier := range t.snapshot() {
+		for _, announceURL := range tier {
+			attemptCtx, cancel := context.WithTimeout(ctx, AttemptTimeout)
+			resp, err := t.announce(attemptCtx, announceURL, req)
+			cancel()
+
+			// No point trying the rest
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			if err != nil {
+				log.Printf("Tracker %s failed: %v\n", announceURL, err)
+				lastErr = err
+				continue
+			}
+
+			t.promote(tierIndex, announceURL)
+			return resp, nil
+		}
+	}
+
+	return nil, lastErr
+}
+
+func (t *Tiers) announce(ctx context.Context, announceURL string, req AnnounceRequest) (*AnnounceResponse, error) {
+	u, err := url.Parse(announceURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "udp" {
+		return t.UDPClient.Announce(ctx, u.Host, req)
+	}
+
+	t.mu.Lock()
+	if req.TrackerID == "" {
+		req.TrackerID = t.trackerIDs[announceURL]
+	}
+	t.mu.Unlock()
+
+	resp, err := Announce(ctx, announceURL, req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.TrackerID != "" {
+		t.mu.Lock()
+		t.trackerIDs[announceURL] = resp.TrackerID
+		t.mu.Unlock()
+	}
+
+	return resp, nil
+}
+
+// snapshot copies the tiers so they can be walked without holding the lock
+// during network requests.
+func (t *Tiers) snapshot() [][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tiers := make([][]string, len(t.tiers))
+	for i, tier := range t.tiers {
+		tiers[i] = append([]string(nil), tier...)
+	}
+
+	return tiers
+}
+
+// promote moves a tracker that answered to the front of its tier
+func (t *Tiers) promote(tierIndex int, announceURL string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tier := t.tiers[tierIndex]
+	for i, u := range tier {
+		if u != announceURL {
+			continue
+		}
+
+		copy(tier[1:i+1], tier[0:i])
+		tier[0] = announceURL
+		return
+	}
+}
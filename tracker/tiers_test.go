@@ -0,0 +1,35 @@
+package tracker
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTiersFailover(t *testing.T) {
+	dead := newStandIn(t, func(s *standIn, packet []byte) [][]byte { return nil })
+	alive := newStandIn(t, tracks)
+
+	deadURL := "udp://" + dead.addr() + "/announce"
+	aliveURL := "udp://" + alive.addr() + "/announce"
+
+	tiers := NewTiers([][]string{{deadURL}, {deadURL, aliveURL}})
+	tiers.UDPClient = testClient()
+
+	if tiers.UDPClient == failoverUDPClient || NewTiers(nil).UDPClient != failoverUDPClient {
+		t.Fatal("Expected every Tiers to share one UDP client")
+	}
+
+	resp, err := tiers.Announce(context.Background(), AnnounceRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Peers) != 1 {
+		t.Errorf("Got peers %v", resp.Peers)
+	}
+
+	// The tracker that answered goes first in its tier from now on
+	if first := tiers.snapshot()[1][0]; first != aliveURL {
+		t.Errorf("Expected %s first in the second tier, got %s", aliveURL, first)
+	}
+}
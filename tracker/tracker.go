@@ -0,0 +1,103 @@
+// Package tracker talks to BitTorrent trackers over HTTP and UDP to find peers.
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/copperwall/bittorrent-go/peers"
+)
+
+// Event tells the tracker where we are in the lifecycle of a download.
+// The values match the UDP tracker protocol.
+type Event int
+
+const (
+	EventNone      Event = 0
+	EventCompleted Event = 1
+	EventStarted   Event = 2
+	EventStopped   Event = 3
+)
+
+// String returns the event as it's written in an HTTP announce
+func (e Event) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+// AnnounceRequest is everything we tell a tracker when announcing
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+	// TrackerID is sent back to a tracker that gave us one
+	TrackerID string
+	// IPv6 is our own IPv6 address, so the tracker can hand it out to
+	// IPv6 peers even when we announce over IPv4
+	IPv6 net.IP
+}
+
+// AnnounceResponse is what the tracker tells us back. Interval and
+// MinInterval are in seconds.
+type AnnounceResponse struct {
+	Interval    int
+	MinInterval int
+	Leechers    int
+	Seeders     int
+	Peers       []peers.Peer
+	// Warning is a message from the tracker about an announce that still worked
+	Warning   string
+	TrackerID string
+}
+
+// ScrapeResult is the swarm health of a single torrent
+type ScrapeResult struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+// FailureError is returned when the tracker answers with an error instead of peers
+type FailureError struct {
+	Reason string
+}
+
+func (e *FailureError) Error() string {
+	return fmt.Sprintf("Tracker failed: %s", e.Reason)
+}
+
+// DefaultUDPClient is used for every udp:// announce made through Announce
+var DefaultUDPClient = NewUDPClient()
+
+// Announce asks the tracker at announceURL for peers. The protocol is picked
+// from the URL's scheme.
+func Announce(ctx context.Context, announceURL string, req AnnounceRequest) (*AnnounceResponse, error) {
+	u, err := url.Parse(announceURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return announceHTTP(ctx, u, req)
+	case "udp":
+		return DefaultUDPClient.Announce(ctx, u.Host, req)
+	default:
+		return nil, fmt.Errorf("Unsupported tracker scheme %q", u.Scheme)
+	}
+}
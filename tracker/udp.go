@@ -0,0 +1,342 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/copperwall/bittorrent-go/peers"
+)
+
+// Magic constant that starts every connect request (BEP 15)
+const udpProtocolID = 0x41727101980
+
+const (
+	actionConnect  = 0
+	actionAnnounce = 1
+	actionScrape   = 2
+	actionError    = 3
+)
+
+// A connection ID can be used for a minute after the tracker hands it out
+const connectionIDLifetime = time.Minute
+
+// A single scrape request can hold at most this many info hashes
+const maxScrapeHashes = 74
+
+// ErrUDPTimeout is returned when the tracker never answers, even after
+// every retransmission.
+var ErrUDPTimeout = errors.New("UDP tracker did not respond")
+
+type connectionID struct {
+	id       uint64
+	obtained time.Time
+}
+
+// UDPClient speaks the UDP tracker protocol (BEP 15). It caches connection
+// IDs per tracker so that back to back requests skip the connect step.
+type UDPClient struct {
+	// Timeout is how long to wait for the first response. Each retry
+	// doubles it, so the nth attempt waits Timeout * 2^n.
+	Timeout time.Duration
+	// MaxRetries is the highest n before giving up
+	MaxRetries int
+
+	mu  sync.Mutex
+	ids map[string]connectionID
+	key uint32
+}
+
+// NewUDPClient creates a UDPClient with the timeouts from the spec
+func NewUDPClient() *UDPClient {
+	return &UDPClient{
+		Timeout:    15 * time.Second,
+		MaxRetries: 8,
+		ids:        map[string]connectionID{},
+		key:        randomUint32(),
+	}
+}
+
+// Announce announces to the UDP tracker at host (host:port)
+func (c *UDPClient) Announce(ctx context.Context, host string, req AnnounceRequest) (*AnnounceResponse, error) {
+	conn, err := dialUDP(ctx, host)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	// Everything after the connection ID, action and transaction ID
+	body := make([]byte, 82)
+	copy(body[0:20], req.InfoHash[:])
+	copy(body[20:40], req.PeerID[:])
+	binary.BigEndian.PutUint64(body[40:48], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(body[48:56], uint64(req.Left))
+	binary.BigEndian.PutUint64(body[56:64], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(body[64:68], uint32(req.Event))
+	// IP address of 0 means use the address the packet came from
+	binary.BigEndian.PutUint32(body[68:72], 0)
+	binary.BigEndian.PutUint32(body[72:76], c.key)
+	// num_want of -1 lets the tracker decide
+	binary.BigEndian.PutUint32(body[76:80], 0xFFFFFFFF)
+	binary.BigEndian.PutUint16(body[80:82], req.Port)
+
+	resp, err := c.request(ctx, conn, host, actionAnnounce, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) < 12 {
+		return nil, fmt.Errorf("Announce response is too short: %d bytes", len(resp))
+	}
+
+	// Trackers reached over IPv6 answer with IPv6 peers (BEP 15)
+	unmarshal := peers.Unmarshal
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		unmarshal = peers.Unmarshal6
+	}
+
+	ps, err := unmarshal(resp[12:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &AnnounceResponse{
+		Interval: int(binary.BigEndian.Uint32(resp[0:4])),
+		Leechers: int(binary.BigEndian.Uint32(resp[4:8])),
+		Seeders:  int(binary.BigEndian.Uint32(resp[8:12])),
+		Peers:    ps,
+	}, nil
+}
+
+// Scrape asks the UDP tracker at host for the swarm health of each info hash
+func (c *UDPClient) Scrape(ctx context.Context, host string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	conn, err := dialUDP(ctx, host)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	results := map[[20]byte]ScrapeResult{}
+
+	for len(infoHashes) > 0 {
+		batch := infoHashes
+		if len(batch) > maxScrapeHashes {
+			batch = batch[:maxScrapeHashes]
+		}
+		infoHashes = infoHashes[len(batch):]
+
+		body := make([]byte, 0, 20*len(batch))
+		for _, h := range batch {
+			body = append(body, h[:]...)
+		}
+
+		resp, err := c.request(ctx, conn, host, actionScrape, body)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Results come back in the order we asked for them
+		for i, h := range batch {
+			offset := i * 12
+			if offset+12 > len(resp) {
+				return nil, fmt.Errorf("Scrape response is missing results for %d info hashes", len(batch)-i)
+			}
+
+			results[h] = ScrapeResult{
+				Seeders:   int(binary.BigEndian.Uint32(resp[offset : offset+4])),
+				Completed: int(binary.BigEndian.Uint32(resp[offset+4 : offset+8])),
+				Leechers:  int(binary.BigEndian.Uint32(resp[offset+8 : offset+12])),
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// dialUDP connects a UDP socket to host. The socket is closed if ctx is
+// cancelled, which interrupts whatever request is waiting on it.
+func dialUDP(ctx context.Context, host string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", host)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &cancelConn{Conn: conn, closed: make(chan struct{})}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-cc.closed:
+		}
+	}()
+
+	return cc, nil
+}
+
+// cancelConn is a connection that gets closed when its context is cancelled
+type cancelConn struct {
+	net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (cc *cancelConn) Close() error {
+	cc.closeOnce.Do(func() { close(cc.closed) })
+
+	return cc.Conn.Close()
+}
+
+// request sends an action to the tracker and returns the response after the
+// action and transaction ID. Lost packets are retransmitted with backoff and
+// the connection ID is refreshed whenever it expires.
+func (c *UDPClient) request(ctx context.Context, conn net.Conn, host string, action uint32, body []byte) ([]byte, error) {
+	for n := 0; n <= c.MaxRetries; n++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		id, err := c.connectionID(conn, host, n)
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if isTimeout(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.roundTrip(conn, id, action, body, n)
+
+		// Whatever went wrong, it's because the socket was closed under us
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if isTimeout(err) {
+			continue
+		}
+
+		// The error might be because the tracker forgot our connection ID,
+		// so don't reuse it.
+		if _, ok := err.(*FailureError); ok {
+			c.forget(host)
+		}
+
+		return resp, err
+	}
+
+	return nil, ErrUDPTimeout
+}
+
+// connectionID returns a cached connection ID for host, or connects to get a new one
+func (c *UDPClient) connectionID(conn net.Conn, host string, n int) (uint64, error) {
+	c.mu.Lock()
+	cached, ok := c.ids[host]
+	c.mu.Unlock()
+
+	if ok && time.Since(cached.obtained) < connectionIDLifetime {
+		return cached.id, nil
+	}
+
+	resp, err := c.roundTrip(conn, udpProtocolID, actionConnect, nil, n)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(resp) < 8 {
+		return 0, fmt.Errorf("Connect response is too short: %d bytes", len(resp))
+	}
+
+	id := binary.BigEndian.Uint64(resp[0:8])
+
+	c.mu.Lock()
+	c.ids[host] = connectionID{id: id, obtained: time.Now()}
+	c.mu.Unlock()
+
+	return id, nil
+}
+
+func (c *UDPClient) forget(host string) {
+	c.mu.Lock()
+	delete(c.ids, host)
+	c.mu.Unlock()
+}
+
+// roundTrip sends a single packet and waits Timeout * 2^n for the matching response
+func (c *UDPClient) roundTrip(conn net.Conn, id uint64, action uint32, body []byte, n int) ([]byte, error) {
+	transactionID := randomUint32()
+
+	packet := make([]byte, 16+len(body))
+	binary.BigEndian.PutUint64(packet[0:8], id)
+	binary.BigEndian.PutUint32(packet[8:12], action)
+	binary.BigEndian.PutUint32(packet[12:16], transactionID)
+	copy(packet[16:], body)
+
+	_, err := conn.Write(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(c.Timeout << uint(n)))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 65536)
+
+	for {
+		length, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := buf[:length]
+
+		// Anything that doesn't match is a late answer to an earlier attempt
+		if length < 8 || binary.BigEndian.Uint32(resp[4:8]) != transactionID {
+			continue
+		}
+
+		respAction := binary.BigEndian.Uint32(resp[0:4])
+
+		if respAction == actionError {
+			return nil, &FailureError{Reason: string(resp[8:])}
+		}
+
+		if respAction != action {
+			return nil, fmt.Errorf("Expected action %d but got %d", action, respAction)
+		}
+
+		return resp[8:], nil
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func randomUint32() uint32 {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+
+	return binary.BigEndian.Uint32(buf)
+}
@@ -0,0 +1,297 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// standIn is an in-process UDP tracker. handle gets every packet that
+// arrives and returns the packets to answer with.
+type standIn struct {
+	conn   net.PacketConn
+	handle func(packet []byte) [][]byte
+
+	mu       sync.Mutex
+	connects int
+	received []uint32
+}
+
+func newStandIn(t *testing.T, handle func(s *standIn, packet []byte) [][]byte) *standIn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &standIn{conn: conn}
+	s.handle = func(packet []byte) [][]byte { return handle(s, packet) }
+
+	go s.serve()
+	t.Cleanup(func() { conn.Close() })
+
+	return s
+}
+
+func (s *standIn) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *standIn) serve() {
+	buf := make([]byte, 65536)
+
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		packet := append([]byte(nil), buf[:n]...)
+		if len(packet) < 16 {
+			continue
+		}
+
+		s.mu.Lock()
+		action := binary.BigEndian.Uint32(packet[8:12])
+		s.received = append(s.received, action)
+		if action == actionConnect {
+			s.connects++
+		}
+		s.mu.Unlock()
+
+		for _, resp := range s.handle(packet) {
+			s.conn.WriteTo(resp, from)
+		}
+	}
+}
+
+func (s *standIn) connectCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connects
+}
+
+const testConnectionID = 0x1122334455667788
+
+func transactionID(packet []byte) uint32 {
+	return binary.BigEndian.Uint32(packet[12:16])
+}
+
+func connectResponse(txn uint32, id uint64) []byte {
+	resp := make([]byte, 16)
+	binary.BigEndian.PutUint32(resp[0:4], actionConnect)
+	binary.BigEndian.PutUint32(resp[4:8], txn)
+	binary.BigEndian.PutUint64(resp[8:16], id)
+
+	return resp
+}
+
+func announceResponse(txn uint32) []byte {
+	resp := make([]byte, 20, 26)
+	binary.BigEndian.PutUint32(resp[0:4], actionAnnounce)
+	binary.BigEndian.PutUint32(resp[4:8], txn)
+	binary.BigEndian.PutUint32(resp[8:12], 1800)
+	binary.BigEndian.PutUint32(resp[12:16], 3)
+	binary.BigEndian.PutUint32(resp[16:20], 7)
+
+	return append(resp, 10, 0, 0, 1, 0x1a, 0xe1)
+}
+
+func errorResponse(txn uint32, reason string) []byte {
+	resp := make([]byte, 8)
+	binary.BigEndian.PutUint32(resp[0:4], actionError)
+	binary.BigEndian.PutUint32(resp[4:8], txn)
+
+	return append(resp, reason...)
+}
+
+// tracks answers connects and announces like a working tracker
+func tracks(s *standIn, packet []byte) [][]byte {
+	txn := transactionID(packet)
+
+	switch binary.BigEndian.Uint32(packet[8:12]) {
+	case actionConnect:
+		return [][]byte{connectResponse(txn, testConnectionID)}
+	case actionAnnounce:
+		if binary.BigEndian.Uint64(packet[0:8]) != testConnectionID {
+			return [][]byte{errorResponse(txn, "bad connection id")}
+		}
+
+		return [][]byte{announceResponse(txn)}
+	}
+
+	return nil
+}
+
+func testClient() *UDPClient {
+	c := NewUDPClient()
+	c.Timeout = 50 * time.Millisecond
+	c.MaxRetries = 2
+
+	return c
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	s := newStandIn(t, tracks)
+	c := testClient()
+
+	resp, err := c.Announce(context.Background(), s.addr(), AnnounceRequest{Port: 6881})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Interval != 1800 || resp.Leechers != 3 || resp.Seeders != 7 {
+		t.Errorf("Got interval %d, %d leechers and %d seeders", resp.Interval, resp.Leechers, resp.Seeders)
+	}
+
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "10.0.0.1:6881" {
+		t.Errorf("Got peers %v", resp.Peers)
+	}
+
+	// The connection ID is still good, so the second announce skips connecting
+	_, err = c.Announce(context.Background(), s.addr(), AnnounceRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := s.connectCount(); n != 1 {
+		t.Errorf("Connected %d times, expected 1", n)
+	}
+}
+
+func TestUDPTransactionMismatch(t *testing.T) {
+	s := newStandIn(t, func(s *standIn, packet []byte) [][]byte {
+		resps := tracks(s, packet)
+		if len(resps) == 0 {
+			return nil
+		}
+
+		// An answer to some other request arrives first
+		stale := append([]byte(nil), resps[0]...)
+		binary.BigEndian.PutUint32(stale[4:8], transactionID(packet)+1)
+
+		return append([][]byte{stale}, resps...)
+	})
+
+	resp, err := testClient().Announce(context.Background(), s.addr(), AnnounceRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Peers) != 1 {
+		t.Errorf("Got peers %v", resp.Peers)
+	}
+}
+
+func TestUDPErrorAction(t *testing.T) {
+	s := newStandIn(t, func(s *standIn, packet []byte) [][]byte {
+		if binary.BigEndian.Uint32(packet[8:12]) == actionAnnounce {
+			return [][]byte{errorResponse(transactionID(packet), "torrent not registered")}
+		}
+
+		return tracks(s, packet)
+	})
+	c := testClient()
+
+	_, err := c.Announce(context.Background(), s.addr(), AnnounceRequest{})
+
+	failure, ok := err.(*FailureError)
+	if !ok || failure.Reason != "torrent not registered" {
+		t.Fatalf("Expected a FailureError, got %v", err)
+	}
+
+	// The tracker might have forgotten the connection ID, so it isn't reused
+	c.Announce(context.Background(), s.addr(), AnnounceRequest{})
+
+	if n := s.connectCount(); n != 2 {
+		t.Errorf("Connected %d times, expected 2", n)
+	}
+}
+
+func TestUDPConnectionIDExpiry(t *testing.T) {
+	s := newStandIn(t, tracks)
+	c := testClient()
+
+	_, err := c.Announce(context.Background(), s.addr(), AnnounceRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Age the cached connection ID past its lifetime
+	c.mu.Lock()
+	id := c.ids[s.addr()]
+	id.obtained = time.Now().Add(-connectionIDLifetime)
+	c.ids[s.addr()] = id
+	c.mu.Unlock()
+
+	_, err = c.Announce(context.Background(), s.addr(), AnnounceRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := s.connectCount(); n != 2 {
+		t.Errorf("Connected %d times, expected 2", n)
+	}
+}
+
+func TestUDPRetransmit(t *testing.T) {
+	var mu sync.Mutex
+	dropped := false
+
+	s := newStandIn(t, func(s *standIn, packet []byte) [][]byte {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// Lose the first announce
+		if binary.BigEndian.Uint32(packet[8:12]) == actionAnnounce && !dropped {
+			dropped = true
+			return nil
+		}
+
+		return tracks(s, packet)
+	})
+
+	_, err := testClient().Announce(context.Background(), s.addr(), AnnounceRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	received := append([]uint32(nil), s.received...)
+	s.mu.Unlock()
+
+	announces := 0
+	for _, action := range received {
+		if action == actionAnnounce {
+			announces++
+		}
+	}
+
+	if announces != 2 {
+		t.Errorf("Sent %d announces, expected 2", announces)
+	}
+}
+
+func TestUDPTimeout(t *testing.T) {
+	s := newStandIn(t, func(s *standIn, packet []byte) [][]byte { return nil })
+	c := testClient()
+
+	start := time.Now()
+	_, err := c.Announce(context.Background(), s.addr(), AnnounceRequest{})
+
+	if err != ErrUDPTimeout {
+		t.Fatalf("Expected ErrUDPTimeout, got %v", err)
+	}
+
+	// 50ms + 100ms + 200ms
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Took %v to give up", elapsed)
+	}
+
+	if n := s.connectCount(); n != c.MaxRetries+1 {
+		t.Errorf("Sent %d connects, expected %d", n, c.MaxRetries+1)
+	}
+}